@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiPrefix         = "/api/v1"
+	maxApiMessageSize = 32 << 20
+	defaultApiLimit   = 20
+)
+
+type ApiBackendResult struct {
+	Score   float64  `json:"score"`
+	Action  string   `json:"action"`
+	Symbols []string `json:"symbols"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type ApiCheckResult struct {
+	Score    float64                      `json:"score"`
+	Action   string                       `json:"action"`
+	Strategy string                       `json:"strategy"`
+	Backends map[string]*ApiBackendResult `json:"backends"`
+	Error    string                       `json:"error,omitempty"`
+}
+
+type ApiAccount struct {
+	Name           string     `json:"name"`
+	Host           string     `json:"host"`
+	Username       string     `json:"username"`
+	Inbox          string     `json:"inbox"`
+	SpamFolder     string     `json:"spamFolder"`
+	Quarantine     string     `json:"quarantine"`
+	InboxBehaviour string     `json:"inboxBehaviour"`
+	Ok             bool       `json:"ok"`
+	UnreadMails    int        `json:"unreadMails"`
+	LastRun        *time.Time `json:"lastRun,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	LastResult     *RunResult `json:"lastResult,omitempty"`
+}
+
+type ApiHistoryElement struct {
+	Id        string    `json:"id,omitempty"`
+	Time      time.Time `json:"time"`
+	Account   string    `json:"account"`
+	Sender    string    `json:"sender"`
+	Subject   string    `json:"subject"`
+	MessageId string    `json:"messageId"`
+	Date      time.Time `json:"date"`
+	Score     float64   `json:"score"`
+	Action    string    `json:"action"`
+	Restored  bool      `json:"restored"`
+}
+
+type ApiHistoryPage struct {
+	Offset   int                  `json:"offset"`
+	Limit    int                  `json:"limit"`
+	Total    int                  `json:"total"`
+	Elements []*ApiHistoryElement `json:"elements"`
+}
+
+type ApiStatus struct {
+	Status string `json:"status"`
+}
+
+type ApiError struct {
+	Error string `json:"error"`
+}
+
+func (conf *Configuration) startApi(mux *http.ServeMux) {
+	mux.HandleFunc(apiPrefix+"/check", conf.handlerApiCheck)
+	mux.HandleFunc(apiPrefix+"/", conf.handlerApi)
+}
+
+// handlerApi dispatches the resource paths of the api:
+//
+//	GET  /api/v1/accounts
+//	GET  /api/v1/accounts/{name}
+//	POST /api/v1/accounts/{name}/scan
+//	POST /api/v1/scan
+//	GET  /api/v1/history?offset=0&limit=20&account=&action=
+//	GET  /api/v1/history/{id}
+//	POST /api/v1/history/{id}/ham|spam|restore
+func (conf *Configuration) handlerApi(w http.ResponseWriter, r *http.Request) {
+	if !conf.checkApiToken(w, r) {
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "accounts" && r.Method == http.MethodGet:
+		accounts := make([]*ApiAccount, 0)
+		for _, ic := range conf.ImapAccounts {
+			accounts = append(accounts, apiAccount(ic))
+		}
+		conf.renderJson(w, r, http.StatusOK, accounts)
+	case len(parts) == 2 && parts[0] == "accounts" && r.Method == http.MethodGet:
+		ic := conf.accountByName(parts[1])
+		if ic == nil {
+			conf.renderApiError(w, r, http.StatusNotFound, fmt.Sprintf("account '%s' not found", parts[1]))
+			return
+		}
+		conf.renderJson(w, r, http.StatusOK, apiAccount(ic))
+	case len(parts) == 3 && parts[0] == "accounts" && parts[2] == "scan" && r.Method == http.MethodPost:
+		ic := conf.accountByName(parts[1])
+		if ic == nil {
+			conf.renderApiError(w, r, http.StatusNotFound, fmt.Sprintf("account '%s' not found", parts[1]))
+			return
+		}
+		conf.apiScan(w, r, ic)
+	case len(parts) == 1 && parts[0] == "scan" && r.Method == http.MethodPost:
+		conf.apiScan(w, r, conf.ImapAccounts...)
+	case len(parts) == 1 && parts[0] == "history" && r.Method == http.MethodGet:
+		conf.apiHistory(w, r)
+	case len(parts) == 2 && parts[0] == "history" && r.Method == http.MethodGet:
+		qe := queue.byId(parts[1])
+		if qe == nil {
+			conf.renderApiError(w, r, http.StatusNotFound, fmt.Sprintf("message '%s' not found", parts[1]))
+			return
+		}
+		conf.renderJson(w, r, http.StatusOK, apiHistoryElement(qe))
+	case len(parts) == 3 && parts[0] == "history" && r.Method == http.MethodPost:
+		qe := queue.byId(parts[1])
+		if qe == nil {
+			conf.renderApiError(w, r, http.StatusNotFound, fmt.Sprintf("message '%s' not found", parts[1]))
+			return
+		}
+		conf.apiHistoryAction(w, r, qe, parts[2])
+	default:
+		conf.renderApiError(w, r, http.StatusNotFound, "not found")
+	}
+}
+
+// apiScan starts the scan of the accounts in the background. The results are shown in lastResult of the accounts.
+func (conf *Configuration) apiScan(w http.ResponseWriter, r *http.Request, accounts ...*ImapConfiguration) {
+	started := conf.startScan(func(results []*RunResult) {
+		for _, rr := range results {
+			log.Infof("scan of the api: %s", rr)
+		}
+	}, accounts...)
+	if !started {
+		conf.renderApiError(w, r, http.StatusConflict, "spamchecker is still working")
+		return
+	}
+	conf.renderJson(w, r, http.StatusAccepted, ApiStatus{Status: "started"})
+}
+
+func (conf *Configuration) apiHistory(w http.ResponseWriter, r *http.Request) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		conf.renderApiError(w, r, http.StatusBadRequest, "illegal offset")
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultApiLimit)
+	if err != nil || limit < 1 {
+		conf.renderApiError(w, r, http.StatusBadRequest, "illegal limit")
+		return
+	}
+	q := r.URL.Query()
+	entries, err := conf.readHistory(historyFilter{account: q.Get("account"), action: q.Get("action")}, 0)
+	if err != nil {
+		log.Errorf("error reading history: %v", err)
+		conf.renderApiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	p := ApiHistoryPage{
+		Offset:   offset,
+		Limit:    limit,
+		Total:    len(entries),
+		Elements: make([]*ApiHistoryElement, 0),
+	}
+	for i := len(entries) - 1 - offset; i >= 0 && len(p.Elements) < limit; i-- {
+		p.Elements = append(p.Elements, apiHistoryEntry(entries[i]))
+	}
+	conf.renderJson(w, r, http.StatusOK, p)
+}
+
+func (conf *Configuration) apiHistoryAction(w http.ResponseWriter, r *http.Request, qe *QueueElement, action string) {
+	var err error
+	switch action {
+	case "ham":
+		err = conf.learnHam(qe)
+	case "spam":
+		err = conf.learnSpam(qe)
+	case "restore":
+		err = qe.Account.restoreMessage(conf.key, qe)
+		if err == nil {
+			queue.markRestored(qe.Id)
+			if qe.Action == spamActionReject {
+				conf.appendHistory(&HistoryEntry{Time: time.Now(), Account: qe.Account.Name, Sender: qe.Sender,
+					Subject: qe.Subject, MessageId: qe.MessageId, Action: historyActionRelease})
+			}
+		}
+	default:
+		conf.renderApiError(w, r, http.StatusNotFound, fmt.Sprintf("unknown action '%s'", action))
+		return
+	}
+	if errors.Is(err, errSessionBusy) {
+		conf.renderApiError(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Errorf("error executing %s for message %s: %v", action, qe.Id, err)
+		conf.renderApiError(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	conf.renderJson(w, r, http.StatusOK, ApiStatus{Status: "ok"})
+}
+
+func apiAccount(ic *ImapConfiguration) *ApiAccount {
+	a := ApiAccount{
+		Name:           ic.Name,
+		Host:           ic.Host,
+		Username:       ic.Username,
+		Inbox:          ic.Inbox,
+		SpamFolder:     ic.SpamFolder,
+		Quarantine:     ic.quarantineFolder(),
+		InboxBehaviour: ic.InboxBehaviour,
+		Ok:             ic.Ok,
+		UnreadMails:    ic.UnreadMails,
+		LastError:      ic.LastError,
+	}
+	if !ic.LastRun.IsZero() {
+		lr := ic.LastRun
+		a.LastRun = &lr
+	}
+	a.LastResult = ic.LastResult
+	return &a
+}
+
+// apiHistoryEntry returns the entry of the history file. Mails which are still queued get the id for learning and
+// restoring them.
+func apiHistoryEntry(e *HistoryEntry) *ApiHistoryElement {
+	he := ApiHistoryElement{
+		Time:      e.Time,
+		Account:   e.Account,
+		Sender:    e.Sender,
+		Subject:   e.Subject,
+		MessageId: e.MessageId,
+		Date:      e.Date,
+		Score:     e.Score,
+		Action:    e.Action,
+	}
+	if qe := queue.byMessageId(e.Account, e.MessageId); qe != nil {
+		he.Id = qe.Id
+		he.Restored = qe.Restored
+	}
+	return &he
+}
+
+func apiHistoryElement(qe *QueueElement) *ApiHistoryElement {
+	score, _ := strconv.ParseFloat(qe.Score, 64)
+	return &ApiHistoryElement{
+		Id:        qe.Id,
+		Account:   qe.Account.Name,
+		Sender:    qe.Sender,
+		Subject:   qe.Subject,
+		MessageId: qe.MessageId,
+		Date:      qe.Time,
+		Score:     score,
+		Action:    qe.Action,
+		Restored:  qe.Restored,
+	}
+}
+
+func queryInt(r *http.Request, name string, defaultValue int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// handlerApiCheck scans the raw RFC 822 message in the request body and returns the verdict eatspam would use
+func (conf *Configuration) handlerApiCheck(w http.ResponseWriter, r *http.Request) {
+	if !conf.checkApiToken(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		conf.renderApiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxApiMessageSize))
+	if err != nil {
+		conf.renderApiError(w, r, http.StatusBadRequest, "error reading message: "+err.Error())
+		return
+	}
+	if len(b) == 0 {
+		conf.renderApiError(w, r, http.StatusBadRequest, "empty message")
+		return
+	}
+	result := conf.checkMessage(string(b))
+	status := http.StatusOK
+	if result.Error != "" {
+		status = http.StatusBadGateway
+	}
+	conf.renderJson(w, r, status, result)
+}
+
+// checkMessage scans the raw message and returns the verdict of every backend and the combined verdict
+func (conf *Configuration) checkMessage(body string) *ApiCheckResult {
+	sr := conf.scanMessage(nil, body)
+	result := ApiCheckResult{
+		Score:    sr.overall.score,
+		Action:   sr.overall.action,
+		Strategy: conf.Strategy,
+		Backends: map[string]*ApiBackendResult{},
+	}
+	if conf.Spamd.Use {
+		result.Backends[strategySpamd] = apiBackendResult(sr.spamd)
+	}
+	if conf.Rspamd.Use {
+		result.Backends[strategyRspamd] = apiBackendResult(sr.rspamd)
+	}
+	if sr.overall.err != nil {
+		result.Error = sr.overall.err.Error()
+	}
+	return &result
+}
+
+func apiBackendResult(c checkSpamResult) *ApiBackendResult {
+	br := ApiBackendResult{
+		Score:   c.score,
+		Action:  c.action,
+		Symbols: c.symbols,
+	}
+	if br.Symbols == nil {
+		br.Symbols = []string{}
+	}
+	if c.err != nil {
+		br.Error = c.err.Error()
+	}
+	return &br
+}
+
+// checkApiToken verifies the bearer token of the request against the configured api token
+func (conf *Configuration) checkApiToken(w http.ResponseWriter, r *http.Request) bool {
+	if conf.Http.ApiToken == "" {
+		conf.renderApiError(w, r, http.StatusForbidden, "api is disabled, no api token configured")
+		return false
+	}
+	token := ""
+	if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(a, "Bearer "))
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(conf.Http.apiToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="eatspam"`)
+		conf.renderApiError(w, r, http.StatusUnauthorized, "unauthorized")
+		return false
+	}
+	return true
+}
+
+func (conf *Configuration) renderJson(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		accessLog(r, http.StatusInternalServerError, "write json")
+		conf.pushRequests(r, http.StatusInternalServerError)
+		return
+	}
+	accessLog(r, status, "")
+	conf.pushRequests(r, status)
+}
+
+func (conf *Configuration) renderApiError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	conf.renderJson(w, r, status, ApiError{Error: msg})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/emersion/go-imap"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMail = "From: sender@example.com\r\nTo: rcpt@example.com\r\nSubject: test\r\n\r\nHello\r\n"
+
+func setupApiConfiguration(t *testing.T) *Configuration {
+	c := setupTestConfiguration()
+	c.key = generateKey()
+	token, err := encrypt("token", c.key)
+	if err != nil {
+		t.Fatalf("error encrypting token: %v", err)
+	}
+	c.Http.ApiToken = token
+	if err := c.resolveSecrets(); err != nil {
+		t.Fatalf("error resolving secrets: %v", err)
+	}
+	return c
+}
+
+func TestApiCheckUnauthorized(t *testing.T) {
+	c := setupApiConfiguration(t)
+	for _, token := range []string{"", "Bearer wrong", "token"} {
+		r := httptest.NewRequest(http.MethodPost, apiPrefix+"/check", strings.NewReader(testMail))
+		if token != "" {
+			r.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		c.handlerApiCheck(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected %d for authorization '%s', got %d", http.StatusUnauthorized, token, w.Code)
+		}
+	}
+}
+
+func TestApiCheck(t *testing.T) {
+	c := setupApiConfiguration(t)
+	r := httptest.NewRequest(http.MethodGet, apiPrefix+"/check", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	c.handlerApiCheck(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, apiPrefix+"/check", strings.NewReader(testMail))
+	r.Header.Set("Authorization", "Bearer token")
+	w = httptest.NewRecorder()
+	c.handlerApiCheck(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	result := ApiCheckResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("error unmarshalling result: %v", err)
+	}
+	if result.Action != spamActionNoAction || result.Strategy != strategyAverage || len(result.Backends) != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestApiCheckBackendError(t *testing.T) {
+	c := setupApiConfiguration(t)
+	c.Rspamd = RspamdConfiguration{Use: true, Host: "127.0.0.1", Port: 1}
+	r := httptest.NewRequest(http.MethodPost, apiPrefix+"/check", strings.NewReader(testMail))
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	c.handlerApiCheck(w, r)
+	result := ApiCheckResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("error unmarshalling result: %v", err)
+	}
+	if w.Code != http.StatusBadGateway || result.Error == "" {
+		t.Errorf("expected %d with the error of rspamd, got %d %+v", http.StatusBadGateway, w.Code, result)
+	}
+}
+
+func TestApiAccounts(t *testing.T) {
+	c := setupApiConfiguration(t)
+	c.ImapAccounts = []*ImapConfiguration{{Name: "a1", Host: "imap.example.com"}, {Name: "a2", Host: "imap.example.com", LastError: "failed"}}
+	r := httptest.NewRequest(http.MethodGet, apiPrefix+"/accounts", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	c.handlerApi(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	accounts := make([]*ApiAccount, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &accounts); err != nil {
+		t.Fatalf("error unmarshalling result: %v", err)
+	}
+	if len(accounts) != 2 || accounts[1].Name != "a2" || accounts[1].LastError != "failed" || accounts[1].LastRun != nil {
+		t.Errorf("unexpected accounts %+v", accounts)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, apiPrefix+"/accounts/unknown", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w = httptest.NewRecorder()
+	c.handlerApi(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestApiHistory(t *testing.T) {
+	c := setupApiConfiguration(t)
+	c.HistoryFile = filepath.Join(t.TempDir(), "eatspam.history")
+	ic := &ImapConfiguration{Name: "a1"}
+	queue = NewQueue()
+	now := time.Now()
+	for i, subject := range []string{"first", "second", "third"} {
+		msg := imap.Message{Envelope: &imap.Envelope{
+			Subject:   subject,
+			Sender:    []*imap.Address{{MailboxName: "sender", HostName: "example.com"}},
+			MessageId: "<" + subject + "@example.com>",
+			Date:      now,
+		}}
+		result := checkSpamResult{score: 1.0, action: spamActionNoAction}
+		e := historyEntry(ic, result, &msg)
+		e.Time = now.Add(time.Duration(i) * time.Minute)
+		c.appendHistory(e)
+		if subject == "second" {
+			queue.queueMessage(ic, result, &msg, subject, false)
+		}
+	}
+	c.appendHistory(&HistoryEntry{Time: now.Add(time.Hour), Account: "a2", Subject: "other", Action: spamActionReject})
+	page := func(query string) ApiHistoryPage {
+		r := httptest.NewRequest(http.MethodGet, apiPrefix+"/history?"+query, nil)
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		c.handlerApi(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		p := ApiHistoryPage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatalf("error unmarshalling result: %v", err)
+		}
+		return p
+	}
+	p := page("offset=1&limit=5&account=a1")
+	if p.Total != 3 || len(p.Elements) != 2 || p.Elements[0].Subject != "second" || p.Elements[1].Subject != "first" {
+		t.Errorf("unexpected page %+v", p)
+	}
+	if p.Elements[0].Account != "a1" || p.Elements[0].Sender != "sender@example.com" || p.Elements[0].Score != 1.0 || p.Elements[0].Id == "" {
+		t.Errorf("expected the queued mail with its id, got %+v", p.Elements[0])
+	}
+	if p.Elements[1].Id != "" {
+		t.Errorf("expected no id for a mail which is not queued, got %+v", p.Elements[1])
+	}
+	if p := page("action=" + url.QueryEscape(spamActionReject)); p.Total != 1 || p.Elements[0].Account != "a2" {
+		t.Errorf("expected the reject of a2, got %+v", p)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, apiPrefix+"/history?limit=0", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	c.handlerApi(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestApiScan(t *testing.T) {
+	c := setupApiConfiguration(t)
+	c.ImapAccounts = []*ImapConfiguration{{Name: "offline", Host: "127.0.0.1", Port: 1, TlsMode: tlsModeNone}}
+	post := func() int {
+		r := httptest.NewRequest(http.MethodPost, apiPrefix+"/accounts/offline/scan", nil)
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		c.handlerApi(w, r)
+		return w.Code
+	}
+	if code := post(); code != http.StatusAccepted {
+		t.Fatalf("expected %d, got %d", http.StatusAccepted, code)
+	}
+	c.cronMu.Lock()
+	c.cronMu.Unlock()
+	r := httptest.NewRequest(http.MethodGet, apiPrefix+"/accounts/offline", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	c.handlerApi(w, r)
+	a := ApiAccount{}
+	if err := json.Unmarshal(w.Body.Bytes(), &a); err != nil {
+		t.Fatalf("error unmarshalling result: %v", err)
+	}
+	if a.LastResult == nil || a.LastResult.Error == "" {
+		t.Errorf("expected the failed run as last result, got %+v", a)
+	}
+}
+
+func TestQueueMarkRestored(t *testing.T) {
+	queue = NewQueue()
+	msg := imap.Message{Envelope: &imap.Envelope{Subject: "restore me", Sender: []*imap.Address{{MailboxName: "sender", HostName: "example.com"}}}}
+	queue.queueMessage(&ImapConfiguration{Name: "a1"}, checkSpamResult{action: spamActionReject}, &msg, "body", false)
+	qe := queue.byId(queue.asList()[0].Id)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			queue.asList()
+		}
+		done <- true
+	}()
+	queue.markRestored(qe.Id)
+	<-done
+	if qe.Restored || !queue.asList()[0].Restored {
+		t.Errorf("expected the queued mail and not the copy to be restored")
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checkDialTimeout is the timeout for the connection tests of --check-config
+const checkDialTimeout = 5 * time.Second
+
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// configProblem is a problem of the config file. Line is 0 for problems without a position in the file.
+type configProblem struct {
+	Line    int
+	Message string
+}
+
+// configChecker collects all problems of a config file
+type configChecker struct {
+	root     *yaml.Node
+	problems []configProblem
+}
+
+// runCheckConfig prints all problems of the config file and returns the exit code
+func runCheckConfig(file string) int {
+	problems := checkConfigFile(file, true)
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+	for _, p := range problems {
+		if p.Line > 0 {
+			fmt.Printf("%s:%d: %s\n", file, p.Line, p.Message)
+		} else {
+			fmt.Printf("%s: %s\n", file, p.Message)
+		}
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Printf("%s: ok\n", file)
+	return 0
+}
+
+func (cc *configChecker) add(line int, format string, args ...interface{}) {
+	cc.problems = append(cc.problems, configProblem{Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// line returns the line of the value at path, e.g. line("imapAccounts", 0, "host"). For a missing value the line of
+// the nearest parent is returned.
+func (cc *configChecker) line(path ...interface{}) int {
+	n := cc.root
+	line := n.Line
+	for _, p := range path {
+		var next *yaml.Node
+		switch k := p.(type) {
+		case string:
+			if n.Kind == yaml.MappingNode {
+				next = mappingValue(n, k)
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && k < len(n.Content) {
+				next = n.Content[k]
+			}
+		}
+		if next == nil {
+			return line
+		}
+		n = next
+		line = n.Line
+	}
+	return line
+}
+
+// checkConfigFile loads the config file and returns all problems. With connect the secrets are resolved with the key
+// and the backends and IMAP servers are contacted.
+func checkConfigFile(file string, connect bool) []configProblem {
+	cc := configChecker{}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		cc.add(0, "error reading config file: %v", err)
+		return cc.problems
+	}
+	doc := yaml.Node{}
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		cc.addYamlError(err)
+		return cc.problems
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		cc.add(doc.Line, "config file is no yaml mapping")
+		return cc.problems
+	}
+	cc.root = doc.Content[0]
+	// decode strictly to find unknown keys and wrong types
+	c := Configuration{}
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(&c); err != nil {
+		cc.addYamlError(err)
+	}
+	c.parseArguments()
+	cc.checkAccounts(&c)
+	cc.checkBackends(&c)
+	cc.checkHttp(&c)
+	if connect {
+		cc.checkSecrets(&c)
+	}
+	if len(cc.problems) > 0 || !connect {
+		return cc.problems
+	}
+	// all defaults are set by loadConfig
+	lc, err := loadConfig(file)
+	if err != nil {
+		cc.add(0, "%v", err)
+		return cc.problems
+	}
+	lc.key = c.key
+	cc.checkConnections(lc)
+	return cc.problems
+}
+
+// addYamlError adds the lines of a yaml error as problems
+func (cc *configChecker) addYamlError(err error) {
+	messages := []string{err.Error()}
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		messages = te.Errors
+	}
+	for _, m := range messages {
+		if g := yamlErrorLine.FindStringSubmatch(m); g != nil {
+			line, _ := strconv.Atoi(g[1])
+			cc.add(line, "%s", g[2])
+		} else {
+			cc.add(0, "%s", strings.TrimPrefix(m, "yaml: "))
+		}
+	}
+}
+
+func (cc *configChecker) checkAccounts(c *Configuration) {
+	if len(c.ImapAccounts) == 0 {
+		cc.add(cc.line("imapAccounts"), "no imap accounts configured")
+	}
+	names := map[string]bool{}
+	for i, a := range c.ImapAccounts {
+		if a == nil {
+			cc.add(cc.line("imapAccounts", i), "empty imap account")
+			continue
+		}
+		at := func(key string) int {
+			return cc.line("imapAccounts", i, key)
+		}
+		if a.Name == "" {
+			cc.add(at("name"), "imap account without name")
+		} else if names[a.Name] {
+			cc.add(at("name"), "imap account %s is configured twice", a.Name)
+		}
+		names[a.Name] = true
+		if a.Username == "" || a.Host == "" {
+			cc.add(at("name"), "username and host are needed for imap account %s", a.Name)
+		}
+		switch a.Auth.Method {
+		case "", authPassword, authPlain, authLogin:
+			if a.Password == "" {
+				cc.add(at("name"), "password is needed for imap account %s", a.Name)
+			}
+		case authXoauth2, authOauthbearer:
+			if a.Auth.TokenEndpoint == "" || a.Auth.ClientId == "" || a.Auth.RefreshToken == "" {
+				cc.add(at("auth"), "auth.tokenEndpoint, auth.clientId and auth.refreshToken are needed for %s", a.Auth.Method)
+			}
+		default:
+			cc.add(at("auth"), "unknown auth method '%s'. Use %s, %s, %s, %s or %s", a.Auth.Method, authPassword, authPlain, authLogin, authXoauth2, authOauthbearer)
+		}
+		if a.Port < 0 || a.Port > 65535 {
+			cc.add(at("port"), "illegal port %d", a.Port)
+		}
+		if a.Tls != nil {
+			if a.TlsMode != "" {
+				cc.add(at("tls"), "tls is ignored, because tlsMode is set")
+			} else {
+				cc.add(at("tls"), "tls is deprecated. Use tlsMode: %s, %s or %s", tlsModeImplicit, tlsModeStarttls, tlsModeNone)
+			}
+		}
+		switch a.TlsMode {
+		case "", tlsModeImplicit, tlsModeStarttls:
+		case tlsModeNone:
+			if !isLoopback(a.Host) {
+				cc.add(at("tlsMode"), "tlsMode %s is only allowed for localhost, not for %s", tlsModeNone, a.Host)
+			}
+		default:
+			cc.add(at("tlsMode"), "unknown tlsMode '%s'. Use %s, %s or %s", a.TlsMode, tlsModeImplicit, tlsModeStarttls, tlsModeNone)
+		}
+		if a.TlsConfig.Pin != "" {
+			if _, err := parseFingerprint(a.TlsConfig.Pin); err != nil {
+				cc.add(cc.line("imapAccounts", i, "tlsConfig", "pin"), "%v", err)
+			}
+		}
+		for _, f := range [][2]string{{"caFile", a.TlsConfig.CaFile}, {"certFile", a.TlsConfig.CertFile}, {"keyFile", a.TlsConfig.KeyFile}} {
+			if _, err := os.Stat(f[1]); f[1] != "" && err != nil {
+				cc.add(cc.line("imapAccounts", i, "tlsConfig", f[0]), "%v", err)
+			}
+		}
+		if a.InboxBehaviour != "" && !contains(behaviours, a.InboxBehaviour) {
+			cc.add(at("inboxBehaviour"), "unknown inboxBehaviour '%s'. Use %s", a.InboxBehaviour, strings.Join(behaviours, ", "))
+		}
+		if a.MaxMessageSize != "" {
+			if _, err := parseSize(a.MaxMessageSize); err != nil {
+				cc.add(at("maxMessageSize"), "%v", err)
+			}
+		}
+		if a.LargeMessages != "" && !contains(largePolicies, a.LargeMessages) {
+			cc.add(at("largeMessages"), "unknown largeMessages policy '%s'. Use %s", a.LargeMessages, strings.Join(largePolicies, " or "))
+		}
+		for j, schedule := range a.Schedule {
+			if err := validateSchedule(schedule); err != nil {
+				cc.add(cc.line("imapAccounts", i, "schedule", j), "%v", err)
+			}
+		}
+		if a.QuietHours != "" {
+			if _, err := parseQuietHours(a.QuietHours); err != nil {
+				cc.add(at("quietHours"), "%v", err)
+			}
+		}
+		if a.Retention != "" {
+			if _, err := parseRetention(a.Retention); err != nil {
+				cc.add(at("quarantineRetention"), "%v", err)
+			}
+		}
+		if err := c.validateDigest(a); err != nil {
+			cc.add(at("digest"), "%v", err)
+		}
+	}
+}
+
+func (cc *configChecker) checkBackends(c *Configuration) {
+	if !c.Spamd.Use && !c.Rspamd.Use {
+		cc.add(cc.line("spamd"), "%v", errNoBackend)
+	}
+	if err := validateStrategy(c.Spamd.Use, c.Rspamd.Use, c.Strategy); err != nil {
+		cc.add(cc.line("strategy"), "%v", err)
+	}
+	if actions := mappingValue(cc.root, "actions"); actions != nil && actions.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(actions.Content); i += 2 {
+			k, v := actions.Content[i], actions.Content[i+1]
+			if _, err := strconv.ParseFloat(k.Value, 64); err != nil {
+				cc.add(k.Line, "illegal score '%s'", k.Value)
+			}
+			if !contains(actionNames, v.Value) {
+				cc.add(v.Line, "unknown action '%s'. Use %s", v.Value, strings.Join(actionNames, ", "))
+			}
+		}
+	}
+	if err := validateSchedule(c.Interval); err != nil {
+		cc.add(cc.line("interval"), "%v", err)
+	}
+	if c.QuietHours != "" {
+		if _, err := parseQuietHours(c.QuietHours); err != nil {
+			cc.add(cc.line("quietHours"), "%v", err)
+		}
+	}
+	if c.Retention != "" {
+		if _, err := parseRetention(c.Retention); err != nil {
+			cc.add(cc.line("quarantineRetention"), "%v", err)
+		}
+	}
+	if c.Fetch.BatchBytes != "" {
+		if _, err := parseSize(c.Fetch.BatchBytes); err != nil {
+			cc.add(cc.line("fetch", "batchBytes"), "%v", err)
+		}
+	}
+	if c.MaxMessageSize != "" {
+		if _, err := parseSize(c.MaxMessageSize); err != nil {
+			cc.add(cc.line("maxMessageSize"), "%v", err)
+		}
+	}
+	if c.Keepalive != "" {
+		if d, err := time.ParseDuration(c.Keepalive); err != nil || d <= 0 {
+			cc.add(cc.line("keepalive"), "illegal keepalive '%s', e.g. 5m", c.Keepalive)
+		}
+	}
+	if _, ok := string2Loglevel[c.LogLevel]; !ok {
+		cc.add(cc.line("logLevel"), "unknown logLevel '%s'", c.LogLevel)
+	}
+}
+
+func (cc *configChecker) checkHttp(c *Configuration) {
+	if c.Http.SessionTimeout != "" {
+		if d, err := time.ParseDuration(c.Http.SessionTimeout); err != nil || d <= 0 {
+			cc.add(cc.line("http", "sessionTimeout"), "illegal sessionTimeout '%s', e.g. 1h", c.Http.SessionTimeout)
+		}
+	}
+	if err := c.validateProxy(); err != nil {
+		cc.add(cc.line("http", "forwardAuth"), "%v", err)
+	}
+	if err := c.validateSmtp(); err != nil {
+		cc.add(cc.line("smtp"), "%v", err)
+	}
+	names := map[string]bool{}
+	for i, u := range c.Http.Users {
+		at := func(key string) int {
+			return cc.line("http", "users", i, key)
+		}
+		if u.Name == "" {
+			cc.add(at("name"), "http user without name")
+		} else if names[u.Name] {
+			cc.add(at("name"), "http user %s is configured twice", u.Name)
+		}
+		names[u.Name] = true
+		if u.PasswordHash == "" && c.Http.ForwardAuth.Header == "" {
+			cc.add(at("name"), "passwordHash is needed for http user %s without http.forwardAuth", u.Name)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); u.PasswordHash != "" && err != nil {
+			cc.add(at("passwordHash"), "passwordHash is no bcrypt hash. Use eatspam --hashPassword <password>")
+		}
+		if u.Role != "" && u.Role != roleAdmin && u.Role != roleUser {
+			cc.add(at("role"), "unknown role '%s'. Use %s or %s", u.Role, roleAdmin, roleUser)
+		}
+		for j, a := range u.Accounts {
+			if c.accountByName(a) == nil {
+				cc.add(cc.line("http", "users", i, "accounts", j), "unknown imap account '%s'", a)
+			}
+		}
+	}
+}
+
+// checkSecrets reads the key and checks that all secrets can be resolved
+func (cc *configChecker) checkSecrets(c *Configuration) {
+	b, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		cc.add(0, "error reading key file: %v", err)
+		return
+	}
+	c.key = strings.TrimSpace(string(b))
+	if _, err := parseKey(c.key); err != nil {
+		cc.add(0, "key file %s: %v", c.KeyFile, err)
+		return
+	}
+	check := func(value string, path ...interface{}) {
+		if _, err := resolveSecret(value, c.key); err != nil {
+			cc.add(cc.line(path...), "%s: %v", path[len(path)-1], err)
+		}
+	}
+	check(c.Http.Password, "http", "password")
+	check(c.Http.ApiToken, "http", "apiToken")
+	check(c.Smtp.Password, "smtp", "password")
+	for i, a := range c.ImapAccounts {
+		if a == nil {
+			continue
+		}
+		check(a.Password, "imapAccounts", i, "password")
+		check(a.Auth.ClientSecret, "imapAccounts", i, "auth", "clientSecret")
+		check(a.Auth.RefreshToken, "imapAccounts", i, "auth", "refreshToken")
+	}
+}
+
+// checkConnections contacts the backends and logs in to the IMAP accounts
+func (cc *configChecker) checkConnections(c *Configuration) {
+	dial := func(name string, host string, port int) {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), checkDialTimeout)
+		if err != nil {
+			cc.add(cc.line(name), "%s is not reachable: %v", name, err)
+			return
+		}
+		conn.Close()
+	}
+	if c.Spamd.Use {
+		dial("spamd", c.Spamd.Host, c.Spamd.Port)
+	}
+	if c.Rspamd.Use {
+		dial("rspamd", c.Rspamd.Host, c.Rspamd.Port)
+	}
+	for i, ic := range c.ImapAccounts {
+		err := ic.resolveSecrets(c.key)
+		if err == nil {
+			_, err = ic.testConnection(c.key)
+		}
+		if err != nil {
+			cc.add(cc.line("imapAccounts", i), "imap account %s: %v", ic.Name, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const checkTestConfig = `imapAccounts:
+  - name: alice
+    username: alice
+    password: env:EATSPAM_TEST_PASSWORD
+    host: imap.example.com
+    tlsMode: plain
+  - name: alice
+    username: alice
+    host: imap.example.com
+    tls: false
+    inboxBehavior: unseen
+strategy: avg
+interval: 90
+actions:
+  5.0: add headers
+http:
+  users:
+    - name: bob
+      passwordHash: secret
+      accounts:
+        - carol
+`
+
+func TestCheckConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "eatspam.yaml")
+	if err := os.WriteFile(file, []byte(checkTestConfig), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	problems := checkConfigFile(file, false)
+	expected := map[int]string{
+		6:  "unknown tlsMode 'plain'",
+		7:  "imap account alice is configured twice",
+		10: "tls is deprecated",
+		11: "field inboxBehavior not found",
+		12: "unknown strategy 'avg'",
+		13: "illegal interval '90'",
+		15: "unknown action 'add headers'",
+		19: "passwordHash is no bcrypt hash",
+		21: "unknown imap account 'carol'",
+	}
+	for line, msg := range expected {
+		found := false
+		for _, p := range problems {
+			if p.Line == line && strings.Contains(p.Message, msg) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected '%s' in line %d, got %v", msg, line, problems)
+		}
+	}
+	if err := os.WriteFile(file, []byte("imapAccounts:\n  - name: [\n"), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	if problems := checkConfigFile(file, false); len(problems) != 1 || problems[0].Line == 0 {
+		t.Errorf("expected one syntax error with line, got %v", problems)
+	}
+}
+
+func TestCheckConfigConnections(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "eatspam.key")
+	if err := os.WriteFile(keyFile, []byte(testKey+"\n"), 0600); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+	ic, _ := startTestImapServer(t, testKey)
+	spamd, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer spamd.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	closed.Close()
+	config := fmt.Sprintf(`keyFile: %s
+imapAccounts:
+  - name: test
+    username: username
+    password: %s
+    host: 127.0.0.1
+    port: %d
+    tlsConfig:
+      pin: %s
+spamd:
+  use: true
+  host: 127.0.0.1
+  port: %d
+rspamd:
+  use: false
+`, keyFile, ic.Password, ic.Port, ic.TlsConfig.Pin, spamd.Addr().(*net.TCPAddr).Port)
+	file := filepath.Join(dir, "eatspam.yaml")
+	if err := os.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	if problems := checkConfigFile(file, true); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+
+	config = strings.Replace(config, ic.Password, "00"+ic.Password[2:], 1)
+	config = strings.Replace(config, fmt.Sprintf("port: %d\nrspamd", spamd.Addr().(*net.TCPAddr).Port), fmt.Sprintf("port: %d\nrspamd", closed.Addr().(*net.TCPAddr).Port), 1)
+	if err := os.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	problems := checkConfigFile(file, true)
+	if len(problems) != 1 || problems[0].Line != 5 || !strings.Contains(problems[0].Message, "decryption failed") {
+		t.Errorf("expected decryption error in line 5, got %v", problems)
+	}
+}
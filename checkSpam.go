@@ -5,12 +5,36 @@ import (
 	"github.com/emersion/go-imap"
 	log "github.com/sirupsen/logrus"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type checkSpamResult struct {
-	score  float64
-	action string
-	err    error
+	score   float64
+	action  string
+	symbols []string
+	err     error
+}
+
+// RunResult summarizes the check of one account
+type RunResult struct {
+	Account  string         `json:"account"`
+	Started  time.Time      `json:"started"`
+	Duration float64        `json:"duration"`
+	Checked  int            `json:"checked"`
+	Skipped  int            `json:"skipped"`
+	Deferred int            `json:"deferred,omitempty"`
+	Purged   int            `json:"purged,omitempty"`
+	Actions  map[string]int `json:"actions"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// scanResult contains the result of every configured backend and the result combined by the configured strategy
+type scanResult struct {
+	spamd   checkSpamResult
+	rspamd  checkSpamResult
+	overall checkSpamResult
 }
 
 const (
@@ -25,35 +49,94 @@ const (
 var queue = NewQueue()
 
 func (conf *Configuration) spamChecker() error {
-	for _, ic := range conf.ImapAccounts {
-		err := ic.checkSpam(conf)
-		if err != nil {
-			log.Errorf("error checking mail on %s: %v", ic.Host, err)
+	conf.checkAccounts(conf.ImapAccounts...)
+	return nil
+}
+
+// checkAccounts checks the given accounts with up to Concurrency.Accounts accounts in parallel
+func (conf *Configuration) checkAccounts(accounts ...*ImapConfiguration) []*RunResult {
+	results := make([]*RunResult, len(accounts))
+	sem := make(chan struct{}, positive(conf.Concurrency.Accounts))
+	var wg sync.WaitGroup
+	for i, ic := range accounts {
+		sem <- struct{}{}
+		if conf.stopping() {
+			<-sem
+			results[i] = &RunResult{Account: ic.Name, Started: time.Now(), Actions: map[string]int{}, Error: "skipped, eatspam is shutting down"}
+			continue
 		}
+		wg.Add(1)
+		go func(i int, ic *ImapConfiguration) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = conf.checkAccount(ic)
+		}(i, ic)
 	}
-	return nil
+	wg.Wait()
+	return results
 }
 
-func (ic *ImapConfiguration) checkSpam(conf *Configuration) error {
-	log.Infof("start checking mail for account %s on host %s", ic.Name, ic.Host)
-	err := ic.connect()
+// checkAccount checks the mails of one account and records the status of the run
+func (conf *Configuration) checkAccount(ic *ImapConfiguration) *RunResult {
+	rr := RunResult{
+		Account: ic.Name,
+		Started: time.Now(),
+		Actions: map[string]int{},
+	}
+	err := ic.checkSpam(conf, &rr)
+	rr.Duration = time.Since(rr.Started).Seconds()
+	ic.LastRun = time.Now()
+	ic.LastResult = &rr
+	ic.LastError = ""
 	if err != nil {
-		return fmt.Errorf("error: imap connect to %s for account %s failed: %v", ic.Host, ic.Name, err)
+		ic.Ok = false
+		ic.LastError = err.Error()
+		rr.Error = err.Error()
+		log.Errorf("error checking mail on %s: %v", ic.Host, err)
 	}
-	defer func() {
-		err := ic.client.Logout()
-		if err != nil {
-			log.Errorf("error logging out: %v", err)
+	return &rr
+}
+
+func (rr *RunResult) String() string {
+	if rr.Error != "" {
+		return fmt.Sprintf("%s: %s", rr.Account, rr.Error)
+	}
+	actions := make([]string, 0)
+	for a, n := range rr.Actions {
+		actions = append(actions, fmt.Sprintf("%s: %d", a, n))
+	}
+	if rr.Skipped > 0 {
+		actions = append(actions, fmt.Sprintf("skipped: %d", rr.Skipped))
+	}
+	if rr.Deferred > 0 {
+		actions = append(actions, fmt.Sprintf("deferred: %d", rr.Deferred))
+	}
+	if rr.Purged > 0 {
+		actions = append(actions, fmt.Sprintf("purged: %d", rr.Purged))
+	}
+	sort.Strings(actions)
+	if len(actions) == 0 {
+		return fmt.Sprintf("%s: checked %d mails", rr.Account, rr.Checked)
+	}
+	return fmt.Sprintf("%s: checked %d mails (%s)", rr.Account, rr.Checked, strings.Join(actions, ", "))
+}
+
+func (conf *Configuration) accountByName(name string) *ImapConfiguration {
+	for _, ic := range conf.ImapAccounts {
+		if ic.Name == name {
+			return ic
 		}
-	}()
+	}
+	return nil
+}
 
-	pw, err := decrypt(ic.Password, conf.key)
+func (ic *ImapConfiguration) checkSpam(conf *Configuration, rr *RunResult) error {
+	log.Infof("start checking mail for account %s on host %s", ic.Name, ic.Host)
+	err := ic.openSession(conf.key)
 	if err != nil {
-		return fmt.Errorf("error decrypting password for %s: %v", ic.Host, err)
-	}
-	if err := ic.client.Login(ic.Username, pw); err != nil {
-		return fmt.Errorf("error login to %s: %v", ic.Host, err)
+		return err
 	}
+	defer ic.closeSession()
 
 	ic.Ok = true
 	mbox, err := ic.client.Select(ic.Inbox, false)
@@ -61,7 +144,7 @@ func (ic *ImapConfiguration) checkSpam(conf *Configuration) error {
 		return fmt.Errorf("error selecting INBOX %s for fetching: %v", ic.Inbox, err)
 	}
 	if mbox.Messages == 0 {
-		return nil
+		return ic.purgeQuarantine(conf, rr, time.Now())
 	}
 	ids, err := ic.searchMails()
 	if err != nil {
@@ -69,41 +152,216 @@ func (ic *ImapConfiguration) checkSpam(conf *Configuration) error {
 	}
 	ic.UnreadMails = len(ids)
 	ids = reverseSort(ids)
-	for _, id := range ids {
-		msg, s, err := ic.getMessage(id)
-		spamdChan := make(chan checkSpamResult)
-		rspamdChan := make(chan checkSpamResult)
-		if conf.Spamd.Use {
-			go conf.Spamd.spamdCheckIfSpam(s, conf.Actions, spamdChan)
-		}
-		if conf.Rspamd.Use {
-			go conf.Rspamd.rspamdCheckIfSpam(s, rspamdChan)
+	// without the sizes maxMessageSize cannot be applied
+	ic.mu.Lock()
+	sizes, err := ic.fetchSizes(ids)
+	ic.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for sm := range ic.scanPipeline(conf, ids, sizes) {
+		if conf.stopping() {
+			// the remaining mails are processed by the next run
+			continue
 		}
-		result := conf.overallResult(msg, spamdChan, rspamdChan)
-		if result.err == nil {
-			conf.pushAction(result.action)
-			err = ic.doAction(id, result, conf)
-			if err != nil {
-				continue
+		ic.processMessage(conf, rr, sm)
+	}
+	if conf.stopping() {
+		log.Infof("stopped checking mail for account %s on host %s", ic.Name, ic.Host)
+		return nil
+	}
+	err = ic.purgeQuarantine(conf, rr, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Infof("end checking mail for account %s on host %s", ic.Name, ic.Host)
+	return nil
+}
+
+// scannedMessage is a message on its way through the scan pipeline of an account
+type scannedMessage struct {
+	index     int
+	id        uint32
+	msg       *imap.Message
+	body      string
+	truncated bool
+	skipped   bool
+	err       error
+	result    checkSpamResult
+}
+
+// scanPipeline fetches the messages ids in batches in the background, keeps up to Concurrency.Scans scanner requests in flight
+// and returns the scanned messages in the order of ids. Processing the messages in the given (descending) order is
+// needed because deleting a message changes the sequence numbers of all following messages. sizes are the
+// RFC822.SIZE of the messages.
+func (ic *ImapConfiguration) scanPipeline(conf *Configuration, ids []uint32, sizes map[uint32]uint32) chan *scannedMessage {
+	fetched := make(chan *scannedMessage, positive(conf.Concurrency.Prefetch))
+	go func() {
+		defer close(fetched)
+		i := 0
+		for _, batch := range batches(ids, sizes, positive(conf.Fetch.BatchSize), conf.Fetch.batchBytes) {
+			if conf.stopping() {
+				return
+			}
+			normal := make([]uint32, 0)
+			for _, id := range batch {
+				if !ic.isLargeId(sizes, id) {
+					normal = append(normal, id)
+				}
+			}
+			msgs := map[uint32]*imap.Message{}
+			var err error
+			if len(normal) > 0 {
+				ic.mu.Lock()
+				var fetchedMsgs []*imap.Message
+				fetchedMsgs, err = ic.fetchBatch(normal)
+				ic.mu.Unlock()
+				for j, msg := range fetchedMsgs {
+					msgs[normal[j]] = msg
+				}
 			}
-			queue.queueMessage(ic, result, msg, s)
-			if ic.InboxBehaviour == behaviourEatspam &&
-				result.action != spamActionReject &&
-				result.action != spamActionAddHeader &&
-				result.action != spamActionRewriteSubject {
-				err = ic.markAsEatspamSeen(id)
-				if err != nil {
-					log.Errorf("error adding flag %s to mail in account %s: %v", eatspamSeenFlag, ic.Name, err)
+			for _, id := range batch {
+				sm := scannedMessage{index: i, id: id}
+				i++
+				if ic.isLargeId(sizes, id) {
+					ic.fetchLarge(&sm, sizes[id])
+				} else if err != nil {
+					sm.err = err
+					log.Errorf("error fetching message %d from account %s: %v", id, ic.Name, err)
+				} else if msgs[id] == nil {
+					sm.err = fmt.Errorf("message %d not found", id)
+					log.Errorf("error fetching message %d from account %s: %v", id, ic.Name, sm.err)
+				} else {
+					sm.msg = msgs[id]
+					sm.body, sm.err = body(sm.msg)
 				}
+				fetched <- &sm
 			}
 		}
+	}()
+
+	scans := positive(conf.Concurrency.Scans)
+	scanned := make(chan *scannedMessage, scans)
+	var wg sync.WaitGroup
+	for i := 0; i < scans; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sm := range fetched {
+				if sm.err == nil && !sm.skipped {
+					sm.result = conf.scanMessage(sm.msg, sm.body).overall
+				}
+				scanned <- sm
+			}
+		}()
 	}
-	log.Infof("end checking mail for account %s on host %s", ic.Name, ic.Host)
-	return nil
+	go func() {
+		wg.Wait()
+		close(scanned)
+	}()
+	return inOrder(scanned)
 }
 
-func (ic *ImapConfiguration) doAction(id uint32, result checkSpamResult, conf *Configuration) error {
+// fetchLarge handles a message bigger than the maximum message size with the policy of the account.
+// It is skipped or only the first maxMessageSize bytes are fetched for scanning.
+func (ic *ImapConfiguration) fetchLarge(sm *scannedMessage, size uint32) {
+	if ic.LargeMessages == largeMessageSkip {
+		log.Infof("message %d in account %s has %d bytes and exceeds the maximum size of %d bytes. Skip it", sm.id, ic.Name, size, ic.maxMessageSize)
+		sm.skipped = true
+		return
+	}
+	log.Infof("message %d in account %s has %d bytes and exceeds the maximum size of %d bytes. Check it truncated", sm.id, ic.Name, size, ic.maxMessageSize)
+	ic.mu.Lock()
+	sm.msg, sm.err = ic.fetchTruncated(sm.id, ic.maxMessageSize)
+	ic.mu.Unlock()
+	if sm.err != nil {
+		log.Errorf("error fetching message %d from account %s: %v", sm.id, ic.Name, sm.err)
+		return
+	}
+	sm.truncated = true
+	sm.body, sm.err = body(sm.msg)
+}
+
+// inOrder returns the messages of scanned ordered by their index
+func inOrder(scanned chan *scannedMessage) chan *scannedMessage {
+	ordered := make(chan *scannedMessage)
+	go func() {
+		defer close(ordered)
+		pending := map[int]*scannedMessage{}
+		next := 0
+		for sm := range scanned {
+			pending[sm.index] = sm
+			for p, ok := pending[next]; ok; p, ok = pending[next] {
+				delete(pending, next)
+				ordered <- p
+				next++
+			}
+		}
+	}()
+	return ordered
+}
+
+// processMessage executes the action for a scanned message. IMAP commands are serialized with the other users of the connection.
+func (ic *ImapConfiguration) processMessage(conf *Configuration, rr *RunResult, sm *scannedMessage) {
+	if sm.err != nil {
+		return
+	}
+	if sm.skipped {
+		rr.Skipped++
+		if ic.InboxBehaviour == behaviourEatspam {
+			ic.mu.Lock()
+			defer ic.mu.Unlock()
+			err := ic.markAsEatspamSeen(sm.id)
+			if err != nil {
+				log.Errorf("error adding flag %s to mail in account %s: %v", eatspamSeenFlag, ic.Name, err)
+			}
+		}
+		return
+	}
+	rr.Checked++
+	result := sm.result
+	if result.err != nil {
+		return
+	}
+	if (result.action == spamActionAddHeader || result.action == spamActionRewriteSubject) && ic.inQuietHours(time.Now()) {
+		// the mail stays unprocessed and is rewritten by the first run after the quiet hours
+		log.Infof("quiet hours of account %s. Action %s for message %d is deferred", ic.Name, result.action, sm.id)
+		rr.Deferred++
+		return
+	}
+	rr.Actions[result.action]++
+	conf.pushAction(result.action)
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	err := ic.doAction(sm, conf)
+	if err != nil {
+		return
+	}
+	queue.queueMessage(ic, result, sm.msg, sm.body, sm.truncated)
+	conf.appendHistory(historyEntry(ic, result, sm.msg))
+	if ic.InboxBehaviour == behaviourEatspam &&
+		result.action != spamActionReject &&
+		result.action != spamActionAddHeader &&
+		result.action != spamActionRewriteSubject {
+		err = ic.markAsEatspamSeen(sm.id)
+		if err != nil {
+			log.Errorf("error adding flag %s to mail in account %s: %v", eatspamSeenFlag, ic.Name, err)
+		}
+	}
+}
+
+func (ic *ImapConfiguration) doAction(sm *scannedMessage, conf *Configuration) error {
+	id := sm.id
+	result := sm.result
 	var err error
+	if sm.truncated && (result.action == spamActionAddHeader || result.action == spamActionRewriteSubject) {
+		// rewriting needs the whole message
+		sm.msg, sm.body, err = ic.getMessage(id)
+		if err != nil {
+			return err
+		}
+		sm.truncated = false
+	}
 	switch result.action {
 	case spamActionReject:
 		log.Infof("action for message %d is %s. Move to spam folder", id, result.action)
@@ -113,13 +371,13 @@ func (ic *ImapConfiguration) doAction(id uint32, result checkSpamResult, conf *C
 		}
 	case spamActionAddHeader:
 		log.Infof("action for message %d is %s", id, result.action)
-		err = ic.markSpamInHeader(result.score, true, id)
+		err = ic.markSpamInHeader(result.score, true, id, sm.msg, sm.body)
 		if err != nil {
 			log.Errorf("error adding header to spam mail %d: %v", id, err)
 		}
 	case spamActionRewriteSubject:
 		log.Infof("action for message %d is %s", id, result.action)
-		err = ic.markSpamInSubject(conf.SpamPrefix, id)
+		err = ic.markSpamInSubject(conf.SpamPrefix, id, sm.msg, sm.body)
 		if err != nil {
 			log.Errorf("error rewriting subject of spam mail %d: %v", id, err)
 		}
@@ -131,14 +389,28 @@ func (ic *ImapConfiguration) doAction(id uint32, result checkSpamResult, conf *C
 	return err
 }
 
-func (conf *Configuration) overallResult(msg *imap.Message, spamdChan chan checkSpamResult, rspamdChan chan checkSpamResult) checkSpamResult {
-	var spamdResult, rspamdResult checkSpamResult
+// scanMessage checks the raw message s against all configured backends and combines the results
+func (conf *Configuration) scanMessage(msg *imap.Message, s string) scanResult {
+	spamdChan := make(chan checkSpamResult, 1)
+	rspamdChan := make(chan checkSpamResult, 1)
 	if conf.Spamd.Use {
-		spamdResult = <-spamdChan
+		go conf.Spamd.spamdCheckIfSpam(s, conf.Actions, spamdChan)
 	}
 	if conf.Rspamd.Use {
-		rspamdResult = <-rspamdChan
+		go conf.Rspamd.rspamdCheckIfSpam(s, rspamdChan)
 	}
+	var sr scanResult
+	if conf.Spamd.Use {
+		sr.spamd = <-spamdChan
+	}
+	if conf.Rspamd.Use {
+		sr.rspamd = <-rspamdChan
+	}
+	sr.overall = conf.overallResult(msg, sr.spamd, sr.rspamd)
+	return sr
+}
+
+func (conf *Configuration) overallResult(msg *imap.Message, spamdResult checkSpamResult, rspamdResult checkSpamResult) checkSpamResult {
 	switch conf.Strategy {
 	case strategyAverage:
 		averageResult := checkSpamResult{
@@ -150,14 +422,14 @@ func (conf *Configuration) overallResult(msg *imap.Message, spamdChan chan check
 			averageResult.err = spamdResult.err
 			log.Errorf("spamd error: %v", spamdResult.err)
 		} else if conf.Spamd.Use {
-			log.Debugf("spamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, spamdResult.score, spamdResult.action)
+			log.Debugf("spamd score for %s is %0.1f with action=%s", messageInfo(msg), spamdResult.score, spamdResult.action)
 			averageResult = spamdResult
 		}
 		if rspamdResult.err != nil {
 			averageResult.err = rspamdResult.err
 			log.Errorf("rspamd error: %v", rspamdResult.err)
 		} else if conf.Rspamd.Use {
-			log.Debugf("rspamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, rspamdResult.score, rspamdResult.action)
+			log.Debugf("rspamd score for %s is %0.1f with action=%s", messageInfo(msg), rspamdResult.score, rspamdResult.action)
 			if conf.Spamd.Use {
 				averageResult.score = (averageResult.score + rspamdResult.score) / 2
 			} else {
@@ -167,26 +439,35 @@ func (conf *Configuration) overallResult(msg *imap.Message, spamdChan chan check
 		return checkSpamResult{
 			score:  averageResult.score,
 			action: conf.averageAction(averageResult.score),
+			err:    averageResult.err,
 		}
 	case strategySpamd:
 		if !conf.Spamd.Use {
-			log.Fatal("stategy spamd is set but spamd is not configured for use")
+			return checkSpamResult{
+				score:  0.0,
+				action: spamActionNoAction,
+				err:    fmt.Errorf("strategy spamd is set but spamd is not configured for use"),
+			}
 		}
-		log.Debugf("spamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, spamdResult.score, spamdResult.action)
+		log.Debugf("spamd score for %s is %0.1f with action=%s", messageInfo(msg), spamdResult.score, spamdResult.action)
 		return spamdResult
 	case strategyRspamd:
 		if !conf.Rspamd.Use {
-			log.Fatal("stategy rspamd is set but rspamd is not configured for use")
+			return checkSpamResult{
+				score:  0.0,
+				action: spamActionNoAction,
+				err:    fmt.Errorf("strategy rspamd is set but rspamd is not configured for use"),
+			}
 		}
-		log.Debugf("rspamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, rspamdResult.score, rspamdResult.action)
+		log.Debugf("rspamd score for %s is %0.1f with action=%s", messageInfo(msg), rspamdResult.score, rspamdResult.action)
 		return rspamdResult
 	case strategyLowest:
 		if conf.Spamd.Use && conf.Rspamd.Use {
 			if spamdResult.score < rspamdResult.score {
-				log.Debugf("spamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, spamdResult.score, spamdResult.action)
+				log.Debugf("spamd score for %s is %0.1f with action=%s", messageInfo(msg), spamdResult.score, spamdResult.action)
 				return spamdResult
 			}
-			log.Debugf("rspamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, rspamdResult.score, rspamdResult.action)
+			log.Debugf("rspamd score for %s is %0.1f with action=%s", messageInfo(msg), rspamdResult.score, rspamdResult.action)
 			return rspamdResult
 		} else if !conf.Spamd.Use && !conf.Rspamd.Use {
 			return checkSpamResult{
@@ -195,18 +476,18 @@ func (conf *Configuration) overallResult(msg *imap.Message, spamdChan chan check
 				err:    fmt.Errorf("spamd and rspamd are noch configured for use"),
 			}
 		} else if conf.Spamd.Use {
-			log.Debugf("spamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, spamdResult.score, spamdResult.action)
+			log.Debugf("spamd score for %s is %0.1f with action=%s", messageInfo(msg), spamdResult.score, spamdResult.action)
 			return spamdResult
 		}
-		log.Debugf("rspamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, rspamdResult.score, rspamdResult.action)
+		log.Debugf("rspamd score for %s is %0.1f with action=%s", messageInfo(msg), rspamdResult.score, rspamdResult.action)
 		return rspamdResult
 	case strategyHighest:
 		if conf.Spamd.Use && conf.Rspamd.Use {
 			if spamdResult.score > rspamdResult.score {
-				log.Debugf("spamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, spamdResult.score, spamdResult.action)
+				log.Debugf("spamd score for %s is %0.1f with action=%s", messageInfo(msg), spamdResult.score, spamdResult.action)
 				return spamdResult
 			}
-			log.Debugf("rspamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, rspamdResult.score, rspamdResult.action)
+			log.Debugf("rspamd score for %s is %0.1f with action=%s", messageInfo(msg), rspamdResult.score, rspamdResult.action)
 			return rspamdResult
 		} else if !conf.Spamd.Use && !conf.Rspamd.Use {
 			return checkSpamResult{
@@ -215,10 +496,10 @@ func (conf *Configuration) overallResult(msg *imap.Message, spamdChan chan check
 				err:    fmt.Errorf("spamd and rspamd are noch configured for use"),
 			}
 		} else if conf.Spamd.Use {
-			log.Debugf("spamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, spamdResult.score, spamdResult.action)
+			log.Debugf("spamd score for %s is %0.1f with action=%s", messageInfo(msg), spamdResult.score, spamdResult.action)
 			return spamdResult
 		}
-		log.Debugf("rspamd score for '%s'(%d) is %0.1f with action=%s", msg.Envelope.Subject, msg.SeqNum, rspamdResult.score, rspamdResult.action)
+		log.Debugf("rspamd score for %s is %0.1f with action=%s", messageInfo(msg), rspamdResult.score, rspamdResult.action)
 		return rspamdResult
 	}
 	return checkSpamResult{
@@ -228,6 +509,14 @@ func (conf *Configuration) overallResult(msg *imap.Message, spamdChan chan check
 	}
 }
 
+// messageInfo describes msg for log messages. msg is nil for messages not coming from an IMAP account
+func messageInfo(msg *imap.Message) string {
+	if msg == nil || msg.Envelope == nil {
+		return "message"
+	}
+	return fmt.Sprintf("'%s'(%d)", msg.Envelope.Subject, msg.SeqNum)
+}
+
 func (conf *Configuration) averageAction(score float64) string {
 	keys := make([]float64, 0)
 	for k, _ := range conf.Actions {
@@ -243,6 +532,14 @@ func (conf *Configuration) averageAction(score float64) string {
 	return spamActionNoAction
 }
 
+// positive returns n or 1 if n is not positive
+func positive(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
 func reverseSort(ids []uint32) []uint32 {
 	sort.Slice(ids, func(i, j int) bool {
 		return ids[i] > ids[j]
@@ -251,29 +548,20 @@ func reverseSort(ids []uint32) []uint32 {
 }
 
 func (conf *Configuration) learnHam(qe *QueueElement) error {
-	var errSpamd, errRspamd error
-	if conf.Spamd.Use {
-		errSpamd = nil
-	}
-	if conf.Rspamd.Use {
-		errRspamd = conf.Rspamd.learnHam(qe.Body)
-	}
-	if errSpamd != nil {
-		return errSpamd
-	}
-	return errRspamd
+	return conf.learn(qe.Body, false)
 }
 
 func (conf *Configuration) learnSpam(qe *QueueElement) error {
-	var errSpamd, errRspamd error
-	if conf.Spamd.Use {
-		errSpamd = nil
-	}
-	if conf.Rspamd.Use {
-		errRspamd = conf.Rspamd.learnSpam(qe.Body)
+	return conf.learn(qe.Body, true)
+}
+
+// learn trains the backends with the raw message body as spam or ham. Only rspamd can be trained.
+func (conf *Configuration) learn(body string, spam bool) error {
+	if !conf.Rspamd.Use {
+		return nil
 	}
-	if errSpamd != nil {
-		return errSpamd
+	if spam {
+		return conf.Rspamd.learnSpam(body)
 	}
-	return errRspamd
+	return conf.Rspamd.learnHam(body)
 }
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"github.com/emersion/go-imap"
 	"testing"
 )
 
-func setupTestConfiguration() Configuration {
+func setupTestConfiguration() *Configuration {
 	c := Configuration{
 		Strategy: strategyAverage,
 		Actions: map[float64]string{
@@ -15,7 +16,7 @@ func setupTestConfiguration() Configuration {
 			10.0: spamActionReject,
 		},
 	}
-	return c
+	return &c
 }
 
 func TestAverageAction(t *testing.T) {
@@ -47,7 +48,6 @@ func TestAverageAction(t *testing.T) {
 }
 
 func TestOverallResult(t *testing.T) {
-	t.SkipNow()
 	c := setupTestConfiguration()
 	c.Strategy = strategyLowest
 	c.Spamd = SpamdConfiguration{
@@ -72,35 +72,41 @@ func TestOverallResult(t *testing.T) {
 		err:    nil,
 	}
 
-	spamdChan := make(chan checkSpamResult)
-	rspamdChan := make(chan checkSpamResult)
-	spamdChan <- spamdResult
-	rspamdChan <- rspamdResult
 	c.Strategy = strategyLowest
-	r := c.overallResult(&m, spamdChan, rspamdChan)
+	r := c.overallResult(&m, spamdResult, rspamdResult)
 	if r.score != 0.0 || r.action != spamActionNoAction {
 		t.Errorf("expecting lowest result (%0.1f, %s), got (%0.1f, %s)", 0.0, spamActionNoAction, r.score, r.action)
 	}
 	c.Strategy = strategyHighest
-	r = c.overallResult(&m, spamdChan, rspamdChan)
+	r = c.overallResult(&m, spamdResult, rspamdResult)
 	if r.score != 4.0 || r.action != spamActionAddHeader {
 		t.Errorf("expecting lowest result (%0.1f, %s), got (%0.1f, %s)", 4.0, spamActionAddHeader, r.score, r.action)
 	}
 	c.Strategy = strategySpamd
-	r = c.overallResult(&m, spamdChan, rspamdChan)
+	r = c.overallResult(&m, spamdResult, rspamdResult)
 	if r.score != 0.0 || r.action != spamActionNoAction {
 		t.Errorf("expecting lowest result (%0.1f, %s), got (%0.1f, %s)", 0.0, spamActionNoAction, r.score, r.action)
 	}
 	c.Strategy = strategyRspamd
-	r = c.overallResult(&m, spamdChan, rspamdChan)
+	r = c.overallResult(&m, spamdResult, rspamdResult)
 	if r.score != 4.0 || r.action != spamActionAddHeader {
 		t.Errorf("expecting lowest result (%0.1f, %s), got (%0.1f, %s)", 4.0, spamActionAddHeader, r.score, r.action)
 	}
 	c.Strategy = strategyAverage
-	r = c.overallResult(&m, spamdChan, rspamdChan)
+	r = c.overallResult(&m, spamdResult, rspamdResult)
 	if r.score != 2.0 || r.action != spamActionNoAction {
 		t.Errorf("expecting lowest result (%0.1f, %s), got (%0.1f, %s)", 2.0, spamActionNoAction, r.score, r.action)
 	}
+	r = c.overallResult(&m, checkSpamResult{err: fmt.Errorf("spamd is down")}, rspamdResult)
+	if r.err == nil {
+		t.Errorf("expecting the error of spamd in the average result")
+	}
+	c.Rspamd.Use = false
+	c.Strategy = strategyRspamd
+	r = c.overallResult(&m, spamdResult, rspamdResult)
+	if r.err == nil {
+		t.Errorf("expecting an error for strategy rspamd without rspamd")
+	}
 }
 
 func TestSort(t *testing.T) {
@@ -120,3 +126,47 @@ func TestSort(t *testing.T) {
 	}
 
 }
+
+func TestRunScanActive(t *testing.T) {
+	c := setupTestConfiguration()
+	c.cronMu.Lock()
+	_, ok := c.runScan(c.ImapAccounts...)
+	if ok {
+		t.Errorf("expected run to be skipped while another run is active")
+	}
+	c.cronMu.Unlock()
+	results, ok := c.runScan(c.ImapAccounts...)
+	if !ok || len(results) != 0 {
+		t.Errorf("expected empty run, got %v, %v", results, ok)
+	}
+}
+
+func TestRunResultString(t *testing.T) {
+	rr := RunResult{Account: "a1", Checked: 3, Actions: map[string]int{spamActionNoAction: 2, spamActionReject: 1}}
+	expected := "a1: checked 3 mails (no action: 2, reject: 1)"
+	if rr.String() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, rr.String())
+	}
+	rr.Error = "connect failed"
+	if rr.String() != "a1: connect failed" {
+		t.Errorf("unexpected result '%s'", rr.String())
+	}
+}
+
+func TestInOrder(t *testing.T) {
+	scanned := make(chan *scannedMessage, 10)
+	for _, i := range []int{3, 1, 0, 4, 2} {
+		scanned <- &scannedMessage{index: i}
+	}
+	close(scanned)
+	next := 0
+	for sm := range inOrder(scanned) {
+		if sm.index != next {
+			t.Fatalf("expected message %d, got %d", next, sm.index)
+		}
+		next++
+	}
+	if next != 5 {
+		t.Errorf("expected 5 messages, got %d", next)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	usageScan     = "scan [--account <name>]"
+	usageLearn    = "learn ham|spam <file|folder>..."
+	usageCheck    = "check [--json] <file.eml|->"
+	usageEncrypt  = "encrypt <password>"
+	usageServe    = "serve"
+	usageHistory  = "history [--account <name>] [--action <action>] [--since <24h|7d|date>]"
+	defaultLimit  = 20
+	historyLayout = "2006-01-02 15:04"
+)
+
+// command is a subcommand of eatspam, e.g. eatspam scan
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) int
+}
+
+// commands are the subcommands of eatspam. Without a subcommand the cli parameters work like before.
+var commands = map[string]command{
+	"scan":    {usageScan, "check the mails of all accounts or one account once", runScanCommand},
+	"learn":   {usageLearn, "train rspamd with mails in files or folders, e.g. a maildir", runLearnCommand},
+	"check":   {usageCheck, "print the verdict for a mail without changing it", runCheckCommand},
+	"encrypt": {usageEncrypt, "encrypt a password with the key", runEncryptCommand},
+	"serve":   {usageServe, "run the daemon with the web ui", runServeCommand},
+	"history": {usageHistory, "print the processed mails of the history file", runHistoryCommand},
+}
+
+// printUsage prints the commands and the cli parameters
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: eatspam [command] [parameters]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", commands[name].usage, commands[name].description)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nWithout a command eatspam checks all accounts once or runs as daemon with --daemon.\n\nParameters:\n")
+	flag.PrintDefaults()
+}
+
+// parseCommand parses the cli parameters and the parameters of a command, which are defined by define. Parameters
+// and arguments may be mixed. It returns the arguments.
+func parseCommand(usage string, args []string, define func(fs *flag.FlagSet)) []string {
+	fs := flag.NewFlagSet("eatspam", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: eatspam %s [parameters]\n\nParameters:\n", usage)
+		fs.PrintDefaults()
+	}
+	cli = defineFlags(fs)
+	if define != nil {
+		define(fs)
+	}
+	cliFlags = fs
+	rest := make([]string, 0)
+	for {
+		_ = fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return rest
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
+func usageError(usage string) int {
+	fmt.Fprintf(os.Stderr, "Usage: eatspam %s [parameters]\n", usage)
+	return 2
+}
+
+func runScanCommand(args []string) int {
+	var account string
+	rest := parseCommand(usageScan, args, func(fs *flag.FlagSet) {
+		fs.StringVar(&account, "account", "", "name of the account to check, default all accounts")
+	})
+	if len(rest) != 0 {
+		return usageError(usageScan)
+	}
+	conf := load()
+	if err := conf.resolveSecrets(); err != nil {
+		log.Error(err)
+		return 1
+	}
+	accounts := conf.ImapAccounts
+	if account != "" {
+		ic := conf.accountByName(account)
+		if ic == nil {
+			fmt.Fprintf(os.Stderr, "unknown account %s\n", account)
+			return 1
+		}
+		accounts = []*ImapConfiguration{ic}
+	}
+	conf.recoverJournal()
+	conf.stopOnSignal()
+	results := conf.checkAccounts(accounts...)
+	conf.logoutSessions()
+	code := 0
+	for _, rr := range results {
+		fmt.Println(rr.String())
+		if rr.Error != "" {
+			code = 1
+		}
+	}
+	return code
+}
+
+func runLearnCommand(args []string) int {
+	rest := parseCommand(usageLearn, args, nil)
+	if len(rest) < 2 || (rest[0] != "ham" && rest[0] != "spam") {
+		return usageError(usageLearn)
+	}
+	conf := load()
+	if !conf.Rspamd.Use {
+		fmt.Fprintln(os.Stderr, "learning needs rspamd")
+		return 1
+	}
+	files, err := messageFiles(rest[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	learned, failed := 0, 0
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err == nil {
+			err = conf.learn(string(b), rest[0] == "spam")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			failed++
+			continue
+		}
+		learned++
+	}
+	fmt.Printf("learned %d mails as %s\n", learned, rest[0])
+	if failed > 0 {
+		fmt.Printf("%d mails failed\n", failed)
+		return 1
+	}
+	return 0
+}
+
+// messageFiles returns the files and the files in the folders of paths. Hidden files are skipped.
+func messageFiles(paths []string) ([]string, error) {
+	files := make([]string, 0)
+	for _, p := range paths {
+		err := filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != p && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func runCheckCommand(args []string) int {
+	var asJson bool
+	rest := parseCommand(usageCheck, args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJson, "json", false, "print the result as json")
+	})
+	if len(rest) != 1 {
+		return usageError(usageCheck)
+	}
+	var b []byte
+	var err error
+	if rest[0] == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(rest[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading mail: %v\n", err)
+		return 1
+	}
+	conf := load()
+	result := conf.checkMessage(string(b))
+	if asJson {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		_ = e.Encode(result)
+	} else {
+		printCheckResult(os.Stdout, result)
+	}
+	if result.Error != "" {
+		return 1
+	}
+	return 0
+}
+
+func printCheckResult(out io.Writer, result *ApiCheckResult) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\t%0.1f\t%s\n", result.Strategy, result.Score, result.Action)
+	for _, name := range []string{strategySpamd, strategyRspamd} {
+		br, ok := result.Backends[name]
+		if !ok {
+			continue
+		}
+		if br.Error != "" {
+			fmt.Fprintf(w, "%s\t\terror: %s\n", name, br.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%0.1f\t%s\t%s\n", name, br.Score, br.Action, strings.Join(br.Symbols, ", "))
+	}
+	w.Flush()
+	if result.Error != "" {
+		fmt.Fprintf(out, "error: %s\n", result.Error)
+	}
+}
+
+func runEncryptCommand(args []string) int {
+	rest := parseCommand(usageEncrypt, args, nil)
+	if len(rest) != 1 {
+		return usageError(usageEncrypt)
+	}
+	conf := load()
+	s, err := encrypt(rest[0], conf.key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error encrypting string: %v\n", err)
+		return 1
+	}
+	fmt.Println(s)
+	return 0
+}
+
+func runServeCommand(args []string) int {
+	rest := parseCommand(usageServe, args, nil)
+	if len(rest) != 0 {
+		return usageError(usageServe)
+	}
+	conf := load()
+	conf.Daemon = true
+	conf.start()
+	return 0
+}
+
+func runHistoryCommand(args []string) int {
+	var hf historyFilter
+	var since string
+	var limit int
+	var asJson bool
+	rest := parseCommand(usageHistory, args, func(fs *flag.FlagSet) {
+		fs.StringVar(&hf.account, "account", "", "only mails of the account")
+		fs.StringVar(&hf.action, "action", "", "only mails with the action, e.g. reject")
+		fs.StringVar(&since, "since", "", "only mails processed since a duration like 24h or 7d or a date like 2024-03-01")
+		fs.IntVar(&limit, "limit", defaultLimit, "maximum number of mails, 0 for all")
+		fs.BoolVar(&asJson, "json", false, "print the mails as json lines")
+	})
+	if len(rest) != 0 {
+		return usageError(usageHistory)
+	}
+	if since != "" {
+		t, err := parseSince(since, time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		hf.since = t
+	}
+	conf, err := New()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	entries, err := conf.readHistory(hf, limit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if asJson {
+		e := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			_ = e.Encode(entry)
+		}
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACCOUNT\tSCORE\tACTION\tSENDER\tSUBJECT")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%0.1f\t%s\t%s\t%s\n", e.Time.Local().Format(historyLayout), e.Account, e.Score, e.Action, e.Sender, e.Subject)
+	}
+	w.Flush()
+	return 0
+}
+
+// parseSince parses a duration like 24h or 7d before now or a date like 2024-03-01
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("illegal since '%s', expected a duration like 24h or 7d or a date like 2024-03-01", s)
+}
@@ -1,19 +1,27 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/emersion/go-imap/client"
+	"github.com/go-co-op/gocron"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	defaultConfigFile     = "config/eatspam.yaml"
 	defaultKeyFile        = "config/eatspam.key"
+	defaultHistoryFile    = "config/eatspam.history"
+	defaultJournalDir     = "config/journal"
+	defaultTokenFile      = "config/eatspam.tokens"
 	defaultSpamdPort      = 783
 	defaultSpamdUse       = true
 	defaultSpamdHost      = "127.0.0.1"
@@ -23,8 +31,9 @@ const (
 	defaultInterval       = "300s"
 	defaultDaemon         = false
 	defaultHttpPort       = 8080
-	defaultImapTls        = true
+	defaultImapTlsMode    = tlsModeImplicit
 	defaultImapPort       = 993
+	defaultImapPlainPort  = 143
 	defaultImapInbox      = "INBOX"
 	defaultImapSpamFolder = "Spam"
 	defaultSpamMark       = "*** SPAM ***"
@@ -32,6 +41,16 @@ const (
 	defaultLogLevel       = "info"
 	defaultCollectMetrics = true
 	defaultInboxBehaviour = behaviourUnseen
+	defaultAccountWorkers = 4
+	defaultScanWorkers    = 4
+	defaultPrefetch       = 10
+	defaultBatchSize      = 25
+	defaultBatchBytes     = "10M"
+	defaultLargePolicy    = largeMessageSkip
+	defaultKeepalive      = "5m"
+	defaultSessionTimeout = "1h"
+	defaultHttpCertFile   = "config/eatspam-http.crt"
+	defaultHttpKeyFile    = "config/eatspam-http.key"
 )
 
 const (
@@ -42,6 +61,11 @@ const (
 	strategyRspamd  = "rspamd"
 )
 
+const (
+	largeMessageSkip     = "skip"
+	largeMessageTruncate = "truncate"
+)
+
 const (
 	behaviourAll     = "all"
 	behaviourUnseen  = "unseen"
@@ -49,44 +73,135 @@ const (
 )
 
 var (
-	loglevel2String map[log.Level]string
-	string2Loglevel map[string]log.Level
+	loglevel2String = map[log.Level]string{
+		log.PanicLevel: "panic",
+		log.FatalLevel: "fatal",
+		log.ErrorLevel: "error",
+		log.WarnLevel:  "warn",
+		log.InfoLevel:  "info",
+		log.DebugLevel: "debug",
+		log.TraceLevel: "trace",
+	}
+	string2Loglevel = map[string]log.Level{
+		"panic": log.PanicLevel,
+		"fatal": log.FatalLevel,
+		"error": log.ErrorLevel,
+		"warn":  log.WarnLevel,
+		"info":  log.InfoLevel,
+		"debug": log.DebugLevel,
+		"trace": log.TraceLevel,
+	}
 )
 
 type Configuration struct {
-	ImapAccounts   []*ImapConfiguration `yaml:"imapAccounts,omitempty"`
-	Spamd          SpamdConfiguration   `yaml:"spamd,omitempty"`
-	Rspamd         RspamdConfiguration  `yaml:"rspamd,omitempty"`
-	Http           HttpConfiguration    `yaml:"http,omitempty"`
-	Daemon         bool                 `yaml:"daemon,omitempty"`
-	Interval       string               `yaml:"interval,omitempty"`
-	SpamPrefix     string               `yaml:"spamMark,omitempty"`
-	ConfigFile     string               `yaml:"-"`
-	KeyFile        string               `yaml:"keyFile,omitempty"`
-	Actions        map[float64]string   `yaml:"actions,omitempty"`
-	Strategy       string               `yaml:"strategy,omitempty"`
-	LogLevel       string               `yaml:"logLevel,omitempty"`
-	Version        string               `yaml:"-"`
-	CollectMetrics bool                 `yaml:"collectMetrics,omitempty"`
-	SpamHeader     string               `yaml:"spamHeader,omitempty"`
+	ImapAccounts   []*ImapConfiguration     `yaml:"imapAccounts,omitempty"`
+	Spamd          SpamdConfiguration       `yaml:"spamd,omitempty"`
+	Rspamd         RspamdConfiguration      `yaml:"rspamd,omitempty"`
+	Http           HttpConfiguration        `yaml:"http,omitempty"`
+	Daemon         bool                     `yaml:"daemon,omitempty"`
+	Interval       string                   `yaml:"interval,omitempty"`
+	SpamPrefix     string                   `yaml:"spamMark,omitempty"`
+	ConfigFile     string                   `yaml:"-"`
+	KeyFile        string                   `yaml:"keyFile,omitempty"`
+	TokenFile      string                   `yaml:"tokenFile,omitempty"`
+	HistoryFile    string                   `yaml:"historyFile,omitempty"`
+	JournalDir     string                   `yaml:"journalDir,omitempty"`
+	Actions        map[float64]string       `yaml:"actions,omitempty"`
+	Strategy       string                   `yaml:"strategy,omitempty"`
+	LogLevel       string                   `yaml:"logLevel,omitempty"`
+	Version        string                   `yaml:"-"`
+	CollectMetrics bool                     `yaml:"collectMetrics,omitempty"`
+	SpamHeader     string                   `yaml:"spamHeader,omitempty"`
+	Concurrency    ConcurrencyConfiguration `yaml:"concurrency,omitempty"`
+	Fetch          FetchConfiguration       `yaml:"fetch,omitempty"`
+	MaxMessageSize string                   `yaml:"maxMessageSize,omitempty"`
+	Keepalive      string                   `yaml:"keepalive,omitempty"`
+	QuietHours     string                   `yaml:"quietHours,omitempty"`
+	Retention      string                   `yaml:"quarantineRetention,omitempty"`
+	Smtp           SmtpConfiguration        `yaml:"smtp,omitempty"`
 	encrypt        string
+	hashPassword   string
+	rotate         bool
+	checkConfig    bool
 	key            string
-	cronActive     bool
+	cronMu         sync.Mutex
+	confMu         sync.RWMutex
+	scheduler      *gocron.Scheduler
+	stop           chan struct{}
+	stopOnce       sync.Once
 }
 
 type ImapConfiguration struct {
-	Name           string         `yaml:"name,omitempty"`
-	Username       string         `yaml:"username,omitempty"`
-	Password       string         `yaml:"password,omitempty"`
-	Host           string         `yaml:"host,omitempty"`
-	Port           int            `yaml:"port,omitempty"`
-	Tls            bool           `yaml:"tls,omitempty"`
-	Inbox          string         `yaml:"inbox,omitempty"`
-	SpamFolder     string         `yaml:"spamFolder,omitempty"`
-	InboxBehaviour string         `yaml:"inboxBehaviour,omitempty"`
-	Ok             bool           `yaml:"-"`
-	UnreadMails    int            `yaml:"-"`
-	client         *client.Client `yaml:"-"`
+	Name           string                `yaml:"name,omitempty"`
+	Username       string                `yaml:"username,omitempty"`
+	Password       string                `yaml:"password,omitempty"`
+	Host           string                `yaml:"host,omitempty"`
+	Port           int                   `yaml:"port,omitempty"`
+	Tls            *bool                 `yaml:"tls,omitempty"`
+	TlsMode        string                `yaml:"tlsMode,omitempty"`
+	TlsConfig      ImapTlsConfiguration  `yaml:"tlsConfig,omitempty"`
+	Auth           ImapAuthConfiguration `yaml:"auth,omitempty"`
+	Inbox          string                `yaml:"inbox,omitempty"`
+	SpamFolder     string                `yaml:"spamFolder,omitempty"`
+	InboxBehaviour string                `yaml:"inboxBehaviour,omitempty"`
+	MaxMessageSize string                `yaml:"maxMessageSize,omitempty"`
+	LargeMessages  string                `yaml:"largeMessages,omitempty"`
+	Schedule       []string              `yaml:"schedule,omitempty"`
+	QuietHours     string                `yaml:"quietHours,omitempty"`
+	Quarantine     string                `yaml:"quarantineFolder,omitempty"`
+	Retention      string                `yaml:"quarantineRetention,omitempty"`
+	Digest         DigestConfiguration   `yaml:"digest,omitempty"`
+	maxMessageSize int64                 `yaml:"-"`
+	quietHours     *quietHours           `yaml:"-"`
+	retention      time.Duration         `yaml:"-"`
+	tokenFile      string                `yaml:"-"`
+	journalDir     string                `yaml:"-"`
+	password       string                `yaml:"-"`
+	Ok             bool                  `yaml:"-"`
+	UnreadMails    int                   `yaml:"-"`
+	LastRun        time.Time             `yaml:"-"`
+	LastError      string                `yaml:"-"`
+	LastResult     *RunResult            `yaml:"-"`
+	client         *client.Client        `yaml:"-"`
+	mu             sync.Mutex            `yaml:"-"`
+	sessionMu      sync.Mutex            `yaml:"-"`
+}
+
+// ImapTlsConfiguration configures the verification of the IMAP server certificate and the client certificate
+type ImapTlsConfiguration struct {
+	CaFile             string `yaml:"caFile,omitempty"`
+	Pin                string `yaml:"pin,omitempty"`
+	CertFile           string `yaml:"certFile,omitempty"`
+	KeyFile            string `yaml:"keyFile,omitempty"`
+	ServerName         string `yaml:"serverName,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
+}
+
+// ImapAuthConfiguration selects the authentication method of an account. The client secret and the refresh token are
+// secrets like the password.
+type ImapAuthConfiguration struct {
+	Method        string `yaml:"method,omitempty"`
+	TokenEndpoint string `yaml:"tokenEndpoint,omitempty"`
+	ClientId      string `yaml:"clientId,omitempty"`
+	ClientSecret  string `yaml:"clientSecret,omitempty"`
+	RefreshToken  string `yaml:"refreshToken,omitempty"`
+	Scope         string `yaml:"scope,omitempty"`
+	clientSecret  string
+	refreshToken  string
+}
+
+// ConcurrencyConfiguration limits the parallel work of a run
+type ConcurrencyConfiguration struct {
+	Accounts int `yaml:"accounts,omitempty"`
+	Scans    int `yaml:"scans,omitempty"`
+	Prefetch int `yaml:"prefetch,omitempty"`
+}
+
+// FetchConfiguration limits the messages fetched from the IMAP server with one FETCH command
+type FetchConfiguration struct {
+	BatchSize  int    `yaml:"batchSize,omitempty"`
+	BatchBytes string `yaml:"batchBytes,omitempty"`
+	batchBytes int64
 }
 
 type SpamdConfiguration struct {
@@ -102,33 +217,44 @@ type RspamdConfiguration struct {
 }
 
 type HttpConfiguration struct {
-	Port     int    `yaml:"port,omitempty"`
-	Password string `yaml:"password,omitempty"`
+	Port           int                      `yaml:"port,omitempty"`
+	Listen         string                   `yaml:"listen,omitempty"`
+	Tls            HttpTlsConfiguration     `yaml:"tls,omitempty"`
+	Password       string                   `yaml:"password,omitempty"`
+	ApiToken       string                   `yaml:"apiToken,omitempty"`
+	SessionTimeout string                   `yaml:"sessionTimeout,omitempty"`
+	Users          []UserConfiguration      `yaml:"users,omitempty"`
+	PathPrefix     string                   `yaml:"pathPrefix,omitempty"`
+	ForwardAuth    ForwardAuthConfiguration `yaml:"forwardAuth,omitempty"`
+	ExternalUrl    string                   `yaml:"externalUrl,omitempty"`
+	password       string
+	apiToken       string
+	sessionTimeout time.Duration
+}
+
+// HttpTlsConfiguration serves the web ui with https. Redirect is an optional listen address for plain http, which
+// redirects to https.
+type HttpTlsConfiguration struct {
+	Use      bool   `yaml:"use,omitempty"`
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+	Redirect string `yaml:"redirect,omitempty"`
 }
 
 func New() (*Configuration, error) {
-	loglevel2String = map[log.Level]string{
-		log.PanicLevel: "panic",
-		log.FatalLevel: "fatal",
-		log.ErrorLevel: "error",
-		log.WarnLevel:  "warn",
-		log.InfoLevel:  "info",
-		log.DebugLevel: "debug",
-		log.TraceLevel: "trace",
-	}
-	string2Loglevel = map[string]log.Level{
-		"panic": log.PanicLevel,
-		"fatal": log.FatalLevel,
-		"error": log.ErrorLevel,
-		"warn":  log.WarnLevel,
-		"info":  log.InfoLevel,
-		"debug": log.DebugLevel,
-		"trace": log.TraceLevel,
+	// peek cli params and environment for the configFile parameter
+	c, err := loadConfig(configLocation())
+	if err != nil {
+		return nil, err
 	}
+	setLogLevel(c.LogLevel)
+	return c, nil
+}
 
-	// peek cli params and environment for the configFile parameter
-	cl := configLocation()
-	c := Configuration{Version: Version}
+// loadConfig reads and validates the config file. Cli parameters and environment variables override the values of the
+// file.
+func loadConfig(cl string) (*Configuration, error) {
+	c := Configuration{Version: Version, stop: make(chan struct{})}
 	// load and parse config file
 	configdata, err := ioutil.ReadFile(cl)
 	if err == nil {
@@ -140,17 +266,53 @@ func New() (*Configuration, error) {
 		log.Warnf("Config file %s not found. Use default parameters.", cl)
 	}
 	if len(c.ImapAccounts) == 0 {
-		log.Fatalf("No imap accounts configured. Stopping here.")
+		return nil, fmt.Errorf("no imap accounts configured")
 	}
 	for _, a := range c.ImapAccounts {
-		if a.Username == "" || a.Password == "" || a.Host == "" {
-			log.Fatalf("Missing arguments for imap account. username, password and host are needed.")
+		if a.Auth.Method == "" {
+			a.Auth.Method = authPassword
 		}
-		if !a.Tls {
-			a.Tls = defaultImapTls
+		switch a.Auth.Method {
+		case authPassword, authPlain, authLogin:
+			if a.Username == "" || a.Password == "" || a.Host == "" {
+				return nil, fmt.Errorf("missing arguments for imap account %s. username, password and host are needed", a.Name)
+			}
+		case authXoauth2, authOauthbearer:
+			if a.Username == "" || a.Host == "" || a.Auth.TokenEndpoint == "" || a.Auth.ClientId == "" || a.Auth.RefreshToken == "" {
+				return nil, fmt.Errorf("missing arguments for imap account %s. username, host, auth.tokenEndpoint, auth.clientId and auth.refreshToken are needed for %s", a.Name, a.Auth.Method)
+			}
+		default:
+			return nil, fmt.Errorf("unknown auth method '%s' for account %s. Use %s, %s, %s, %s or %s", a.Auth.Method, a.Name, authPassword, authPlain, authLogin, authXoauth2, authOauthbearer)
+		}
+		if a.TlsMode == "" {
+			a.TlsMode = defaultImapTlsMode
+			if a.Tls != nil && !*a.Tls {
+				log.Warnf("tls: false is deprecated for account %s. Use tlsMode: %s or %s instead. Using %s", a.Name, tlsModeStarttls, tlsModeNone, tlsModeStarttls)
+				a.TlsMode = tlsModeStarttls
+			}
+		}
+		switch a.TlsMode {
+		case tlsModeImplicit, tlsModeStarttls:
+		case tlsModeNone:
+			if !isLoopback(a.Host) {
+				return nil, fmt.Errorf("tlsMode %s is only allowed for localhost, account %s uses %s", tlsModeNone, a.Name, a.Host)
+			}
+		default:
+			return nil, fmt.Errorf("unknown tlsMode '%s' for account %s. Use %s, %s or %s", a.TlsMode, a.Name, tlsModeImplicit, tlsModeStarttls, tlsModeNone)
+		}
+		if a.TlsConfig.Pin != "" {
+			if _, err := parseFingerprint(a.TlsConfig.Pin); err != nil {
+				return nil, fmt.Errorf("account %s: %v", a.Name, err)
+			}
+		}
+		if a.TlsConfig.InsecureSkipVerify {
+			log.Warnf("certificate verification is disabled for account %s", a.Name)
 		}
 		if a.Port == 0 {
 			a.Port = defaultImapPort
+			if a.TlsMode != tlsModeImplicit {
+				a.Port = defaultImapPlainPort
+			}
 		}
 		if a.Inbox == "" {
 			a.Inbox = defaultImapInbox
@@ -161,6 +323,88 @@ func New() (*Configuration, error) {
 		if a.InboxBehaviour == "" {
 			a.InboxBehaviour = defaultInboxBehaviour
 		}
+		if a.MaxMessageSize == "" {
+			a.MaxMessageSize = c.MaxMessageSize
+		}
+		if a.MaxMessageSize != "" {
+			a.maxMessageSize, err = parseSize(a.MaxMessageSize)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing maxMessageSize of account %s: %v", a.Name, err)
+			}
+		}
+		if a.LargeMessages == "" {
+			a.LargeMessages = defaultLargePolicy
+		}
+		if a.LargeMessages != largeMessageSkip && a.LargeMessages != largeMessageTruncate {
+			return nil, fmt.Errorf("unknown largeMessages policy '%s' for account %s. Use %s or %s", a.LargeMessages, a.Name, largeMessageSkip, largeMessageTruncate)
+		}
+		for _, schedule := range a.Schedule {
+			if err := validateSchedule(schedule); err != nil {
+				return nil, fmt.Errorf("schedule of account %s: %v", a.Name, err)
+			}
+		}
+		if a.QuietHours == "" {
+			a.QuietHours = c.QuietHours
+		}
+		if a.QuietHours != "" {
+			a.quietHours, err = parseQuietHours(a.QuietHours)
+			if err != nil {
+				return nil, fmt.Errorf("account %s: %v", a.Name, err)
+			}
+		}
+		if a.Retention == "" {
+			a.Retention = c.Retention
+		}
+		if a.Retention != "" {
+			a.retention, err = parseRetention(a.Retention)
+			if err != nil {
+				return nil, fmt.Errorf("account %s: %v", a.Name, err)
+			}
+		}
+		if err := c.validateDigest(a); err != nil {
+			return nil, err
+		}
+	}
+	err = c.validateSmtp()
+	if err != nil {
+		return nil, err
+	}
+	err = c.validateProxy()
+	if err != nil {
+		return nil, err
+	}
+	err = c.validateUsers()
+	if err != nil {
+		return nil, err
+	}
+	if c.Concurrency.Prefetch == 0 {
+		c.Concurrency.Prefetch = defaultPrefetch
+	}
+	if c.Keepalive == "" {
+		c.Keepalive = defaultKeepalive
+	}
+	if c.Http.SessionTimeout == "" {
+		c.Http.SessionTimeout = defaultSessionTimeout
+	}
+	if c.Http.Tls.CertFile == "" {
+		c.Http.Tls.CertFile = defaultHttpCertFile
+	}
+	if c.Http.Tls.KeyFile == "" {
+		c.Http.Tls.KeyFile = defaultHttpKeyFile
+	}
+	c.Http.sessionTimeout, err = time.ParseDuration(c.Http.SessionTimeout)
+	if err != nil || c.Http.sessionTimeout <= 0 {
+		return nil, fmt.Errorf("illegal http.sessionTimeout '%s'", c.Http.SessionTimeout)
+	}
+	if c.Fetch.BatchSize == 0 {
+		c.Fetch.BatchSize = defaultBatchSize
+	}
+	if c.Fetch.BatchBytes == "" {
+		c.Fetch.BatchBytes = defaultBatchBytes
+	}
+	c.Fetch.batchBytes, err = parseSize(c.Fetch.BatchBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing fetch.batchBytes: %v", err)
 	}
 	if c.Actions == nil || len(c.Actions) == 0 {
 		c.Actions = map[float64]string{
@@ -171,44 +415,115 @@ func New() (*Configuration, error) {
 	}
 	// parse all given cli parameters and environment variables
 	c.parseArguments()
-	// set loglevel
-	l, ok := string2Loglevel[c.LogLevel]
+	if err := validateSchedule(c.Interval); err != nil {
+		return nil, err
+	}
+	if err := validateBackends(c.Spamd.Use, c.Rspamd.Use, c.Strategy); err != nil {
+		return nil, err
+	}
+	for score, action := range c.Actions {
+		if !contains(actionNames, action) {
+			return nil, fmt.Errorf("unknown action '%s' for score %v. Use %s", action, score, strings.Join(actionNames, ", "))
+		}
+	}
+	for _, a := range c.ImapAccounts {
+		a.tokenFile = c.TokenFile
+		a.journalDir = c.JournalDir
+	}
+	return &c, nil
+}
+
+var errNoBackend = errors.New("neither spamd nor rspamd is used")
+
+// validateBackends checks that a backend is used and that the strategy only needs used backends
+func validateBackends(spamd bool, rspamd bool, strategy string) error {
+	if !spamd && !rspamd {
+		return errNoBackend
+	}
+	return validateStrategy(spamd, rspamd, strategy)
+}
+
+// validateStrategy checks that the strategy is known and only needs used backends
+func validateStrategy(spamd bool, rspamd bool, strategy string) error {
+	if !contains(strategyNames, strategy) {
+		return fmt.Errorf("unknown strategy '%s'. Use %s", strategy, strings.Join(strategyNames, ", "))
+	}
+	if (strategy == strategySpamd && !spamd) || (strategy == strategyRspamd && !rspamd) {
+		return fmt.Errorf("strategy %s needs the backend %s", strategy, strategy)
+	}
+	return nil
+}
+
+func setLogLevel(level string) {
+	l, ok := string2Loglevel[level]
 	if !ok {
-		log.Warnf("unknown loglevel '%s'. Use loglevel info instead", c.LogLevel)
+		log.Warnf("unknown loglevel '%s'. Use loglevel info instead", level)
 		l = log.InfoLevel
 	} else {
-		log.Infof("loglevel set to %s", c.LogLevel)
+		log.Infof("loglevel set to %s", level)
 	}
 	log.SetLevel(l)
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp: true,
 	})
-	return &c, nil
 }
 
-func (c *Configuration) parseArguments() {
-	cp := Configuration{}
-	flag.BoolVar(&cp.Spamd.Use, "spamdUse", defaultSpamdUse, "use spamd, default true")
-	flag.StringVar(&cp.Spamd.Host, "spamdHost", defaultSpamdHost, "spamd host name")
-	flag.IntVar(&cp.Spamd.Port, "spamdPort", defaultSpamdPort, "Port of the spamd server")
-	flag.BoolVar(&cp.Rspamd.Use, "rspamdUse", defaultRspamdUse, "use rspamd, default true")
-	flag.StringVar(&cp.Rspamd.Host, "rspamdHost", defaultRspamdHost, "rspamd host name")
-	flag.IntVar(&cp.Rspamd.Port, "rspamdPort", defaultRspamdPort, "Port of the rspamd server")
-	flag.StringVar(&cp.Interval, "interval", defaultInterval, "interval for checking new mails")
-	flag.BoolVar(&cp.Daemon, "daemon", defaultDaemon, "start in daemon mode, default false")
-	flag.IntVar(&cp.Http.Port, "httpPort", defaultHttpPort, "Port for the WebUI")
-	flag.StringVar(&cp.encrypt, "encrypt", "", "password to encrypt with the internal key")
-	flag.StringVar(&cp.SpamPrefix, "spamMark", defaultSpamMark, "subject prefix for spam mails")
-	flag.StringVar(&cp.ConfigFile, "configFile", defaultConfigFile, "location of configuration file")
-	flag.StringVar(&cp.KeyFile, "keyFile", defaultKeyFile, "location of the key file for password en-/decryption")
-	flag.StringVar(&cp.Strategy, "strategy", defaultStrategy, "strategy for spam handling (average, lowest, highest, spamd, rspamd")
-	flag.StringVar(&cp.LogLevel, "loglevel", defaultLogLevel, "loglevel. One of panic, fatal, error, warn, info, debug or trace")
-	flag.BoolVar(&cp.CollectMetrics, "collectMetrics", defaultCollectMetrics, "collect metrics for Prometheus, default true")
-	flag.StringVar(&cp.LogLevel, "spamHeader", defaultHeaderTemplate, "spam header to add to a spam mail")
+// cli holds the cli parameters. They are parsed once and applied again on every reload of the config file.
+var cli *Configuration
+
+// cliFlags is the flag set of the cli parameters, flag.CommandLine or the flag set of a command
+var cliFlags = flag.CommandLine
 
+// parseFlags defines and parses the cli parameters
+func parseFlags() *Configuration {
+	cp := defineFlags(flag.CommandLine)
 	flag.Parse()
+	return cp
+}
+
+// defineFlags defines the cli parameters in the flag set
+func defineFlags(fs *flag.FlagSet) *Configuration {
+	cp := Configuration{}
+	fs.BoolVar(&cp.Spamd.Use, "spamdUse", defaultSpamdUse, "use spamd, default true")
+	fs.StringVar(&cp.Spamd.Host, "spamdHost", defaultSpamdHost, "spamd host name")
+	fs.IntVar(&cp.Spamd.Port, "spamdPort", defaultSpamdPort, "Port of the spamd server")
+	fs.BoolVar(&cp.Rspamd.Use, "rspamdUse", defaultRspamdUse, "use rspamd, default true")
+	fs.StringVar(&cp.Rspamd.Host, "rspamdHost", defaultRspamdHost, "rspamd host name")
+	fs.IntVar(&cp.Rspamd.Port, "rspamdPort", defaultRspamdPort, "Port of the rspamd server")
+	fs.StringVar(&cp.Interval, "interval", defaultInterval, "interval for checking new mails, e.g. 5m, or a cron expression")
+	fs.BoolVar(&cp.Daemon, "daemon", defaultDaemon, "start in daemon mode, default false")
+	fs.IntVar(&cp.Http.Port, "httpPort", defaultHttpPort, "Port for the WebUI")
+	fs.StringVar(&cp.Http.Listen, "httpListen", "", "listen address for the WebUI, e.g. 127.0.0.1:8080. Overrides httpPort")
+	fs.StringVar(&cp.Http.ApiToken, "apiToken", "", "encrypted token for the REST api")
+	fs.StringVar(&cp.encrypt, "encrypt", "", "password to encrypt with the internal key")
+	fs.StringVar(&cp.hashPassword, "hashPassword", "", "password to hash for a user of the web ui")
+	fs.BoolVar(&cp.rotate, "rotate-key", false, "generate a new key and re-encrypt all values of the config file with it")
+	fs.BoolVar(&cp.checkConfig, "check-config", false, "check the config file, the secrets and the connections and print all problems")
+	fs.StringVar(&cp.SpamPrefix, "spamMark", defaultSpamMark, "subject prefix for spam mails")
+	fs.StringVar(&cp.ConfigFile, "configFile", defaultConfigFile, "location of configuration file")
+	fs.StringVar(&cp.KeyFile, "keyFile", defaultKeyFile, "location of the key file for password en-/decryption")
+	fs.StringVar(&cp.TokenFile, "tokenFile", defaultTokenFile, "location of the file for OAuth2 tokens")
+	fs.StringVar(&cp.HistoryFile, "historyFile", defaultHistoryFile, "location of the history of processed mails")
+	fs.StringVar(&cp.JournalDir, "journalDir", defaultJournalDir, "folder for the journal of mails being rewritten")
+	fs.StringVar(&cp.Strategy, "strategy", defaultStrategy, "strategy for spam handling (average, lowest, highest, spamd, rspamd")
+	fs.StringVar(&cp.LogLevel, "loglevel", defaultLogLevel, "loglevel. One of panic, fatal, error, warn, info, debug or trace")
+	fs.BoolVar(&cp.CollectMetrics, "collectMetrics", defaultCollectMetrics, "collect metrics for Prometheus, default true")
+	fs.IntVar(&cp.Concurrency.Accounts, "accountWorkers", defaultAccountWorkers, "number of accounts checked in parallel")
+	fs.IntVar(&cp.Concurrency.Scans, "scanWorkers", defaultScanWorkers, "number of parallel spam checks per account")
+	fs.StringVar(&cp.SpamHeader, "spamHeader", defaultHeaderTemplate, "spam header to add to a spam mail")
+
+	return &cp
+}
+
+func (c *Configuration) parseArguments() {
+	if cli == nil {
+		cli = parseFlags()
+	}
+	cp := cli
 
 	c.encrypt = cp.encrypt
+	c.hashPassword = cp.hashPassword
+	c.rotate = cp.rotate
 	c.Spamd.Use = boolConfig("spamdUse", cp.Spamd.Use, "SPAMD_USE", c.Spamd.Use)
 	c.Spamd.Host = stringConfig("spamdHold", cp.Spamd.Host, "SPAMD_HOST", c.Spamd.Host)
 	c.Spamd.Port = intConfig("spamdPort", cp.Spamd.Port, "SPAMD_PORT", c.Spamd.Port)
@@ -222,9 +537,14 @@ func (c *Configuration) parseArguments() {
 	c.Daemon = boolConfig("daemon", cp.Daemon, "DAEMON", c.Daemon)
 
 	c.Http.Port = intConfig("httpPort", cp.Http.Port, "HTTP_PORT", c.Http.Port)
+	c.Http.Listen = stringConfig("httpListen", cp.Http.Listen, "HTTP_LISTEN", c.Http.Listen)
+	c.Http.ApiToken = stringConfig("apiToken", cp.Http.ApiToken, "API_TOKEN", c.Http.ApiToken)
 
 	c.ConfigFile = stringConfig("configFile", cp.ConfigFile, "CONFIG_FILE", c.ConfigFile)
 	c.KeyFile = stringConfig("keyFile", cp.KeyFile, "KEY_FILE", c.KeyFile)
+	c.TokenFile = stringConfig("tokenFile", cp.TokenFile, "TOKEN_FILE", c.TokenFile)
+	c.HistoryFile = stringConfig("historyFile", cp.HistoryFile, "HISTORY_FILE", c.HistoryFile)
+	c.JournalDir = stringConfig("journalDir", cp.JournalDir, "JOURNAL_DIR", c.JournalDir)
 
 	c.Strategy = stringConfig("strategy", cp.Strategy, "STRATEGY", c.Strategy)
 	c.LogLevel = stringConfig("loglevel", cp.LogLevel, "LOGLEVEL", c.LogLevel)
@@ -232,11 +552,38 @@ func (c *Configuration) parseArguments() {
 	c.CollectMetrics = boolConfig("collectMetrics", cp.CollectMetrics, "COLLECT_METRICS", c.CollectMetrics)
 
 	c.SpamHeader = stringConfig("spamHeader", cp.SpamHeader, "SPAM_HEADER", c.SpamHeader)
+
+	c.Concurrency.Accounts = intConfig("accountWorkers", cp.Concurrency.Accounts, "ACCOUNT_WORKERS", c.Concurrency.Accounts)
+	c.Concurrency.Scans = intConfig("scanWorkers", cp.Concurrency.Scans, "SCAN_WORKERS", c.Concurrency.Scans)
+}
+
+// parseSize parses a size in bytes with an optional unit K, M or G (1024 based), e.g. 500K or 10M
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	factor := int64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			factor = 1 << 10
+		case 'M':
+			factor = 1 << 20
+		case 'G':
+			factor = 1 << 30
+		}
+		if factor > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("illegal size '%s', expected a number with an optional unit K, M or G", size)
+	}
+	return n * factor, nil
 }
 
 func isFlagPassed(name string) bool {
 	found := false
-	flag.Visit(func(f *flag.Flag) {
+	cliFlags.Visit(func(f *flag.Flag) {
 		if f.Name == name {
 			found = true
 		}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sync"
+)
+
+// configFileMu serializes the changes of the configuration file
+var configFileMu sync.Mutex
+
+// loadConfigNode reads the configuration file as yaml document. A missing file is an empty document.
+func loadConfigNode(file string) (*yaml.Node, error) {
+	doc := yaml.Node{}
+	b, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	if err == nil {
+		err = yaml.Unmarshal(b, &doc)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing config file: %v", err)
+		}
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file is no yaml mapping")
+	}
+	return &doc, nil
+}
+
+// saveConfigNode writes the yaml document atomically to the configuration file. The previous file is kept with the
+// suffix .bak.
+func saveConfigNode(file string, doc *yaml.Node) error {
+	var buf bytes.Buffer
+	e := yaml.NewEncoder(&buf)
+	e.SetIndent(2)
+	err := e.Encode(doc)
+	if err == nil {
+		err = e.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("error encoding config file: %v", err)
+	}
+	perm := os.FileMode(0600)
+	if old, err := os.ReadFile(file); err == nil {
+		if fi, err := os.Stat(file); err == nil {
+			perm = fi.Mode().Perm()
+		}
+		err = writeFileAtomic(file+".bak", old, 0600)
+		if err != nil {
+			return fmt.Errorf("error writing config backup: %v", err)
+		}
+	}
+	return writeFileAtomic(file, buf.Bytes(), perm)
+}
+
+// mappingValue returns the value of key in the mapping m or nil
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue sets the value of key in the mapping m. A new key is appended.
+func setMappingValue(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			// keep the comments of the old value
+			value.HeadComment, value.LineComment, value.FootComment = m.Content[i+1].HeadComment, m.Content[i+1].LineComment, m.Content[i+1].FootComment
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// deleteMappingValue removes key from the mapping m
+func deleteMappingValue(m *yaml.Node, key string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// mappingNode returns the mapping of key in m and creates it if it is missing
+func mappingNode(m *yaml.Node, key string) *yaml.Node {
+	v := mappingValue(m, key)
+	if v == nil || v.Kind != yaml.MappingNode {
+		v = &yaml.Node{Kind: yaml.MappingNode}
+		setMappingValue(m, key, v)
+	}
+	return v
+}
+
+// setScalar sets a scalar value of key in m. An empty value removes the key.
+func setScalar(m *yaml.Node, key string, tag string, value string) {
+	if value == "" {
+		deleteMappingValue(m, key)
+		return
+	}
+	setMappingValue(m, key, &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value})
+}
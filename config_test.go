@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]int64{
+		"0":     0,
+		"512":   512,
+		"500K":  500 << 10,
+		"500kb": 500 << 10,
+		"10M":   10 << 20,
+		" 2G ":  2 << 30,
+	}
+	for s, expected := range sizes {
+		n, err := parseSize(s)
+		if err != nil {
+			t.Errorf("error parsing '%s': %v", s, err)
+		} else if n != expected {
+			t.Errorf("expected %d for '%s', got %d", expected, s, n)
+		}
+	}
+	for _, s := range []string{"", "M", "ten", "-1K", "10T"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("expected error for '%s'", s)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	digestDaily         = "daily"
+	digestWeekly        = "weekly"
+	deliverySmtp        = "smtp"
+	deliveryImap        = "imap"
+	historyActionDigest = "digest"
+	// digestFirstPeriod is the period of the first digest of an account
+	digestFirstPeriod = 7 * 24 * time.Hour
+	smtpTimeout       = 30 * time.Second
+
+	defaultSmtpPort         = 25
+	defaultSmtpTlsPort      = 465
+	defaultSmtpStarttlsPort = 587
+)
+
+var deliveries = []string{deliverySmtp, deliveryImap}
+
+// DigestConfiguration sends a periodic summary of the quarantined mails of an account
+type DigestConfiguration struct {
+	Schedule string `yaml:"schedule,omitempty"`
+	To       string `yaml:"to,omitempty"`
+	Delivery string `yaml:"delivery,omitempty"`
+}
+
+// SmtpConfiguration is the server for sending digests
+type SmtpConfiguration struct {
+	Host     string `yaml:"host,omitempty"`
+	Port     int    `yaml:"port,omitempty"`
+	TlsMode  string `yaml:"tlsMode,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	From     string `yaml:"from,omitempty"`
+	password string
+}
+
+// digestSchedule returns the schedule for daily and weekly digests, every day or every monday at 8:00. Other values
+// are used as interval or cron expression.
+func digestSchedule(schedule string) string {
+	switch schedule {
+	case digestDaily:
+		return "0 8 * * *"
+	case digestWeekly:
+		return "0 8 * * 1"
+	}
+	return schedule
+}
+
+// validateSmtp sets the defaults of the smtp server and checks it
+func (conf *Configuration) validateSmtp() error {
+	s := &conf.Smtp
+	if s.Host == "" {
+		return nil
+	}
+	if s.TlsMode == "" {
+		s.TlsMode = tlsModeStarttls
+	}
+	switch s.TlsMode {
+	case tlsModeImplicit, tlsModeStarttls:
+	case tlsModeNone:
+		if !isLoopback(s.Host) {
+			return fmt.Errorf("smtp.tlsMode %s is only allowed for localhost, not %s", tlsModeNone, s.Host)
+		}
+	default:
+		return fmt.Errorf("unknown smtp.tlsMode '%s'. Use %s, %s or %s", s.TlsMode, tlsModeImplicit, tlsModeStarttls, tlsModeNone)
+	}
+	if s.Port == 0 {
+		switch s.TlsMode {
+		case tlsModeImplicit:
+			s.Port = defaultSmtpTlsPort
+		case tlsModeStarttls:
+			s.Port = defaultSmtpStarttlsPort
+		default:
+			s.Port = defaultSmtpPort
+		}
+	}
+	if s.From == "" {
+		return fmt.Errorf("smtp.from is needed for sending digests")
+	}
+	return nil
+}
+
+// validateDigest sets the defaults of the digest of the account and checks it
+func (conf *Configuration) validateDigest(ic *ImapConfiguration) error {
+	d := &ic.Digest
+	if d.Schedule == "" {
+		return nil
+	}
+	if err := validateSchedule(digestSchedule(d.Schedule)); err != nil {
+		return fmt.Errorf("digest schedule of account %s: %v", ic.Name, err)
+	}
+	if d.Delivery == "" {
+		d.Delivery = deliveryImap
+		if conf.Smtp.Host != "" {
+			d.Delivery = deliverySmtp
+		}
+	}
+	if d.To == "" && strings.Contains(ic.Username, "@") {
+		d.To = ic.Username
+	}
+	switch d.Delivery {
+	case deliverySmtp:
+		if conf.Smtp.Host == "" {
+			return fmt.Errorf("digest of account %s needs smtp.host", ic.Name)
+		}
+		if d.To == "" {
+			return fmt.Errorf("digest of account %s needs a recipient in digest.to", ic.Name)
+		}
+	case deliveryImap:
+	default:
+		return fmt.Errorf("unknown digest delivery '%s' for account %s. Use %s", d.Delivery, ic.Name, strings.Join(deliveries, " or "))
+	}
+	return nil
+}
+
+// digestData is the content of a digest
+type digestData struct {
+	Account   string
+	Folder    string
+	Retention string
+	Since     time.Time
+	Mails     []*digestMail
+}
+
+// digestMail is a quarantined mail with the links to release or confirm it
+type digestMail struct {
+	*HistoryEntry
+	Release string
+	Confirm string
+}
+
+var digestTemplate = template.Must(template.New("digest.txt").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		return t.Local().Format(historyLayout)
+	},
+}).ParseFS(templates, templateDir+"/digest.txt"))
+
+// cronDigest sends the digest of an account with a digest schedule
+func (conf *Configuration) cronDigest(name string) {
+	ic := conf.accountByName(name)
+	if ic == nil || conf.stopping() {
+		return
+	}
+	if err := conf.sendDigest(ic, time.Now()); err != nil {
+		log.Errorf("error sending digest of account %s: %v", name, err)
+	}
+}
+
+// sendDigest sends the mails moved to the quarantine since the last digest of the account. Nothing is sent if there
+// are no new mails. Sent digests are written to the history.
+func (conf *Configuration) sendDigest(ic *ImapConfiguration, now time.Time) error {
+	if conf.HistoryFile == "" {
+		return fmt.Errorf("digests need the history file")
+	}
+	since := now.Add(-digestFirstPeriod)
+	last, err := conf.readHistory(historyFilter{account: ic.Name, action: historyActionDigest}, 1)
+	if err != nil {
+		return err
+	}
+	if len(last) > 0 {
+		since = last[0].Time
+	}
+	entries, err := conf.readHistory(historyFilter{account: ic.Name, since: since}, 0)
+	if err != nil {
+		return err
+	}
+	entries = quarantinedEntries(entries)
+	if len(entries) == 0 {
+		log.Debugf("no new mails in the quarantine of account %s, skipping the digest", ic.Name)
+		return nil
+	}
+	data := digestData{
+		Account:   ic.Name,
+		Folder:    ic.quarantineFolder(),
+		Retention: ic.Retention,
+		Since:     since,
+	}
+	for _, e := range entries {
+		data.Mails = append(data.Mails, &digestMail{
+			HistoryEntry: e,
+			Release:      conf.quarantineLink(ic, e.MessageId, "release"),
+			Confirm:      conf.quarantineLink(ic, e.MessageId, "confirm"),
+		})
+	}
+	subject := fmt.Sprintf("eatspam: %d mails in the quarantine of %s", len(entries), ic.Name)
+	msg, err := conf.digestMessage(ic, subject, &data, now)
+	if err != nil {
+		return err
+	}
+	if ic.Digest.Delivery == deliveryImap {
+		err = ic.appendDigest(conf.key, msg, now)
+	} else {
+		err = conf.Smtp.send(ic.Digest.To, msg)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("sent digest with %d mails of account %s", len(entries), ic.Name)
+	conf.appendHistory(&HistoryEntry{Time: now, Account: ic.Name, Subject: subject, Action: historyActionDigest})
+	return nil
+}
+
+// quarantinedEntries returns the rejected mails of the history entries, which have no later release or purge entry
+func quarantinedEntries(entries []*HistoryEntry) []*HistoryEntry {
+	gone := map[string]int{}
+	for i, e := range entries {
+		if e.MessageId != "" && (e.Action == historyActionRelease || e.Action == historyActionPurge) {
+			gone[e.MessageId] = i
+		}
+	}
+	quarantined := make([]*HistoryEntry, 0)
+	for i, e := range entries {
+		if e.Action != spamActionReject {
+			continue
+		}
+		if j, ok := gone[e.MessageId]; ok && j > i {
+			continue
+		}
+		quarantined = append(quarantined, e)
+	}
+	return quarantined
+}
+
+// quarantineLink returns the link to the web ui page for releasing or confirming a quarantined mail. Without
+// http.externalUrl or Message-ID there is no link.
+func (conf *Configuration) quarantineLink(ic *ImapConfiguration, messageId string, do string) string {
+	if conf.Http.ExternalUrl == "" || messageId == "" {
+		return ""
+	}
+	q := url.Values{"a": {ic.Name}, "id": {messageId}, "do": {do}}
+	return strings.TrimSuffix(conf.Http.ExternalUrl, "/") + conf.url("/quarantine.html") + "?" + q.Encode()
+}
+
+// digestMessage creates the digest mail
+func (conf *Configuration) digestMessage(ic *ImapConfiguration, subject string, data *digestData, now time.Time) ([]byte, error) {
+	to := ic.Digest.To
+	if to == "" {
+		to = ic.Username
+	}
+	from := conf.Smtp.From
+	if from == "" {
+		from = "eatspam@localhost"
+	}
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: eatspam <%s>\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s.%s@eatspam>\r\n", strconv.FormatInt(now.Unix(), 10), hex.EncodeToString(id))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("Auto-Submitted: auto-generated\r\n\r\n")
+	var body bytes.Buffer
+	if err := digestTemplate.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("error creating digest: %v", err)
+	}
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes(), nil
+}
+
+// appendDigest puts the digest into the inbox of the account. It gets the flags of a checked mail, so it is not checked.
+func (ic *ImapConfiguration) appendDigest(key string, msg []byte, now time.Time) error {
+	err := ic.openSession(key)
+	if err != nil {
+		return err
+	}
+	defer ic.closeSession()
+	err = ic.client.Append(ic.Inbox, ic.checkedFlags(), now, bytes.NewBuffer(msg))
+	if err != nil {
+		return fmt.Errorf("error writing digest to %s: %v", ic.Inbox, err)
+	}
+	return nil
+}
+
+// send delivers msg to the recipient
+func (s *SmtpConfiguration) send(to string, msg []byte) error {
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	tlsConfig := &tls.Config{ServerName: s.Host, MinVersion: tls.VersionTLS12}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	var err error
+	if s.TlsMode == tlsModeImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to smtp server %s: %v", addr, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error connecting to smtp server %s: %v", addr, err)
+	}
+	defer c.Close()
+	if s.TlsMode == tlsModeStarttls {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("error starting tls with smtp server %s: %v", addr, err)
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.password, s.Host)); err != nil {
+			return fmt.Errorf("error logging into smtp server %s: %v", addr, err)
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return fmt.Errorf("error sending digest: %v", err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return fmt.Errorf("error sending digest to %s: %v", to, err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("error sending digest: %v", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("error sending digest: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error sending digest: %v", err)
+	}
+	return c.Quit()
+}
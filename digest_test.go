@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const quarantinedMail = "Message-ID: <win@example.com>\r\nFrom: sender@example.com\r\nSubject: win\r\n\r\nHello\r\n"
+
+// startTestSmtpServer starts a minimal SMTP server on localhost, which sends the data of every mail to the channel
+func startTestSmtpServer(t *testing.T) (int, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSmtp(conn, mails)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, mails
+}
+
+func serveSmtp(conn net.Conn, mails chan string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) {
+		conn.Write([]byte(s + "\r\n"))
+	}
+	reply("220 localhost ESMTP test")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			mails <- data.String()
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// setupDigestConfiguration returns a configuration with the account ic and a history with a rejected mail
+func setupDigestConfiguration(t *testing.T, ic *ImapConfiguration, key string) *Configuration {
+	c := setupTestConfiguration()
+	c.key = key
+	c.HistoryFile = filepath.Join(t.TempDir(), "eatspam.history")
+	c.ImapAccounts = []*ImapConfiguration{ic}
+	c.Http.ExternalUrl = "https://eatspam.example.com/"
+	c.Http.PathPrefix = "/eatspam"
+	c.appendHistory(&HistoryEntry{Time: time.Now().Add(-time.Hour), Account: ic.Name, Sender: "sender@example.com",
+		Subject: "win", MessageId: "<win@example.com>", Score: 12.5, Action: spamActionReject})
+	c.appendHistory(&HistoryEntry{Time: time.Now().Add(-time.Hour), Account: ic.Name, Subject: "hello", Action: spamActionNoAction})
+	return c
+}
+
+func TestSendDigestSmtp(t *testing.T) {
+	port, mails := startTestSmtpServer(t)
+	ic := &ImapConfiguration{Name: "test", Username: "user@example.com", SpamFolder: defaultImapSpamFolder,
+		Digest: DigestConfiguration{Schedule: digestDaily}}
+	c := setupDigestConfiguration(t, ic, "")
+	c.Smtp = SmtpConfiguration{Host: "127.0.0.1", Port: port, TlsMode: tlsModeNone, From: "eatspam@example.com"}
+	if err := c.validateSmtp(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validateDigest(ic); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []string{historyActionRelease, historyActionPurge} {
+		id := "<" + a + "@example.com>"
+		c.appendHistory(&HistoryEntry{Time: time.Now().Add(-time.Hour), Account: ic.Name, Subject: a, MessageId: id, Action: spamActionReject})
+		c.appendHistory(&HistoryEntry{Time: time.Now().Add(-time.Minute), Account: ic.Name, MessageId: id, Action: a})
+	}
+	if ic.Digest.Delivery != deliverySmtp || ic.Digest.To != "user@example.com" {
+		t.Fatalf("expected smtp delivery to the username, got %+v", ic.Digest)
+	}
+	if err := c.sendDigest(ic, time.Now()); err != nil {
+		t.Fatalf("error sending digest: %v", err)
+	}
+	var mail string
+	select {
+	case mail = <-mails:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no digest received")
+	}
+	release := "https://eatspam.example.com/eatspam/quarantine.html?" + url.Values{"a": {"test"}, "do": {"release"}, "id": {"<win@example.com>"}}.Encode()
+	for _, s := range []string{"To: user@example.com\r\n", "Auto-Submitted: auto-generated\r\n", "From:    sender@example.com", "Subject: win", "score 12.5", release} {
+		if !strings.Contains(mail, s) {
+			t.Errorf("expected %q in the digest:\n%s", s, mail)
+		}
+	}
+	for _, s := range []string{"hello", "Subject: " + historyActionRelease, "Subject: " + historyActionPurge} {
+		if strings.Contains(mail, s) {
+			t.Errorf("expected only mails still in the quarantine in the digest, got %q:\n%s", s, mail)
+		}
+	}
+	entries, err := c.readHistory(historyFilter{action: historyActionDigest}, 0)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected the digest in the history, got %v (%v)", entries, err)
+	}
+	if err := c.sendDigest(ic, time.Now()); err != nil {
+		t.Fatalf("error sending digest: %v", err)
+	}
+	select {
+	case mail = <-mails:
+		t.Errorf("expected no digest without new mails, got:\n%s", mail)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSendDigestImap(t *testing.T) {
+	key := generateKey()
+	ic, be := startTestImapServer(t, key)
+	ic.InboxBehaviour = behaviourUnseen
+	ic.Digest = DigestConfiguration{Schedule: "0 7 * * *"}
+	c := setupDigestConfiguration(t, ic, key)
+	c.Http.ExternalUrl = ""
+	if err := c.validateDigest(ic); err != nil || ic.Digest.Delivery != deliveryImap {
+		t.Fatalf("expected imap delivery without smtp server, got %s (%v)", ic.Digest.Delivery, err)
+	}
+	if err := c.sendDigest(ic, time.Now()); err != nil {
+		t.Fatalf("error sending digest: %v", err)
+	}
+	defer ic.logoutSession()
+	msgs := mailboxMessages(t, be, defaultImapInbox)
+	last := msgs[len(msgs)-1]
+	if !strings.Contains(last.body, "Subject: eatspam: 1 mails in the quarantine of test") || strings.Contains(last.body, "Release:") {
+		t.Errorf("expected the digest without links in the inbox, got:\n%s", last.body)
+	}
+	if !contains(last.flags, imap.CanonicalFlag(eatspamSeenFlag)) || !contains(last.flags, imap.SeenFlag) {
+		t.Errorf("expected the digest flagged as seen and seen by eatspam, got %v", last.flags)
+	}
+}
+
+func TestValidateDigest(t *testing.T) {
+	c := setupTestConfiguration()
+	for _, d := range []DigestConfiguration{
+		{Schedule: "sometimes"},
+		{Schedule: digestWeekly, Delivery: deliverySmtp, To: "user@example.com"},
+		{Schedule: digestWeekly, Delivery: "pigeon"},
+	} {
+		ic := &ImapConfiguration{Name: "test", Username: "username", Digest: d}
+		if err := c.validateDigest(ic); err == nil {
+			t.Errorf("expected error for digest %+v", d)
+		}
+	}
+	c.Smtp = SmtpConfiguration{Host: "smtp.example.com", TlsMode: tlsModeNone, From: "eatspam@example.com"}
+	if err := c.validateSmtp(); err == nil {
+		t.Errorf("expected error for smtp without tls to a remote host")
+	}
+	c.Smtp.TlsMode = ""
+	if err := c.validateSmtp(); err != nil || c.Smtp.TlsMode != tlsModeStarttls || c.Smtp.Port != defaultSmtpStarttlsPort {
+		t.Errorf("expected starttls on port %d, got %+v (%v)", defaultSmtpStarttlsPort, c.Smtp, err)
+	}
+}
+
+func TestReleaseQuarantine(t *testing.T) {
+	key := generateKey()
+	ic, be := startTestImapServer(t, key)
+	ic.Quarantine = "Quarantine"
+	defer ic.logoutSession()
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox(ic.Quarantine); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(ic.Quarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(strings.Replace(quarantinedMail, "win@", string(rune('a'+i))+"@", 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := setupHttpConfiguration(t)
+	c.key = key
+	c.HistoryFile = filepath.Join(t.TempDir(), "eatspam.history")
+	c.ImapAccounts = []*ImapConfiguration{ic}
+	ck := login(t, c)
+	s := sessions.get(ck.Value, time.Hour)
+
+	w := postForm(c, "/confirm", url.Values{"a": {"test"}, "id": {"<b@example.com>"}, csrfField: {s.csrf}}, ck)
+	if text, kind := s.takeFlash(); w.Code != http.StatusFound || kind != "success" {
+		t.Errorf("expected confirmed mail, got %d %s", w.Code, text)
+	}
+	w = postForm(c, "/release", url.Values{"a": {"test"}, "id": {"<a@example.com>"}, csrfField: {s.csrf}}, ck)
+	if text, kind := s.takeFlash(); w.Code != http.StatusFound || kind != "success" {
+		t.Errorf("expected released mail, got %d %s", w.Code, text)
+	}
+	quarantine := mailboxMessages(t, be, ic.Quarantine)
+	if len(quarantine) != 1 || !strings.Contains(quarantine[0].body, "<b@example.com>") {
+		t.Errorf("expected only the confirmed mail in the quarantine, got %v", quarantine)
+	}
+	inbox := mailboxMessages(t, be, defaultImapInbox)
+	if last := inbox[len(inbox)-1]; !strings.Contains(last.body, "<a@example.com>") || !contains(last.flags, imap.CanonicalFlag(eatspamSeenFlag)) {
+		t.Errorf("expected the released mail in the inbox, got %v", last)
+	}
+	entries, err := c.readHistory(historyFilter{action: historyActionRelease}, 0)
+	if err != nil || len(entries) != 1 || entries[0].MessageId != "<a@example.com>" {
+		t.Errorf("expected the release in the history, got %v (%v)", entries, err)
+	}
+	w = postForm(c, "/release", url.Values{"a": {"test"}, "id": {"<a@example.com>"}, csrfField: {s.csrf}}, ck)
+	if text, kind := s.takeFlash(); w.Code != http.StatusFound || kind != "danger" {
+		t.Errorf("expected error for a mail not in the quarantine, got %d %s", w.Code, text)
+	}
+}
+
+func TestLoginNext(t *testing.T) {
+	c := setupHttpConfiguration(t)
+	r := httptest.NewRecorder()
+	c.handlerIndex(r, httptest.NewRequest(http.MethodGet, "/quarantine.html?a=test&id=x", nil))
+	next := "/quarantine.html?a=test&id=x"
+	location := "/login.html?" + url.Values{"next": {next}}.Encode()
+	if r.Code != http.StatusFound || r.Header().Get("Location") != location {
+		t.Fatalf("expected redirect to the login with next, got %d %s", r.Code, r.Header().Get("Location"))
+	}
+	w := postForm(c, "/login", url.Values{"password": {"password"}, "next": {next}}, nil)
+	if w.Header().Get("Location") != next {
+		t.Errorf("expected redirect to %s after login, got %s", next, w.Header().Get("Location"))
+	}
+	for _, other := range []string{"https://evil.example.com/", "//evil.example.com/", "/\\evil.example.com"} {
+		w := postForm(c, "/login", url.Values{"password": {"password"}, "next": {other}}, nil)
+		if w.Header().Get("Location") != "/index.html" {
+			t.Errorf("expected redirect to the index for %s, got %s", other, w.Header().Get("Location"))
+		}
+	}
+}
+
+type testMessage struct {
+	body  string
+	flags []string
+}
+
+// mailboxMessages returns the messages of a mailbox of the test server
+func mailboxMessages(t *testing.T, be *memory.Backend, name string) []testMessage {
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *imap.Message, 100)
+	section := &imap.BodySectionName{}
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+	if err := mbox.ListMessages(false, seqset, []imap.FetchItem{imap.FetchFlags, section.FetchItem()}, ch); err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([]testMessage, 0)
+	for msg := range ch {
+		if contains(msg.Flags, imap.DeletedFlag) {
+			continue
+		}
+		var b bytes.Buffer
+		b.ReadFrom(msg.GetBody(section))
+		msgs = append(msgs, testMessage{body: b.String(), flags: msg.Flags})
+	}
+	return msgs
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxHistorySize is the size of the history file, at which it is moved to <historyFile>.1
+const maxHistorySize = 10 << 20
+
+// historyMu serializes the writes to the history file
+var historyMu sync.Mutex
+
+// HistoryEntry is a processed mail in the history file. The file has one json object per line.
+type HistoryEntry struct {
+	Time      time.Time `json:"time"`
+	Account   string    `json:"account"`
+	Sender    string    `json:"sender"`
+	Subject   string    `json:"subject"`
+	MessageId string    `json:"messageId"`
+	Date      time.Time `json:"date"`
+	Score     float64   `json:"score"`
+	Action    string    `json:"action"`
+}
+
+func historyEntry(ic *ImapConfiguration, result checkSpamResult, msg *imap.Message) *HistoryEntry {
+	e := HistoryEntry{
+		Time:    time.Now(),
+		Account: ic.Name,
+		Score:   result.score,
+		Action:  result.action,
+	}
+	if msg != nil && msg.Envelope != nil {
+		if len(msg.Envelope.Sender) > 0 {
+			e.Sender = msg.Envelope.Sender[0].Address()
+		}
+		e.Subject = msg.Envelope.Subject
+		e.MessageId = msg.Envelope.MessageId
+		e.Date = msg.Envelope.Date
+	}
+	return &e
+}
+
+// appendHistory writes the entry to the history file. Errors are only logged, they don't stop the run.
+func (conf *Configuration) appendHistory(e *HistoryEntry) {
+	if conf.HistoryFile == "" {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("error encoding history entry: %v", err)
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if fi, err := os.Stat(conf.HistoryFile); err == nil && fi.Size() >= maxHistorySize {
+		if err := os.Rename(conf.HistoryFile, conf.HistoryFile+".1"); err != nil {
+			log.Errorf("error rotating history file: %v", err)
+		}
+	}
+	f, err := os.OpenFile(conf.HistoryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Errorf("error opening history file: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Errorf("error writing history file: %v", err)
+	}
+}
+
+// historyFilter selects entries of the history
+type historyFilter struct {
+	account string
+	action  string
+	since   time.Time
+}
+
+func (hf *historyFilter) matches(e *HistoryEntry) bool {
+	return (hf.account == "" || e.Account == hf.account) &&
+		(hf.action == "" || e.Action == hf.action) &&
+		!e.Time.Before(hf.since)
+}
+
+// readHistory returns the last limit entries of the history file and the rotated file matching the filter, oldest
+// first. A limit of 0 returns all entries.
+func (conf *Configuration) readHistory(hf historyFilter, limit int) ([]*HistoryEntry, error) {
+	entries := make([]*HistoryEntry, 0)
+	for _, file := range []string{conf.HistoryFile + ".1", conf.HistoryFile} {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading history: %v", err)
+		}
+		s := bufio.NewScanner(f)
+		s.Buffer(make([]byte, 64*1024), 1<<20)
+		line := 0
+		for s.Scan() {
+			line++
+			if len(bytes.TrimSpace(s.Bytes())) == 0 {
+				continue
+			}
+			e := HistoryEntry{}
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				log.Warnf("skipping illegal entry in %s line %d: %v", file, line, err)
+				continue
+			}
+			if hf.matches(&e) {
+				entries = append(entries, &e)
+			}
+		}
+		err = s.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading history: %v", err)
+		}
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
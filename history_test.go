@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	c := setupTestConfiguration()
+	c.HistoryFile = filepath.Join(t.TempDir(), "eatspam.history")
+	now := time.Now()
+	c.appendHistory(&HistoryEntry{Time: now.Add(-48 * time.Hour), Account: "alice", Score: 1, Action: spamActionNoAction})
+	c.appendHistory(&HistoryEntry{Time: now.Add(-time.Hour), Account: "bob", Score: 20, Action: spamActionReject, Subject: "spam"})
+	c.appendHistory(&HistoryEntry{Time: now, Account: "alice", Score: 8, Action: spamActionAddHeader})
+
+	entries, err := c.readHistory(historyFilter{}, 0)
+	if err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+	if len(entries) != 3 || entries[0].Account != "alice" || entries[1].Subject != "spam" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	entries, _ = c.readHistory(historyFilter{}, 2)
+	if len(entries) != 2 || entries[0].Account != "bob" {
+		t.Errorf("expected the last 2 entries, got %+v", entries)
+	}
+	entries, _ = c.readHistory(historyFilter{account: "alice"}, 0)
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries of alice, got %d", len(entries))
+	}
+	entries, _ = c.readHistory(historyFilter{action: spamActionReject}, 0)
+	if len(entries) != 1 || entries[0].Account != "bob" {
+		t.Errorf("expected the rejected mail, got %+v", entries)
+	}
+	entries, _ = c.readHistory(historyFilter{since: now.Add(-24 * time.Hour)}, 0)
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries of the last day, got %d", len(entries))
+	}
+}
+
+func TestHistoryRotation(t *testing.T) {
+	c := setupTestConfiguration()
+	c.HistoryFile = filepath.Join(t.TempDir(), "eatspam.history")
+	c.appendHistory(&HistoryEntry{Time: time.Now(), Account: "old"})
+	f, err := os.OpenFile(c.HistoryFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fill the file with empty lines up to the maximum size
+	line := strings.Repeat(" ", 1023) + "\n"
+	for i := 0; i < maxHistorySize/len(line); i++ {
+		_, _ = f.WriteString(line)
+	}
+	f.Close()
+	c.appendHistory(&HistoryEntry{Time: time.Now(), Account: "new"})
+
+	if _, err := os.Stat(c.HistoryFile + ".1"); err != nil {
+		t.Fatalf("expected rotated history file: %v", err)
+	}
+	entries, err := c.readHistory(historyFilter{}, 0)
+	if err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Account != "old" || entries[1].Account != "new" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+	tests := map[string]time.Time{
+		"24h":        now.Add(-24 * time.Hour),
+		"7d":         time.Date(2024, 3, 3, 12, 0, 0, 0, time.Local),
+		"2024-03-01": time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local),
+	}
+	for s, expected := range tests {
+		got, err := parseSince(s, now)
+		if err != nil || !got.Equal(expected) {
+			t.Errorf("expected %s for '%s', got %s (%v)", expected, s, got, err)
+		}
+	}
+	for _, illegal := range []string{"", "yesterday", "-1d", "2024-13-01"} {
+		if _, err := parseSince(illegal, now); err == nil {
+			t.Errorf("expected error for '%s'", illegal)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	oldCli, oldFlags := cli, cliFlags
+	defer func() {
+		cli, cliFlags = oldCli, oldFlags
+	}()
+	var account string
+	rest := parseCommand(usageScan, []string{"learn", "--loglevel", "debug", "spam", "--account", "alice", "mails"}, func(fs *flag.FlagSet) {
+		fs.StringVar(&account, "account", "", "")
+	})
+	if strings.Join(rest, " ") != "learn spam mails" {
+		t.Errorf("unexpected arguments %v", rest)
+	}
+	if account != "alice" || cli.LogLevel != "debug" || !isFlagPassed("loglevel") || isFlagPassed("daemon") {
+		t.Errorf("unexpected parameters account=%s logLevel=%s", account, cli.LogLevel)
+	}
+}
+
+func TestMessageFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"cur/1", "cur/2", "new/3", ".hidden/4", "cur/.5"} {
+		p := filepath.Join(dir, name)
+		_ = os.MkdirAll(filepath.Dir(p), 0700)
+		if err := os.WriteFile(p, []byte(testMail), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := messageFiles([]string{dir, filepath.Join(dir, "cur/.5")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Errorf("expected 3 files of the folder and the explicit file, got %v", files)
+	}
+	if _, err := messageFiles([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expected error for missing folder")
+	}
+}
@@ -7,22 +7,19 @@ import (
 	log "github.com/sirupsen/logrus"
 	"html/template"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	templateDir = "templates"
 	assetsDir   = "assets"
-)
-
-const (
-	secretPhrase   = "secret"
-	cookieLoggedIn = "loggedIn"
-)
-
-var (
-	lastMessageText string
-	lastMessageType string
+	// httpReadHeaderTimeout and httpIdleTimeout limit slow and idle clients of the web ui
+	httpReadHeaderTimeout = 10 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
 )
 
 //go:embed templates
@@ -31,74 +28,148 @@ var templates embed.FS
 //go:embed assets
 var assets embed.FS
 
-func (conf *Configuration) startHttpListener() {
-	http.HandleFunc("/", conf.handlerIndex)
+// startHttpListener starts the web ui in the background and returns the servers for the shutdown
+func (conf *Configuration) startHttpListener() []*http.Server {
+	listen := conf.httpListen()
+	srv := newHttpServer(listen, conf.httpHandler())
+	if !conf.Http.Tls.Use {
+		log.Infof("web ui listens on http://%s%s", listen, conf.url("/"))
+		go serve(srv.ListenAndServe)
+		return []*http.Server{srv}
+	}
+	tlsConfig, err := conf.httpTlsConfig()
+	if err != nil {
+		log.Fatalf("error configuring https: %v", err)
+	}
+	servers := []*http.Server{srv}
+	if conf.Http.Tls.Redirect != "" {
+		redirect := newHttpServer(conf.Http.Tls.Redirect, httpsRedirect(listen))
+		log.Infof("redirecting http://%s to https", conf.Http.Tls.Redirect)
+		go serve(redirect.ListenAndServe)
+		servers = append(servers, redirect)
+	}
+	srv.TLSConfig = tlsConfig
+	log.Infof("web ui listens on https://%s%s", listen, conf.url("/"))
+	go serve(func() error {
+		return srv.ListenAndServeTLS("", "")
+	})
+	return servers
+}
+
+func newHttpServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+}
+
+// serve runs a listener and stops eatspam if it fails. A shutdown is no failure.
+func serve(listen func() error) {
+	if err := listen(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// parseTemplates parses the templates with the template functions
+func (conf *Configuration) parseTemplates(files ...string) (*template.Template, error) {
+	return template.New(path.Base(files[0])).Funcs(conf.templateFuncs()).ParseFS(templates, files...)
+}
+
+// httpHandler routes the web ui, the api and the metrics. With a path prefix all routes are below the prefix.
+func (conf *Configuration) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", conf.handlerIndex)
+	conf.startApi(mux)
 	if conf.CollectMetrics {
-		http.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	if conf.Http.PathPrefix == "" {
+		return conf.readLocked(mux)
+	}
+	root := http.NewServeMux()
+	root.Handle(conf.Http.PathPrefix+"/", http.StripPrefix(conf.Http.PathPrefix, mux))
+	root.Handle(conf.Http.PathPrefix, http.RedirectHandler(conf.url("/"), http.StatusMovedPermanently))
+	return conf.readLocked(root)
+}
+
+// readLocked serves a request with the read lock of the config, so a reload does not change the config during the request
+func (conf *Configuration) readLocked(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf.confMu.RLock()
+		defer conf.confMu.RUnlock()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// httpListen returns the listen address of the web ui, http.listen or all interfaces with http.port
+func (conf *Configuration) httpListen() string {
+	if conf.Http.Listen != "" {
+		return conf.Http.Listen
 	}
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%04d", conf.Http.Port), nil))
+	return fmt.Sprintf(":%d", conf.Http.Port)
 }
 
 func (conf *Configuration) handlerIndex(w http.ResponseWriter, r *http.Request) {
-	if r.RequestURI == "" || r.RequestURI == "/" {
-		http.Redirect(w, r, "/index.html", http.StatusMovedPermanently)
+	if r.URL.Path == "" || r.URL.Path == "/" {
+		http.Redirect(w, r, conf.url("/index.html"), http.StatusMovedPermanently)
 		conf.pushRequests(r, http.StatusMovedPermanently)
-	} else if r.RequestURI == "/logout" {
-		c := http.Cookie{
-			Name:   cookieLoggedIn,
-			Value:  "",
-			MaxAge: 0,
-		}
-		http.SetCookie(w, &c)
-		http.Redirect(w, r, "/login.html", http.StatusMovedPermanently)
-		conf.pushRequests(r, http.StatusMovedPermanently)
-	} else if r.RequestURI == "/login" && r.Method == http.MethodPost {
-		if err := r.ParseForm(); err != nil {
-			fmt.Fprintf(w, "ParseForm() err: %v", err)
+	} else if r.URL.Path == "/logout" {
+		s := conf.checkPost(w, r)
+		if s == nil {
 			return
 		}
-		pw := r.FormValue("password")
-		opw, err := decrypt(conf.Http.Password, conf.key)
-		if err != nil || opw != pw {
-			conf.renderUnauthorized(w, r)
+		sessions.revoke(s.id)
+		conf.setSessionCookie(w, r, "")
+		http.Redirect(w, r, conf.url("/login.html"), http.StatusFound)
+		conf.pushRequests(r, http.StatusFound)
+	} else if r.URL.Path == "/login" && r.Method == http.MethodPost {
+		conf.handleLogin(w, r)
+	} else if r.URL.Path == "/scan" {
+		s := conf.checkPost(w, r)
+		if s == nil {
 			return
 		}
-		secret, err := encrypt(secretPhrase, conf.key)
-		if err != nil {
-			conf.renderServerError(w, r)
+		conf.handleScan(w, r, s)
+	} else if r.URL.Path == "/ham" {
+		s := conf.checkPost(w, r)
+		if s == nil {
 			return
 		}
-		c := http.Cookie{
-			Name:   cookieLoggedIn,
-			Value:  secret,
-			MaxAge: 3600,
-		}
-		http.SetCookie(w, &c)
-		http.Redirect(w, r, "/index.html", http.StatusMovedPermanently)
-		conf.pushRequests(r, http.StatusMovedPermanently)
-
-	} else if r.URL.Path == "/ham" {
-		m := r.URL.Query().Get("m")
+		m := r.PostFormValue("m")
 		log.Debugf("make %s to ham", m)
 		qe := queue.byId(m)
-		if qe != nil {
+		if qe != nil && qe.Account != nil && s.user.canSee(qe.Account.Name) {
 			err := conf.learnHam(qe)
 			if err != nil {
 				log.Errorf("error learning ham: %v", err)
 			}
 		}
-		http.Redirect(w, r, "/mails.html", http.StatusFound)
+		http.Redirect(w, r, conf.url("/mails.html"), http.StatusFound)
 	} else if r.URL.Path == "/spam" {
-		m := r.URL.Query().Get("m")
+		s := conf.checkPost(w, r)
+		if s == nil {
+			return
+		}
+		m := r.PostFormValue("m")
 		log.Debugf("make %s to spam", m)
 		qe := queue.byId(m)
-		if qe != nil {
+		if qe != nil && qe.Account != nil && s.user.canSee(qe.Account.Name) {
 			err := conf.learnSpam(qe)
 			if err != nil {
 				log.Errorf("error learning spam: %v", err)
 			}
 		}
-		http.Redirect(w, r, "/mails.html", http.StatusFound)
+		http.Redirect(w, r, conf.url("/mails.html"), http.StatusFound)
+	} else if r.URL.Path == "/release" || r.URL.Path == "/confirm" {
+		s := conf.checkPost(w, r)
+		if s == nil {
+			return
+		}
+		conf.handleQuarantine(w, r, s, r.URL.Path == "/release")
+	} else if strings.HasPrefix(r.URL.Path, "/settings/") {
+		conf.handleSettings(w, r)
 	} else if f, err := templates.Open(templateDir + r.URL.Path); err == nil {
 		f.Close()
 		conf.handleTemplate(w, r)
@@ -110,39 +181,120 @@ func (conf *Configuration) handlerIndex(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func (conf *Configuration) handleTemplate(w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
-	case "/index.html":
-		if !conf.checkLoggedIn(w, r) {
+// handleLogin starts a new session if the password is correct. Clients with too many failed logins are blocked for a while.
+func (conf *Configuration) handleLogin(w http.ResponseWriter, r *http.Request) {
+	client := conf.clientAddress(r)
+	if d := logins.blocked(client); d > 0 {
+		log.Warnf("login from %s blocked for %s after failed logins", client, d.Round(time.Second))
+		w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "Too many failed logins. Try again later.")
+		conf.pushRequests(r, http.StatusTooManyRequests)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		conf.renderBadRequest(w, r)
+		return
+	}
+	u := conf.authenticateUser(r.PostFormValue("username"), r.PostFormValue("password"))
+	if u == nil {
+		logins.failed(client)
+		conf.renderUnauthorized(w, r)
+		return
+	}
+	logins.succeeded(client)
+	log.Infof("user %s logged in from %s", u.name, client)
+	s := sessions.create(u, conf.Http.sessionTimeout)
+	conf.setSessionCookie(w, r, s.id)
+	http.Redirect(w, r, conf.url(localPath(r.PostFormValue("next"))), http.StatusFound)
+	conf.pushRequests(r, http.StatusFound)
+}
+
+// localPath returns next if it is a path of the web ui or /index.html. It prevents redirects to other sites after the
+// login.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return "/index.html"
+	}
+	return next
+}
+
+// handleScan starts a check of one account (parameter a) or all accounts of the user in the background. The index page
+// shows the running scan and its result.
+func (conf *Configuration) handleScan(w http.ResponseWriter, r *http.Request, s *session) {
+	accounts := conf.visibleAccounts(s.user)
+	if a := r.PostFormValue("a"); a != "" {
+		ic := conf.accountByName(a)
+		if ic == nil || !s.user.canSee(ic.Name) {
+			s.setFlash(fmt.Sprintf("IMAP account '%s' not found", a), "danger")
+			http.Redirect(w, r, conf.url("/index.html"), http.StatusFound)
+			conf.pushRequests(r, http.StatusFound)
 			return
 		}
-		conf.renderIndex(w, r)
-	case "/login.html":
-		conf.renderLogin(w, r)
-	case "/account.html":
-		if !conf.checkLoggedIn(w, r) {
-			return
+		accounts = []*ImapConfiguration{ic}
+	}
+	s.setScanning(true)
+	ok := conf.startScan(func(results []*RunResult) {
+		kind := "success"
+		texts := make([]string, 0)
+		for _, rr := range results {
+			if rr.Error != "" {
+				kind = "danger"
+			}
+			texts = append(texts, rr.String())
 		}
-		conf.renderAccount(w, r)
-	case "/mails.html":
+		s.setFlash(strings.Join(texts, "; "), kind)
+		s.setScanning(false)
+	}, accounts...)
+	if !ok {
+		s.setScanning(false)
+		s.setFlash("spamchecker is still working. Try again later.", "warning")
+	}
+	http.Redirect(w, r, conf.url("/index.html"), http.StatusFound)
+	conf.pushRequests(r, http.StatusFound)
+}
 
+func (conf *Configuration) handleTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/login.html" {
+		conf.renderLogin(w, r)
+		return
 	}
-	accessLog(r, http.StatusOK, r.RequestURI)
-	if !conf.checkLoggedIn(w, r) {
+	s := conf.checkLoggedIn(w, r)
+	if s == nil {
 		return
 	}
-	conf.renderMails(w, r)
+	accessLog(r, http.StatusOK, r.RequestURI)
+	switch r.URL.Path {
+	case "/index.html":
+		conf.renderIndex(w, r, s)
+	case "/account.html":
+		conf.renderAccount(w, r, s)
+	case "/mails.html":
+		conf.renderMails(w, r, s)
+	case "/quarantine.html":
+		conf.renderQuarantine(w, r, s)
+	case "/settings.html":
+		if conf.checkAdmin(w, r, s) != nil {
+			conf.renderSettings(w, r, s)
+		}
+	case "/accountEdit.html":
+		if conf.checkAdmin(w, r, s) != nil {
+			conf.handleAccountEdit(w, r, s)
+		}
+	default:
+		conf.renderNotFound(w, r)
+	}
 }
 
 func (conf *Configuration) serveFile(w http.ResponseWriter, r *http.Request) {
-	data, err := assets.ReadFile(assetsDir + r.RequestURI)
+	data, err := assets.ReadFile(assetsDir + r.URL.Path)
 	if err != nil {
 		accessLog(r, http.StatusInternalServerError, err.Error())
 		conf.renderServerError(w, r)
 		return
 	}
 	accessLog(r, 200, "")
-	lc := strings.ToLower(r.RequestURI)
+	lc := strings.ToLower(r.URL.Path)
 	switch {
 	case strings.HasSuffix(lc, ".css"):
 		w.Header().Add("Content-Type", "text/css")
@@ -176,38 +328,55 @@ func (conf *Configuration) serveFile(w http.ResponseWriter, r *http.Request) {
 }
 
 type IndexData struct {
-	Page          string
-	MessageText   string
-	MessageType   string
-	Configuration *Configuration
+	Page        string
+	Csrf        string
+	User        string
+	Admin       bool
+	MessageText string
+	MessageType string
+	Scanning    bool
+	Accounts    []*ImapConfiguration
 }
 
-func (conf *Configuration) renderIndex(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFS(templates, templateDir+r.URL.Path, templateDir+"/navbar.html")
+func (conf *Configuration) renderIndex(w http.ResponseWriter, r *http.Request, s *session) {
+	t, err := conf.parseTemplates(templateDir+r.URL.Path, templateDir+"/navbar.html")
 	if err != nil {
 		log.Errorf("Error parsing template %s: %v", r.URL.Path, err)
 		conf.renderServerError(w, r)
 		return
 	}
-	err = t.Execute(w, IndexData{Page: "index", Configuration: conf, MessageType: lastMessageType, MessageText: lastMessageText})
+	text, kind := s.takeFlash()
+	err = t.Execute(w, IndexData{
+		Page:        "index",
+		Csrf:        s.csrf,
+		User:        s.user.name,
+		Admin:       s.user.isAdmin(),
+		Accounts:    conf.visibleAccounts(s.user),
+		MessageType: kind,
+		MessageText: text,
+		Scanning:    s.isScanning(),
+	})
 	if err != nil {
 		log.Errorf("error executing template /index.html: %v", err)
 		conf.renderServerError(w, r)
 	} else {
 		conf.pushRequests(r, http.StatusOK)
 	}
-	lastMessageType = ""
-	lastMessageText = ""
+}
+
+type LoginData struct {
+	Version string
+	Next    string
 }
 
 func (conf *Configuration) renderLogin(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFS(templates, templateDir+r.URL.Path)
+	t, err := conf.parseTemplates(templateDir + r.URL.Path)
 	if err != nil {
 		log.Errorf("error parsing template %s: %v", r.URL.Path, err)
 		conf.renderServerError(w, r)
 		return
 	}
-	err = t.Execute(w, conf)
+	err = t.Execute(w, LoginData{Version: conf.Version, Next: localPath(r.URL.Query().Get("next"))})
 	if err != nil {
 		log.Errorf("error executing template /login.html: %v", err)
 		conf.renderServerError(w, r)
@@ -218,67 +387,165 @@ func (conf *Configuration) renderLogin(w http.ResponseWriter, r *http.Request) {
 
 type AccountData struct {
 	Page         string
+	Csrf         string
+	User         string
+	Admin        bool
 	Imap         *ImapConfiguration
 	MailboxNames []string
 }
 
-func (conf *Configuration) renderAccount(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFS(templates, templateDir+r.URL.Path, templateDir+"/navbar.html")
+func (conf *Configuration) renderAccount(w http.ResponseWriter, r *http.Request, s *session) {
+	t, err := conf.parseTemplates(templateDir+r.URL.Path, templateDir+"/navbar.html")
 	if err != nil {
 		log.Errorf("error parsing template %s: %v", r.URL.Path, err)
 		conf.renderServerError(w, r)
 		return
 	}
 	a := r.URL.Query().Get("a")
-	for _, ia := range conf.ImapAccounts {
-		if ia.Name == a {
-			err := ia.connect()
-			if err != nil {
-				log.Fatalf("imap login to %s failed: %v", ia.Host, err)
-			}
-			err = ia.login(conf.key)
-			if err != nil {
-				conf.renderServerError(w, r)
-				return
-			}
-			defer ia.logout()
-			m, err := ia.mailboxes()
-			if err != nil {
-				log.Errorf("error getting mailbox list for %s: %v", ia.Name, err)
-				conf.renderServerError(w, r)
-				return
-			} else if len(m) > 0 {
-				mbs := make([]string, 0)
-				for mb := range m {
-					mbs = append(mbs, mb.Name)
-				}
-				ad := AccountData{
-					Page:         "account",
-					Imap:         ia,
-					MailboxNames: mbs,
-				}
-				err = t.Execute(w, &ad)
-				if err != nil {
-					log.Errorf("error executing account template: %v", err)
-				}
-				return
-			}
+	if ia := conf.accountByName(a); ia != nil && s.user.canSee(ia.Name) {
+		err := ia.tryOpenSession(conf.key)
+		if err != nil {
+			log.Errorf("error opening imap session for %s: %v", ia.Name, err)
+			s.setFlash(fmt.Sprintf("IMAP account '%s' is not available: %v", a, err), "danger")
+			http.Redirect(w, r, conf.url("/index.html"), http.StatusFound)
+			conf.pushRequests(r, http.StatusFound)
+			return
+		}
+		mbs, err := ia.mailboxNames()
+		ia.closeSession()
+		if err != nil {
+			log.Errorf("error getting mailbox list for %s: %v", ia.Name, err)
+			conf.renderServerError(w, r)
+			return
+		}
+		ad := AccountData{
+			Page:         "account",
+			Csrf:         s.csrf,
+			User:         s.user.name,
+			Admin:        s.user.isAdmin(),
+			Imap:         ia,
+			MailboxNames: mbs,
+		}
+		err = t.Execute(w, &ad)
+		if err != nil {
+			log.Errorf("error executing account template: %v", err)
 		}
+		return
 	}
-	lastMessageText = fmt.Sprintf("IMAP account '%s' not found", a)
-	lastMessageType = "danger"
-	http.Redirect(w, r, "index.html", http.StatusFound)
+	s.setFlash(fmt.Sprintf("IMAP account '%s' not found", a), "danger")
+	http.Redirect(w, r, conf.url("/index.html"), http.StatusFound)
 	conf.pushRequests(r, http.StatusFound)
 	//renderNotFound(w, r)
 }
 
 type MailsData struct {
 	Page     string
+	Csrf     string
+	User     string
+	Admin    bool
 	Elements []*QueueElement
 }
 
-func (conf *Configuration) renderMails(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFS(templates, templateDir+r.URL.Path, templateDir+"/navbar.html")
+type QuarantineData struct {
+	Page      string
+	Csrf      string
+	User      string
+	Admin     bool
+	Account   string
+	MessageId string
+	Sender    string
+	Subject   string
+	Date      time.Time
+	Do        string
+}
+
+// renderQuarantine shows a quarantined mail (parameters a and id) with buttons to release it or confirm it as spam.
+// The links of the digests open this page.
+func (conf *Configuration) renderQuarantine(w http.ResponseWriter, r *http.Request, s *session) {
+	t, err := conf.parseTemplates(templateDir+r.URL.Path, templateDir+"/navbar.html")
+	if err != nil {
+		log.Errorf("error parsing template %s: %v", r.URL.Path, err)
+		conf.renderServerError(w, r)
+		return
+	}
+	q := r.URL.Query()
+	ic := conf.accountByName(q.Get("a"))
+	if ic == nil || !s.user.canSee(ic.Name) {
+		s.setFlash(fmt.Sprintf("IMAP account '%s' not found", q.Get("a")), "danger")
+		http.Redirect(w, r, conf.url("/index.html"), http.StatusFound)
+		conf.pushRequests(r, http.StatusFound)
+		return
+	}
+	msg, _, err := ic.quarantinedMessage(conf.key, q.Get("id"))
+	if err != nil {
+		log.Errorf("error reading quarantine of %s: %v", ic.Name, err)
+		s.setFlash(fmt.Sprintf("mail not found in the quarantine of %s: %v", ic.Name, err), "danger")
+		http.Redirect(w, r, conf.url("/index.html"), http.StatusFound)
+		conf.pushRequests(r, http.StatusFound)
+		return
+	}
+	qd := QuarantineData{
+		Page:      "quarantine",
+		Csrf:      s.csrf,
+		User:      s.user.name,
+		Admin:     s.user.isAdmin(),
+		Account:   ic.Name,
+		MessageId: q.Get("id"),
+		Do:        q.Get("do"),
+	}
+	if msg.Envelope != nil {
+		if len(msg.Envelope.Sender) > 0 {
+			qd.Sender = msg.Envelope.Sender[0].Address()
+		}
+		qd.Subject = msg.Envelope.Subject
+		qd.Date = msg.Envelope.Date
+	}
+	err = t.Execute(w, &qd)
+	if err != nil {
+		log.Errorf("error executing quarantine template: %v", err)
+	}
+}
+
+// handleQuarantine releases a quarantined mail (parameters a and id) into the inbox and learns it as ham, or confirms
+// it and learns it as spam. The confirmed mail stays in the quarantine.
+func (conf *Configuration) handleQuarantine(w http.ResponseWriter, r *http.Request, s *session, release bool) {
+	a, id := r.PostFormValue("a"), r.PostFormValue("id")
+	ic := conf.accountByName(a)
+	if ic == nil || !s.user.canSee(ic.Name) {
+		s.setFlash(fmt.Sprintf("IMAP account '%s' not found", a), "danger")
+	} else if err := conf.releaseOrConfirm(ic, id, release); err != nil {
+		log.Errorf("error handling quarantined mail of %s: %v", ic.Name, err)
+		s.setFlash(err.Error(), "danger")
+	} else if release {
+		s.setFlash(fmt.Sprintf("mail released to %s of %s", ic.Inbox, ic.Name), "success")
+	} else {
+		s.setFlash(fmt.Sprintf("mail confirmed as spam in %s of %s", ic.quarantineFolder(), ic.Name), "success")
+	}
+	http.Redirect(w, r, conf.url("/index.html"), http.StatusFound)
+	conf.pushRequests(r, http.StatusFound)
+}
+
+// releaseOrConfirm releases the quarantined mail and learns it as ham or learns it as spam
+func (conf *Configuration) releaseOrConfirm(ic *ImapConfiguration, id string, release bool) error {
+	if release {
+		body, err := ic.releaseMessage(conf.key, id)
+		if err != nil {
+			return err
+		}
+		log.Infof("released mail %s from the quarantine of %s", id, ic.Name)
+		conf.appendHistory(&HistoryEntry{Time: time.Now(), Account: ic.Name, MessageId: id, Action: historyActionRelease})
+		return conf.learn(body, false)
+	}
+	_, body, err := ic.quarantinedMessage(conf.key, id)
+	if err != nil {
+		return err
+	}
+	log.Infof("confirmed mail %s in the quarantine of %s as spam", id, ic.Name)
+	return conf.learn(body, true)
+}
+
+func (conf *Configuration) renderMails(w http.ResponseWriter, r *http.Request, s *session) {
+	t, err := conf.parseTemplates(templateDir+r.URL.Path, templateDir+"/navbar.html")
 	if err != nil {
 		log.Errorf("error parsing template %s: %v", r.URL.Path, err)
 		conf.renderServerError(w, r)
@@ -286,30 +553,72 @@ func (conf *Configuration) renderMails(w http.ResponseWriter, r *http.Request) {
 	}
 	err = t.Execute(w, MailsData{
 		Page:     "mails",
-		Elements: queue.asList(),
+		Csrf:     s.csrf,
+		User:     s.user.name,
+		Admin:    s.user.isAdmin(),
+		Elements: visibleMails(s.user, queue.asList()),
 	})
 	if err != nil {
 		log.Errorf("error executing mails template: %v", err)
 	}
 }
 
-func (conf *Configuration) checkLoggedIn(w http.ResponseWriter, r *http.Request) bool {
-	cookie, err := r.Cookie(cookieLoggedIn)
-	if err == nil && cookie.Value != "" {
-		osp, err := decrypt(cookie.Value, conf.key)
-		if err == nil && strings.Compare(osp, secretPhrase) == 0 {
-			return true
+// checkLoggedIn returns the session of the request. A user of a trusted reverse proxy gets a new session. Without a
+// valid session it redirects to the login page and returns nil.
+func (conf *Configuration) checkLoggedIn(w http.ResponseWriter, r *http.Request) *session {
+	fu := conf.forwardedUser(r)
+	if cookie, err := r.Cookie(cookieSession); err == nil && cookie.Value != "" {
+		if s := sessions.get(cookie.Value, conf.Http.sessionTimeout); s != nil {
+			if fu == "" || fu == s.user.name {
+				return s
+			}
+			// the reverse proxy authenticated another user
+			sessions.revoke(s.id)
 		}
+		conf.setSessionCookie(w, r, "")
 	}
-	c := http.Cookie{
-		Name:   cookieLoggedIn,
-		Value:  "",
-		MaxAge: 0,
+	if fu != "" {
+		u := conf.forwardedWebUser(fu)
+		if u == nil {
+			log.Warnf("unknown user %s from reverse proxy %s", fu, r.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Forbidden")
+			conf.pushRequests(r, http.StatusForbidden)
+			return nil
+		}
+		s := sessions.create(u, conf.Http.sessionTimeout)
+		conf.setSessionCookie(w, r, s.id)
+		return s
 	}
-	http.SetCookie(w, &c)
-	http.Redirect(w, r, "/login.html", http.StatusFound)
-	conf.pushRequests(r, http.StatusNotFound)
-	return false
+	login := conf.url("/login.html")
+	if r.Method == http.MethodGet && r.URL.Path != "/index.html" {
+		login += "?" + url.Values{"next": {r.URL.RequestURI()}}.Encode()
+	}
+	http.Redirect(w, r, login, http.StatusFound)
+	conf.pushRequests(r, http.StatusFound)
+	return nil
+}
+
+// checkPost returns the session of a state-changing request. The request must be a POST with the csrf token of the session.
+func (conf *Configuration) checkPost(w http.ResponseWriter, r *http.Request) *session {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		conf.pushRequests(r, http.StatusMethodNotAllowed)
+		return nil
+	}
+	s := conf.checkLoggedIn(w, r)
+	if s == nil {
+		return nil
+	}
+	if !s.validCsrf(r) {
+		log.Warnf("%s %s with invalid csrf token", r.Method, r.RequestURI)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Forbidden")
+		conf.pushRequests(r, http.StatusForbidden)
+		return nil
+	}
+	return s
 }
 
 func (conf *Configuration) renderNotFound(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is the minimum time between two checks of the certificate files for changes
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate of the web ui and loads it again when the files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := certReloader{certFile: certFile, keyFile: keyFile}
+	err := cr.load()
+	if err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
+// load reads certificate and key if one of the files changed since the last load
+func (cr *certReloader) load() error {
+	modTime, err := latestModTime(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.checked = time.Now()
+	if cr.cert != nil && !modTime.After(cr.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %v", err)
+	}
+	if cr.cert != nil {
+		log.Infof("reloaded certificate %s", cr.certFile)
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// getCertificate is the GetCertificate callback of the tls configuration. A certificate which can't be loaded again
+// is logged and the previous certificate is used.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.checked) >= certCheckInterval {
+		if err := cr.load(); err != nil {
+			log.Errorf("error reloading certificate %s: %v", cr.certFile, err)
+		}
+	}
+	return cr.cert, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// createSelfSignedCertificate writes a self-signed certificate for the host name, localhost and the loopback
+// addresses to certFile and keyFile
+func createSelfSignedCertificate(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("error generating key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("error generating serial number: %v", err)
+	}
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		names = append(names, hostname)
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[len(names)-1], Organization: []string{"eatspam"}},
+		DNSNames:              names,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("error creating certificate: %v", err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("error encoding key: %v", err)
+	}
+	err = writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	if err != nil {
+		return fmt.Errorf("error writing key file: %v", err)
+	}
+	err = writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing certificate file: %v", err)
+	}
+	return nil
+}
+
+// httpTlsConfig creates the tls configuration of the web ui. Without certificate files a self-signed certificate is
+// created on the first start.
+func (conf *Configuration) httpTlsConfig() (*tls.Config, error) {
+	tc := conf.Http.Tls
+	_, certErr := os.Stat(tc.CertFile)
+	_, keyErr := os.Stat(tc.KeyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		log.Infof("creating self-signed certificate %s", tc.CertFile)
+		err := createSelfSignedCertificate(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cr, err := newCertReloader(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}, nil
+}
+
+// httpsRedirect redirects plain http requests to the https listener
+func httpsRedirect(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
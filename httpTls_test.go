@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHttpTlsConfig(t *testing.T) {
+	dir := t.TempDir()
+	c := &Configuration{Http: HttpConfiguration{Tls: HttpTlsConfiguration{
+		Use:      true,
+		CertFile: filepath.Join(dir, "eatspam-http.crt"),
+		KeyFile:  filepath.Join(dir, "eatspam-http.key"),
+	}}}
+	tc, err := c.httpTlsConfig()
+	if err != nil {
+		t.Fatalf("error creating tls config: %v", err)
+	}
+	cert, err := tc.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatalf("expected self-signed certificate: %v", err)
+	}
+	if fi, err := os.Stat(c.Http.Tls.KeyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected key file with permissions 0600")
+	}
+	// an existing certificate is kept on the next start
+	tc, err = c.httpTlsConfig()
+	if err != nil {
+		t.Fatalf("error creating tls config: %v", err)
+	}
+	if again, _ := tc.GetCertificate(nil); !bytes.Equal(again.Certificate[0], cert.Certificate[0]) {
+		t.Errorf("expected the existing certificate")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := createSelfSignedCertificate(certFile, keyFile); err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error loading certificate: %v", err)
+	}
+	old, _ := cr.getCertificate(nil)
+	if err := createSelfSignedCertificate(certFile, keyFile); err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	// the files are checked only every certCheckInterval
+	if cert, _ := cr.getCertificate(nil); !bytes.Equal(cert.Certificate[0], old.Certificate[0]) {
+		t.Errorf("expected the certificate not to be checked yet")
+	}
+	cr.checked = time.Now().Add(-certCheckInterval)
+	if cert, _ := cr.getCertificate(nil); bytes.Equal(cert.Certificate[0], old.Certificate[0]) {
+		t.Errorf("expected the changed certificate to be loaded")
+	}
+	// a broken certificate keeps the last one
+	os.WriteFile(certFile, []byte("broken"), 0644)
+	os.Chtimes(certFile, later.Add(time.Minute), later.Add(time.Minute))
+	cr.checked = time.Now().Add(-certCheckInterval)
+	if cert, _ := cr.getCertificate(nil); cert == nil {
+		t.Errorf("expected the last certificate after a failed reload")
+	}
+}
+
+func TestHttpsRedirect(t *testing.T) {
+	tests := []struct {
+		listen   string
+		host     string
+		expected string
+	}{
+		{":8443", "example.com:8080", "https://example.com:8443/index.html?a=b"},
+		{":443", "example.com", "https://example.com/index.html?a=b"},
+		{"127.0.0.1:8443", "[::1]:8080", "https://[::1]:8443/index.html?a=b"},
+		{":443", "[::1]", "https://[::1]/index.html?a=b"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/index.html?a=b", nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		httpsRedirect(test.listen).ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != test.expected {
+			t.Errorf("expected redirect to %s, got %d %s", test.expected, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupHttpConfiguration(t *testing.T) *Configuration {
+	c := setupTestConfiguration()
+	c.Http.password = "password"
+	c.Http.sessionTimeout = time.Hour
+	return c
+}
+
+// postForm sends a form to the web ui with the optional session cookie
+func postForm(c *Configuration, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "192.0.2.1:1234"
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	c.handlerIndex(w, r)
+	return w
+}
+
+// login logs in and returns the session cookie
+func login(t *testing.T, c *Configuration) *http.Cookie {
+	w := postForm(c, "/login", url.Values{"password": {"password"}}, nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect after login, got %d", w.Code)
+	}
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == cookieSession {
+			if !ck.HttpOnly || ck.SameSite != http.SameSiteLaxMode {
+				t.Errorf("expected HttpOnly and SameSite cookie")
+			}
+			return ck
+		}
+	}
+	t.Fatalf("no session cookie after login")
+	return nil
+}
+
+func TestSessionLogout(t *testing.T) {
+	c := setupHttpConfiguration(t)
+	ck := login(t, c)
+	s := sessions.get(ck.Value, time.Hour)
+	if s == nil {
+		t.Fatalf("expected session after login")
+	}
+	for _, page := range []string{"/index.html", "/mails.html"} {
+		r := httptest.NewRequest(http.MethodGet, page, nil)
+		r.AddCookie(ck)
+		w := httptest.NewRecorder()
+		c.handlerIndex(w, r)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), s.csrf) {
+			t.Errorf("expected %s with csrf token, got %d", page, w.Code)
+		}
+	}
+	// logout without csrf token is refused
+	if w := postForm(c, "/logout", url.Values{}, ck); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without csrf token, got %d", w.Code)
+	}
+	if w := postForm(c, "/logout", url.Values{csrfField: {s.csrf}}, ck); w.Code != http.StatusFound {
+		t.Errorf("expected redirect after logout, got %d", w.Code)
+	}
+	if sessions.get(ck.Value, time.Hour) != nil {
+		t.Errorf("expected session to be revoked")
+	}
+	// the revoked cookie is not accepted anymore
+	r := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+	r.AddCookie(ck)
+	if c.checkLoggedIn(httptest.NewRecorder(), r) != nil {
+		t.Errorf("expected revoked session to be refused")
+	}
+}
+
+func TestFlashPerSession(t *testing.T) {
+	c := setupHttpConfiguration(t)
+	ck, other := login(t, c), login(t, c)
+	s := sessions.get(ck.Value, time.Hour)
+	if w := postForm(c, "/scan", url.Values{"a": {"secret-account"}, csrfField: {s.csrf}}, ck); w.Code != http.StatusFound {
+		t.Fatalf("expected redirect after scan, got %d", w.Code)
+	}
+	index := func(ck *http.Cookie) string {
+		r := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		r.AddCookie(ck)
+		w := httptest.NewRecorder()
+		c.handlerIndex(w, r)
+		return w.Body.String()
+	}
+	if strings.Contains(index(other), "secret-account") {
+		t.Errorf("expected the message only in the session of the scan")
+	}
+	if !strings.Contains(index(ck), "secret-account") {
+		t.Errorf("expected the message on the next page of the session")
+	}
+	if strings.Contains(index(ck), "secret-account") {
+		t.Errorf("expected the message to be shown once")
+	}
+}
+
+func TestScanInBackground(t *testing.T) {
+	c := setupHttpConfiguration(t)
+	c.ImapAccounts = []*ImapConfiguration{{Name: "offline", Host: "127.0.0.1", Port: 1, TlsMode: tlsModeNone}}
+	ck := login(t, c)
+	s := sessions.get(ck.Value, time.Hour)
+	if w := postForm(c, "/scan", url.Values{csrfField: {s.csrf}}, ck); w.Code != http.StatusFound {
+		t.Fatalf("expected redirect after scan, got %d", w.Code)
+	}
+	for i := 0; s.isScanning(); i++ {
+		if i > 500 {
+			t.Fatalf("scan did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if text, kind := s.takeFlash(); kind != "danger" || !strings.HasPrefix(text, "offline: ") {
+		t.Errorf("expected the result of the scan, got %s %s", kind, text)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := sessions.create(&webUser{name: legacyUser, role: roleAdmin}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if sessions.get(s.id, time.Millisecond) != nil {
+		t.Errorf("expected expired session to be refused")
+	}
+}
+
+func TestCsrf(t *testing.T) {
+	c := setupHttpConfiguration(t)
+	ck := login(t, c)
+	for _, path := range []string{"/ham", "/spam", "/scan", "/logout"} {
+		r := httptest.NewRequest(http.MethodGet, path+"?m=1", nil)
+		r.AddCookie(ck)
+		w := httptest.NewRecorder()
+		c.handlerIndex(w, r)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected 405 for GET %s, got %d", path, w.Code)
+		}
+		w = postForm(c, path, url.Values{"m": {"1"}, csrfField: {"wrong"}}, ck)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403 for POST %s with wrong csrf token, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	c := setupHttpConfiguration(t)
+	for i := 0; i < maxLoginFailures; i++ {
+		if w := postForm(c, "/login", url.Values{"password": {"wrong"}}, nil); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for wrong password, got %d", w.Code)
+		}
+	}
+	w := postForm(c, "/login", url.Values{"password": {"password"}}, nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After after %d failed logins, got %d", maxLoginFailures, w.Code)
+	}
+	logins.succeeded("192.0.2.1")
+}
+
+func TestNewHttpServerTimeouts(t *testing.T) {
+	srv := newHttpServer(":0", http.NotFoundHandler())
+	if srv.ReadHeaderTimeout != httpReadHeaderTimeout || srv.IdleTimeout != httpIdleTimeout {
+		t.Errorf("expected header and idle timeouts, got %v and %v", srv.ReadHeaderTimeout, srv.IdleTimeout)
+	}
+}
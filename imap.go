@@ -15,8 +15,22 @@ import (
 
 func (ic *ImapConfiguration) connect() error {
 	s := fmt.Sprintf("%s:%d", ic.Host, ic.Port)
-	tlsConfig := tls.Config{InsecureSkipVerify: true}
-	c, err := client.DialTLS(s, &tlsConfig)
+	tlsConfig, err := ic.tlsConfig()
+	if err != nil {
+		return err
+	}
+	var c *client.Client
+	switch ic.TlsMode {
+	case tlsModeNone:
+		c, err = client.Dial(s)
+	case tlsModeStarttls:
+		c, err = client.Dial(s)
+		if err == nil {
+			err = startTls(c, tlsConfig)
+		}
+	default:
+		c, err = client.DialTLS(s, tlsConfig)
+	}
 	if err != nil {
 		return err
 	}
@@ -24,25 +38,55 @@ func (ic *ImapConfiguration) connect() error {
 	return nil
 }
 
-func (ic *ImapConfiguration) mailboxes() (chan *imap.MailboxInfo, error) {
+func startTls(c *client.Client, tlsConfig *tls.Config) error {
+	ok, err := c.SupportStartTLS()
+	if err == nil && !ok {
+		err = fmt.Errorf("server does not support STARTTLS")
+	}
+	if err == nil {
+		err = c.StartTLS(tlsConfig)
+	}
+	if err != nil {
+		_ = c.Terminate()
+	}
+	return err
+}
+
+// mailboxes returns all mailboxes. The list is read while the server sends it, so the buffer of the channel
+// does not limit the number of mailboxes.
+func (ic *ImapConfiguration) mailboxes() ([]*imap.MailboxInfo, error) {
 	mailboxList := make(chan *imap.MailboxInfo, 100)
 	done := make(chan error, 1)
 	go func() {
 		done <- ic.client.List("", "*", mailboxList)
 	}()
 
+	result := make([]*imap.MailboxInfo, 0)
+	for mb := range mailboxList {
+		result = append(result, mb)
+	}
 	if err := <-done; err != nil {
 		return nil, fmt.Errorf("error getting mailboxlist: %v", err)
 	}
-	return mailboxList, nil
+	return result, nil
 }
 
-func (ic *ImapConfiguration) login(key string) error {
-	pw, err := decrypt(ic.Password, key)
+// mailboxNames returns the sorted names of all mailboxes
+func (ic *ImapConfiguration) mailboxNames() ([]string, error) {
+	m, err := ic.mailboxes()
 	if err != nil {
-		return fmt.Errorf("error decrypting password for %s: %v", ic.Host, err)
+		return nil, err
 	}
-	if err := ic.client.Login(ic.Username, pw); err != nil {
+	names := make([]string, 0)
+	for _, mb := range m {
+		names = append(names, mb.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (ic *ImapConfiguration) login(key string) error {
+	if err := ic.authenticate(key); err != nil {
 		if err == client.ErrAlreadyLoggedIn {
 			log.Warnf("warning: already logged in")
 			return nil
@@ -112,6 +156,99 @@ func (ic *ImapConfiguration) fetchMessage(seqset *imap.SeqSet) (*imap.Message, e
 	return <-ch, nil
 }
 
+// fetchSizes returns the RFC822.SIZE of the messages ids
+func (ic *ImapConfiguration) fetchSizes(ids []uint32) (map[uint32]uint32, error) {
+	sizes := map[uint32]uint32{}
+	if len(ids) == 0 {
+		return sizes, nil
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(ids...)
+	msgs := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- ic.client.Fetch(seqset, []imap.FetchItem{imap.FetchRFC822Size}, msgs)
+	}()
+	for msg := range msgs {
+		sizes[msg.SeqNum] = msg.Size
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("error fetching message sizes: %v", err)
+	}
+	return sizes, nil
+}
+
+// fetchBatch fetches the messages ids with one FETCH and returns them in the order of ids.
+// Messages missing in the response are nil.
+func (ic *ImapConfiguration) fetchBatch(ids []uint32) ([]*imap.Message, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(ids...)
+	msgs, err := ic.fetchMessages(seqset)
+	if err != nil {
+		return nil, err
+	}
+	bySeqNum := map[uint32]*imap.Message{}
+	for _, msg := range msgs {
+		bySeqNum[msg.SeqNum] = msg
+	}
+	result := make([]*imap.Message, len(ids))
+	for i, id := range ids {
+		result[i] = bySeqNum[id]
+	}
+	return result, nil
+}
+
+// fetchTruncated fetches message id with only the first n bytes of the message (headers and the beginning of the body)
+func (ic *ImapConfiguration) fetchTruncated(id uint32, n int64) (*imap.Message, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(id)
+	log.Debugf("fetching first %d bytes of message %d", n, id)
+	section := imap.FetchItem(fmt.Sprintf("BODY.PEEK[]<0.%d>", n))
+	ch := make(chan *imap.Message, 1)
+	err := ic.client.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, section}, ch)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching message %v: %v", seqset, err)
+	}
+	msg := <-ch
+	if msg == nil {
+		return nil, fmt.Errorf("message %d not found", id)
+	}
+	return msg, nil
+}
+
+// isLarge reports if a message of the given size exceeds the maximum message size of the account
+func (ic *ImapConfiguration) isLarge(size uint32) bool {
+	return ic.maxMessageSize > 0 && int64(size) > ic.maxMessageSize
+}
+
+// isLargeId reports if message id exceeds maxMessageSize. A message without a known size is treated as large.
+func (ic *ImapConfiguration) isLargeId(sizes map[uint32]uint32, id uint32) bool {
+	size, ok := sizes[id]
+	return ic.isLarge(size) || (!ok && ic.maxMessageSize > 0)
+}
+
+// batches splits ids into chunks of at most batchSize messages and batchBytes bytes.
+// A message bigger than batchBytes gets a chunk of its own. Messages without a known size count as 0 bytes.
+func batches(ids []uint32, sizes map[uint32]uint32, batchSize int, batchBytes int64) [][]uint32 {
+	result := make([][]uint32, 0)
+	chunk := make([]uint32, 0)
+	var chunkBytes int64
+	for _, id := range ids {
+		size := int64(sizes[id])
+		if len(chunk) > 0 && (len(chunk) >= batchSize || (batchBytes > 0 && chunkBytes+size > batchBytes)) {
+			result = append(result, chunk)
+			chunk = make([]uint32, 0)
+			chunkBytes = 0
+		}
+		chunk = append(chunk, id)
+		chunkBytes += size
+	}
+	if len(chunk) > 0 {
+		result = append(result, chunk)
+	}
+	return result
+}
+
 func (ic *ImapConfiguration) fetchMessages(seqset *imap.SeqSet) ([]*imap.Message, error) {
 	log.Debugf("fetching messages %v", seqset)
 	msgs := make(chan *imap.Message, 10)
@@ -151,7 +288,7 @@ func (ic *ImapConfiguration) moveToSpam(id ...uint32) error {
 	for _, i := range id {
 		seqset.AddNum(i)
 	}
-	return ic.client.Move(seqset, ic.SpamFolder)
+	return ic.client.Move(seqset, ic.quarantineFolder())
 }
 
 func (ic *ImapConfiguration) deleteMessages(id ...uint32) error {
@@ -168,28 +305,13 @@ func (ic *ImapConfiguration) deleteMessages(id ...uint32) error {
 	return nil
 }
 
-func (ic *ImapConfiguration) markSpamInSubject(spamPrefix string, id uint32) error {
-	msgs, err := ic.fetchMessages(reverseSeqSet(id))
-	if err != nil {
-		return fmt.Errorf("error fetching mail: %v", err)
-	}
-	if len(msgs) != 1 {
-		return fmt.Errorf("expect 1 mail got %d", len(msgs))
-	}
-	dt := msgs[0].Envelope.Date
-	s, err := body(msgs[0])
-	if err != nil {
-		return fmt.Errorf("error getting mails body: %v", err)
-	}
+// markSpamInSubject replaces message id with a copy of msg with the spam prefix in the subject. s is the already fetched body of msg.
+func (ic *ImapConfiguration) markSpamInSubject(spamPrefix string, id uint32, msg *imap.Message, s string) error {
 	if strings.Contains(s, fmt.Sprintf("Subject: %s ", spamPrefix)) {
 		// has already the prefix. stopping here
 		return nil
 	}
-	err = ic.deleteMessages(id)
-	if err != nil {
-		return fmt.Errorf("error deleting message: %v", err)
-	}
-
+	original := s
 	if strings.Contains(s, "Subject: ") {
 		s = strings.Replace(s, "Subject: ", fmt.Sprintf("Subject: %s ", spamPrefix), 1)
 	} else {
@@ -197,42 +319,17 @@ func (ic *ImapConfiguration) markSpamInSubject(spamPrefix string, id uint32) err
 			s = strings.Replace(s, "Subject:\n", fmt.Sprintf("Subject: %s\n", spamPrefix), 1)
 		}
 	}
-
-	b := bytes.NewBufferString(s)
-	flags := []string{}
-	if ic.InboxBehaviour == behaviourEatspam {
-		flags = append(flags, eatspamSeenFlag)
-	}
-	err = ic.client.Append(ic.Inbox, flags, dt, b)
-	if err != nil {
-		return fmt.Errorf("error writing mail copy to server: %v", err)
-	}
-	return nil
+	return ic.replaceMessage(id, msg, original, s)
 }
 
 var regexpSpamHeader = regexp.MustCompile("(?m)^X-Spam-Flag: [NY][OE][S]*$")
 
-func (ic *ImapConfiguration) markSpamInHeader(spamScore float64, isSpam bool, id uint32) error {
-	msgs, err := ic.fetchMessages(reverseSeqSet(id))
-	if err != nil {
-		return fmt.Errorf("error fetching mail: %v", err)
-	}
-	if len(msgs) != 1 {
-		return fmt.Errorf("exprect 1 mail got %d", len(msgs))
-	}
-	dt := msgs[0].Envelope.Date
-	s, err := body(msgs[0])
-	if err != nil {
-		return fmt.Errorf("error getting mails body: %v", err)
-	}
+// markSpamInHeader replaces message id with a copy of msg with added spam headers. s is the already fetched body of msg.
+func (ic *ImapConfiguration) markSpamInHeader(spamScore float64, isSpam bool, id uint32, msg *imap.Message, s string) error {
 	if regexpSpamHeader.MatchString(s) {
 		// Remove previous spam-flag
 		regexpSpamHeader.ReplaceAllString(s, "")
 	}
-	err = ic.deleteMessages(id)
-	if err != nil {
-		return fmt.Errorf("error deleting message: %v", err)
-	}
 	var b bytes.Buffer
 	hd, err := header(isSpam, spamScore)
 	if err != nil {
@@ -247,19 +344,21 @@ func (ic *ImapConfiguration) markSpamInHeader(spamScore float64, isSpam bool, id
 		b.WriteString(fmt.Sprintf("X-Spam-Status: %s, score=%0.1f\r\n", yesNoCap(isSpam), spamScore))
 	*/
 	b.WriteString(s)
-	flags := []string{}
-	if ic.InboxBehaviour == behaviourEatspam {
-		flags = append(flags, eatspamSeenFlag)
-	}
-	err = ic.client.Append(ic.Inbox, flags, dt, &b)
-	if err != nil {
-		return fmt.Errorf("error writing mail copy to server: %v", err)
-	}
-	return nil
+	return ic.replaceMessage(id, msg, s, b.String())
 }
 
 const eatspamSeenFlag = "$EatspamSeen"
 
+// checkedFlags returns the flags of a mail which eatspam puts into the inbox. It is not checked again and with the
+// unseen behaviour it is marked as seen.
+func (ic *ImapConfiguration) checkedFlags() []string {
+	flags := []string{eatspamSeenFlag}
+	if ic.InboxBehaviour == behaviourUnseen {
+		flags = append(flags, imap.SeenFlag)
+	}
+	return flags
+}
+
 func (ic *ImapConfiguration) markAsEatspamSeen(id uint32) error {
 	item := imap.FormatFlagsOp(imap.AddFlags, true)
 	flags := []interface{}{eatspamSeenFlag}
@@ -285,6 +384,54 @@ func (ic *ImapConfiguration) getMessage(id uint32) (*imap.Message, string, error
 	return msg, s, nil
 }
 
+// restoreMessage puts the original message of qe back into the inbox and deletes the copy eatspam has moved or rewritten.
+// The restored message gets flagged as seen by eatspam, so it is not processed again.
+func (ic *ImapConfiguration) restoreMessage(key string, qe *QueueElement) error {
+	folder := ic.Inbox
+	switch qe.Action {
+	case spamActionReject:
+		folder = ic.quarantineFolder()
+	case spamActionAddHeader, spamActionRewriteSubject:
+	default:
+		return fmt.Errorf("nothing to restore for action %s", qe.Action)
+	}
+	if qe.MessageId == "" {
+		return fmt.Errorf("message has no Message-ID and cannot be found in %s", folder)
+	}
+	if qe.Truncated {
+		return fmt.Errorf("message was checked truncated, the original is not available")
+	}
+	err := ic.tryOpenSession(key)
+	if err != nil {
+		return err
+	}
+	defer ic.closeSession()
+	_, err = ic.client.Select(folder, false)
+	if err != nil {
+		return fmt.Errorf("error selecting %s: %v", folder, err)
+	}
+	ids, err := ic.searchMessageId(qe.MessageId)
+	if err != nil {
+		return fmt.Errorf("error searching message in %s: %v", folder, err)
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("message %s not found in %s", qe.MessageId, folder)
+	}
+	err = ic.client.Append(ic.Inbox, ic.checkedFlags(), qe.Time, bytes.NewBufferString(qe.Body))
+	if err != nil {
+		return fmt.Errorf("error writing original mail to server: %v", err)
+	}
+	return ic.deleteMessages(ids...)
+}
+
+// searchMessageId returns the messages with the Message-ID in the selected mailbox, which are not marked as deleted
+func (ic *ImapConfiguration) searchMessageId(messageId string) ([]uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", messageId)
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	return ic.client.Search(criteria)
+}
+
 func (ic *ImapConfiguration) searchMails() ([]uint32, error) {
 	switch ic.InboxBehaviour {
 	case behaviourUnseen:
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCertificate creates a self-signed certificate for 127.0.0.1 and localhost
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTestImapServer starts an in-memory IMAP server with TLS and returns an account for the server.
+// The server has the user "username" with password "password" and one message in the INBOX.
+func startTestImapServer(t *testing.T, key string) (*ImapConfiguration, *memory.Backend) {
+	return startTestImapServerMode(t, key, tlsModeImplicit)
+}
+
+// startTestImapServerMode starts an in-memory IMAP server for the given tls mode. The certificate of the server is pinned in the account.
+func startTestImapServerMode(t *testing.T, key string, mode string) (*ImapConfiguration, *memory.Backend) {
+	return startTestImapServerWith(t, key, mode, nil)
+}
+
+// startTestImapServerWith starts an in-memory IMAP server like startTestImapServerMode. setup can change the server before it starts.
+func startTestImapServerWith(t *testing.T, key string, mode string, setup func(s *server.Server, be *memory.Backend)) (*ImapConfiguration, *memory.Backend) {
+	be := memory.New()
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	if setup != nil {
+		setup(s, be)
+	}
+	cert := testCertificate(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	var l net.Listener
+	var err error
+	if mode == tlsModeImplicit {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+		if mode == tlsModeStarttls {
+			s.TLSConfig = tlsConfig
+		}
+	}
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	pw, err := encrypt("password", key)
+	if err != nil {
+		t.Fatalf("error encrypting password: %v", err)
+	}
+	ic := ImapConfiguration{
+		Name:           "test",
+		Username:       "username",
+		Password:       pw,
+		Host:           "127.0.0.1",
+		Port:           l.Addr().(*net.TCPAddr).Port,
+		Inbox:          defaultImapInbox,
+		SpamFolder:     defaultImapSpamFolder,
+		InboxBehaviour: defaultInboxBehaviour,
+		TlsMode:        mode,
+		TlsConfig: ImapTlsConfiguration{
+			Pin: fmt.Sprintf("%x", sha256.Sum256(cert.Certificate[0])),
+		},
+	}
+	if err := ic.resolveSecrets(key); err != nil {
+		t.Fatalf("error resolving secrets: %v", err)
+	}
+	return &ic, be
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// errSessionBusy is returned by tryOpenSession while the session is in use
+var errSessionBusy = errors.New("busy checking mails, try again later")
+
+// openSession locks the IMAP session of the account for a unit of work (a run, a restore, a web request) and makes
+// sure the connection is alive and authenticated. A broken connection is replaced by a new one. Every successful call
+// must be followed by closeSession, which keeps the connection open for the next user.
+func (ic *ImapConfiguration) openSession(key string) error {
+	ic.sessionMu.Lock()
+	return ic.connectSession(key)
+}
+
+// tryOpenSession is openSession for interactive requests like web pages and the api. It fails at once if the session
+// is in use, e.g. by a run, instead of waiting for it.
+func (ic *ImapConfiguration) tryOpenSession(key string) error {
+	if !ic.sessionMu.TryLock() {
+		return fmt.Errorf("account %s is %w", ic.Name, errSessionBusy)
+	}
+	return ic.connectSession(key)
+}
+
+// connectSession makes sure the locked session is connected and authenticated. It unlocks the session on errors.
+func (ic *ImapConfiguration) connectSession(key string) error {
+	if ic.client != nil {
+		if ic.client.State() != imap.LogoutState && ic.client.Noop() == nil {
+			return nil
+		}
+		log.Infof("imap connection of account %s is broken. Reconnecting", ic.Name)
+		ic.dropConnection()
+	}
+	err := ic.connect()
+	if err != nil {
+		ic.sessionMu.Unlock()
+		return fmt.Errorf("imap connect to %s for account %s failed: %v", ic.Host, ic.Name, err)
+	}
+	err = ic.login(key)
+	if err != nil {
+		ic.dropConnection()
+		ic.sessionMu.Unlock()
+		return err
+	}
+	log.Debugf("opened imap session for account %s", ic.Name)
+	return nil
+}
+
+// closeSession releases the session locked by openSession
+func (ic *ImapConfiguration) closeSession() {
+	ic.sessionMu.Unlock()
+}
+
+// dropConnection closes the connection without logging out
+func (ic *ImapConfiguration) dropConnection() {
+	if ic.client != nil {
+		_ = ic.client.Terminate()
+		ic.client = nil
+	}
+}
+
+// logoutSession waits for the current user of the session and logs out
+func (ic *ImapConfiguration) logoutSession() {
+	ic.sessionMu.Lock()
+	defer ic.sessionMu.Unlock()
+	if ic.client != nil {
+		if ic.client.State() != imap.LogoutState {
+			ic.logout()
+		}
+		ic.client = nil
+	}
+}
+
+// keepalive sends a NOOP on the idle sessions of the account. Busy sessions are skipped.
+func (ic *ImapConfiguration) keepalive() {
+	if !ic.sessionMu.TryLock() {
+		return
+	}
+	defer ic.sessionMu.Unlock()
+	if ic.client == nil {
+		return
+	}
+	if err := ic.client.Noop(); err != nil {
+		log.Infof("imap connection of account %s is broken: %v", ic.Name, err)
+		ic.dropConnection()
+	}
+}
+
+// startKeepalive keeps the idle IMAP sessions of all accounts alive
+func (conf *Configuration) startKeepalive() {
+	d, err := time.ParseDuration(conf.Keepalive)
+	if err != nil || d <= 0 {
+		log.Warnf("illegal keepalive '%s'. Use %s instead", conf.Keepalive, defaultKeepalive)
+		d, _ = time.ParseDuration(defaultKeepalive)
+	}
+	go func() {
+		for range time.Tick(d) {
+			conf.confMu.RLock()
+			accounts := conf.ImapAccounts
+			conf.confMu.RUnlock()
+			for _, ic := range accounts {
+				ic.keepalive()
+			}
+		}
+	}()
+}
+
+// logoutSessions logs out the IMAP sessions of all accounts
+func (conf *Configuration) logoutSessions() {
+	for _, ic := range conf.ImapAccounts {
+		ic.logoutSession()
+	}
+}
+
+// testConnection connects and logs in with a new connection and returns the names of the mailboxes. It is used to test
+// an account before it is saved.
+func (ic *ImapConfiguration) testConnection(key string) ([]string, error) {
+	err := ic.connect()
+	if err != nil {
+		return nil, fmt.Errorf("imap connect to %s failed: %v", ic.Host, err)
+	}
+	defer ic.dropConnection()
+	err = ic.login(key)
+	if err != nil {
+		return nil, err
+	}
+	names, err := ic.mailboxNames()
+	ic.logout()
+	return names, err
+}
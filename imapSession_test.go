@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSessionReuse(t *testing.T) {
+	key := generateKey()
+	ic, _ := startTestImapServer(t, key)
+	if err := ic.openSession(key); err != nil {
+		t.Fatalf("error opening session: %v", err)
+	}
+	c := ic.client
+	ic.closeSession()
+	if err := ic.openSession(key); err != nil {
+		t.Fatalf("error opening session again: %v", err)
+	}
+	if ic.client != c {
+		t.Errorf("expected the connection to be reused")
+	}
+	// break the connection, the next session has to reconnect
+	_ = ic.client.Terminate()
+	ic.closeSession()
+	if err := ic.openSession(key); err != nil {
+		t.Fatalf("error reopening session: %v", err)
+	}
+	if ic.client == c {
+		t.Errorf("expected a new connection")
+	}
+	ic.closeSession()
+	ic.logoutSession()
+	if ic.client != nil {
+		t.Errorf("expected no connection after logout")
+	}
+}
+
+func TestSessionWrongPassword(t *testing.T) {
+	key := generateKey()
+	ic, _ := startTestImapServer(t, key)
+	ic.Password, _ = encrypt("wrong", key)
+	ic.resolveSecrets(key)
+	if err := ic.openSession(key); err == nil {
+		t.Fatalf("expected login to fail")
+	}
+	if ic.client != nil {
+		t.Errorf("expected no connection after failed login")
+	}
+	// the session must not stay locked
+	if !ic.sessionMu.TryLock() {
+		t.Errorf("expected session to be unlocked")
+	}
+}
+
+func TestTryOpenSessionBusy(t *testing.T) {
+	key := generateKey()
+	ic, _ := startTestImapServer(t, key)
+	if err := ic.openSession(key); err != nil {
+		t.Fatalf("error opening session: %v", err)
+	}
+	if err := ic.tryOpenSession(key); !errors.Is(err, errSessionBusy) {
+		t.Errorf("expected busy session, got %v", err)
+	}
+	ic.closeSession()
+	if err := ic.tryOpenSession(key); err != nil {
+		t.Fatalf("error opening idle session: %v", err)
+	}
+	ic.closeSession()
+	ic.logoutSession()
+}
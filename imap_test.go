@@ -87,7 +87,7 @@ func TestMove(t *testing.T) {
 				log.Fatal(err)
 			}
 			log.Println("Mailboxes:")
-			for m := range mailboxList {
+			for _, m := range mailboxList {
 				log.Println(m.Name)
 			}
 		}
@@ -151,7 +151,11 @@ func TestMarkSubject(t *testing.T) {
 	if mbox.Messages == 0 {
 		t.Error("no messages in mbox")
 	}
-	err = ic.markSpamInSubject(c.SpamPrefix, mbox.Messages)
+	msg, s, err := ic.getMessage(mbox.Messages)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	err = ic.markSpamInSubject(c.SpamPrefix, mbox.Messages, msg, s)
 	if err != nil {
 		t.Errorf("error mark message: %v", err)
 	}
@@ -182,7 +186,11 @@ func TestMarkHeader(t *testing.T) {
 	if mbox.Messages == 0 {
 		t.Error("no messages in mbox")
 	}
-	err = ic.markSpamInHeader(6.0, true, mbox.Messages)
+	msg, s, err := ic.getMessage(mbox.Messages)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	err = ic.markSpamInHeader(6.0, true, mbox.Messages, msg, s)
 	if err != nil {
 		t.Errorf("error mark message: %v", err)
 	}
@@ -311,6 +319,64 @@ func TestDumpFlags(t *testing.T) {
 	}
 }
 
+func TestBatches(t *testing.T) {
+	ids := []uint32{9, 8, 7, 6, 5, 4}
+	sizes := map[uint32]uint32{9: 100, 8: 100, 7: 900, 6: 2000, 5: 100, 4: 100}
+	result := batches(ids, sizes, 3, 1000)
+	expected := [][]uint32{{9, 8}, {7}, {6}, {5, 4}}
+	if fmt.Sprint(result) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+	result = batches(ids, nil, 4, 1000)
+	expected = [][]uint32{{9, 8, 7, 6}, {5, 4}}
+	if fmt.Sprint(result) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+	if len(batches([]uint32{}, nil, 4, 0)) != 0 {
+		t.Errorf("expected no batches for no ids")
+	}
+}
+
+func TestManyMailboxes(t *testing.T) {
+	key := generateKey()
+	ic, be := startTestImapServer(t, key)
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 150; i++ {
+		if err := u.CreateMailbox(fmt.Sprintf("Folder%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ic.openSession(key); err != nil {
+		t.Fatal(err)
+	}
+	defer ic.logoutSession()
+	defer ic.closeSession()
+	names, err := ic.mailboxNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 151 {
+		t.Errorf("expected 151 mailboxes, got %d", len(names))
+	}
+}
+
+func TestIsLargeId(t *testing.T) {
+	sizes := map[uint32]uint32{1: 100, 2: 2000}
+	ic := &ImapConfiguration{}
+	if ic.isLargeId(sizes, 2) || ic.isLargeId(sizes, 3) {
+		t.Errorf("expected no large messages without maxMessageSize")
+	}
+	ic.maxMessageSize = 1000
+	for id, expected := range map[uint32]bool{1: false, 2: true, 3: true} {
+		if ic.isLargeId(sizes, id) != expected {
+			t.Errorf("expected large %v for message %d", expected, id)
+		}
+	}
+}
+
 func TestReplace(t *testing.T) {
 	mail1 := `
 Subject: bla
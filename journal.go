@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journalHeader is added to the modified copy with the token of its journal entry
+const journalHeader = "X-Eatspam-Journal"
+
+// journalEntry keeps the original of a mail while it is replaced by a modified copy. It is written before the copy is
+// appended and removed after the original is deleted. Entries left by a crash are recovered on the next start.
+type journalEntry struct {
+	Account     string    `json:"account"`
+	Mailbox     string    `json:"mailbox"`
+	MessageId   string    `json:"messageId"`
+	Uid         uint32    `json:"uid"`
+	UidValidity uint32    `json:"uidValidity"`
+	Token       string    `json:"token"`
+	Date        time.Time `json:"date"`
+	Flags       []string  `json:"flags"`
+	Original    string    `json:"original"`
+	file        string
+}
+
+// writeJournal saves the original s of msg with its uid in the journal folder of the account. Without a journal
+// folder nothing is written.
+func (ic *ImapConfiguration) writeJournal(msg *imap.Message, s string, uid, uidValidity uint32) (*journalEntry, error) {
+	j := journalEntry{
+		Account:     ic.Name,
+		Mailbox:     ic.Inbox,
+		MessageId:   msg.Envelope.MessageId,
+		Uid:         uid,
+		UidValidity: uidValidity,
+		Token:       randomToken(),
+		Date:        msg.Envelope.Date,
+		Original:    s,
+	}
+	for _, f := range msg.Flags {
+		if f != imap.RecentFlag {
+			j.Flags = append(j.Flags, f)
+		}
+	}
+	if ic.journalDir == "" {
+		return &j, nil
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(ic.journalDir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(ic.journalDir, "rewrite-*.json")
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+	j.file = f.Name()
+	return &j, nil
+}
+
+// remove deletes the finished entry from the journal
+func (j *journalEntry) remove() {
+	if j.file == "" {
+		return
+	}
+	if err := os.Remove(j.file); err != nil {
+		log.Errorf("error removing journal entry %s: %v", j.file, err)
+	}
+}
+
+func readJournal(file string) (*journalEntry, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	j := journalEntry{}
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, err
+	}
+	j.file = file
+	return &j, nil
+}
+
+// replaceMessage replaces message id in the inbox with the modified copy s of msg. The copy is appended with the
+// journal token in the X-Eatspam-Journal header and verified by it before the original is deleted, so a failure leaves
+// the original in place.
+func (ic *ImapConfiguration) replaceMessage(id uint32, msg *imap.Message, original string, s string) error {
+	uid, err := ic.fetchUid(id)
+	if err != nil {
+		return err
+	}
+	j, err := ic.writeJournal(msg, original, uid, ic.client.Mailbox().UidValidity)
+	if err != nil {
+		return fmt.Errorf("error writing journal: %v", err)
+	}
+	flags := []string{}
+	if ic.InboxBehaviour == behaviourEatspam {
+		flags = append(flags, eatspamSeenFlag)
+	}
+	s = journalHeader + ": " + j.Token + "\r\n" + s
+	err = ic.client.Append(ic.Inbox, flags, msg.Envelope.Date, bytes.NewBufferString(s))
+	if err != nil {
+		j.remove()
+		return fmt.Errorf("error writing mail copy to server: %v", err)
+	}
+	copies, err := ic.searchJournalCopies(j.Token)
+	if err != nil {
+		copies, err = ic.searchJournalCopies(j.Token)
+	}
+	if err != nil {
+		if rerr := ic.recoverEntry(j); rerr != nil {
+			// the journal is kept, the next start completes the replacement
+			return fmt.Errorf("error verifying mail copy: %v. Recovering failed: %v", err, rerr)
+		}
+		j.remove()
+		return fmt.Errorf("error verifying mail copy, recovered the mail: %v", err)
+	}
+	if len(copies) == 0 {
+		j.remove()
+		return fmt.Errorf("mail copy not found in %s after writing it, keeping the original", ic.Inbox)
+	}
+	err = ic.deleteMessages(id)
+	if err != nil {
+		return fmt.Errorf("error deleting message: %v", err)
+	}
+	j.remove()
+	return nil
+}
+
+// fetchUid returns the uid of message id in the selected mailbox
+func (ic *ImapConfiguration) fetchUid(id uint32) (uint32, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(id)
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- ic.client.Fetch(seqset, []imap.FetchItem{imap.FetchUid}, messages)
+	}()
+	var uid uint32
+	for msg := range messages {
+		uid = msg.Uid
+	}
+	if err := <-done; err != nil {
+		return 0, fmt.Errorf("error fetching uid of message %d: %v", id, err)
+	}
+	if uid == 0 {
+		return 0, fmt.Errorf("error fetching uid of message %d: not found", id)
+	}
+	return uid, nil
+}
+
+// searchJournalCopies returns the messages in the selected mailbox with the journal token
+func (ic *ImapConfiguration) searchJournalCopies(token string) ([]uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add(journalHeader, token)
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	ids, err := ic.client.Search(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("error searching the mail copy: %v", err)
+	}
+	return ids, nil
+}
+
+// searchJournalOriginal returns the original of the journal entry in the selected mailbox by its uid
+func (ic *ImapConfiguration) searchJournalOriginal(j *journalEntry) ([]uint32, error) {
+	if mbox := ic.client.Mailbox(); mbox == nil || mbox.UidValidity != j.UidValidity {
+		return nil, fmt.Errorf("the UIDVALIDITY of %s changed. Restore the mail manually if it is missing", j.Mailbox)
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddNum(j.Uid)
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	ids, err := ic.client.Search(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("error searching the original mail: %v", err)
+	}
+	return ids, nil
+}
+
+// recoverJournal completes or rolls back the replacements left in the journal by a crash. Entries which can't be
+// recovered are kept.
+func (conf *Configuration) recoverJournal() {
+	if conf.JournalDir == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(conf.JournalDir, "rewrite-*.json"))
+	if err != nil {
+		log.Errorf("error reading journal %s: %v", conf.JournalDir, err)
+		return
+	}
+	for _, file := range files {
+		j, err := readJournal(file)
+		if err != nil {
+			log.Errorf("error reading journal entry %s: %v", file, err)
+			continue
+		}
+		ic := conf.accountByName(j.Account)
+		if ic == nil {
+			log.Warnf("journal entry %s belongs to the unknown account %s, keeping it", file, j.Account)
+			continue
+		}
+		if err := ic.recover(conf.key, j); err != nil {
+			log.Errorf("error recovering journal entry %s, keeping it: %v", file, err)
+			continue
+		}
+		j.remove()
+	}
+}
+
+// recover looks for the original and the modified copy of the journal entry. If both exist the original is deleted,
+// if none exists the original is restored.
+func (ic *ImapConfiguration) recover(key string, j *journalEntry) error {
+	err := ic.openSession(key)
+	if err != nil {
+		return err
+	}
+	defer ic.closeSession()
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if _, err := ic.client.Select(j.Mailbox, false); err != nil {
+		return fmt.Errorf("error selecting %s: %v", j.Mailbox, err)
+	}
+	return ic.recoverEntry(j)
+}
+
+// recoverEntry recovers the journal entry in its selected mailbox like recover. The original is found by its uid, the
+// copy by the journal token.
+func (ic *ImapConfiguration) recoverEntry(j *journalEntry) error {
+	if j.Token == "" || j.Uid == 0 {
+		return fmt.Errorf("the journal entry has no token. Restore the mail manually if it is missing")
+	}
+	originals, err := ic.searchJournalOriginal(j)
+	if err != nil {
+		return err
+	}
+	copies, err := ic.searchJournalCopies(j.Token)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(originals) > 0 && len(copies) > 0:
+		log.Infof("completing the rewrite of %s in account %s, deleting the original", j.MessageId, ic.Name)
+		return ic.deleteMessages(originals...)
+	case len(originals) > 0:
+		log.Infof("mail %s in account %s was not rewritten, it is checked again", j.MessageId, ic.Name)
+		return nil
+	case len(copies) > 0:
+		return nil
+	}
+	log.Warnf("mail %s in account %s is missing, restoring the original from the journal", j.MessageId, ic.Name)
+	err = ic.client.Append(j.Mailbox, j.Flags, j.Date, bytes.NewBufferString(j.Original))
+	if err != nil {
+		return fmt.Errorf("error restoring mail: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const journalMail = "Message-ID: <journal@example.com>\r\nFrom: sender@example.com\r\nTo: rcpt@example.com\r\nSubject: win\r\n\r\nHello\r\n"
+
+// setupJournalAccount starts a test server with journalMail as last message of the INBOX and selects the INBOX
+func setupJournalAccount(t *testing.T) (*ImapConfiguration, *memory.Backend, string) {
+	key := generateKey()
+	ic, be := startTestImapServer(t, key)
+	ic.journalDir = filepath.Join(t.TempDir(), "journal")
+	addTestMessage(t, be, journalMail)
+	if err := ic.openSession(key); err != nil {
+		t.Fatalf("error opening session: %v", err)
+	}
+	if _, err := ic.client.Select(ic.Inbox, false); err != nil {
+		t.Fatalf("error selecting inbox: %v", err)
+	}
+	t.Cleanup(func() {
+		ic.closeSession()
+		ic.logoutSession()
+	})
+	return ic, be, key
+}
+
+// inboxBodies returns the bodies of the messages in the INBOX with the Message-ID of journalMail
+func inboxBodies(t *testing.T, ic *ImapConfiguration) []string {
+	if _, err := ic.client.Select(ic.Inbox, false); err != nil {
+		t.Fatalf("error selecting inbox: %v", err)
+	}
+	ids, err := ic.searchMessageId("<journal@example.com>")
+	if err != nil {
+		t.Fatalf("error searching: %v", err)
+	}
+	bodies := make([]string, 0)
+	if len(ids) == 0 {
+		return bodies
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(ids...)
+	msgs, err := ic.fetchMessages(seqset)
+	if err != nil {
+		t.Fatalf("error fetching: %v", err)
+	}
+	for _, msg := range msgs {
+		s, _ := body(msg)
+		bodies = append(bodies, s)
+	}
+	return bodies
+}
+
+func journalFiles(t *testing.T, ic *ImapConfiguration) []string {
+	files, err := filepath.Glob(filepath.Join(ic.journalDir, "rewrite-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestReplaceMessage(t *testing.T) {
+	ic, _, _ := setupJournalAccount(t)
+	id := ic.client.Mailbox().Messages
+	msg, s, err := ic.getMessage(id)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	if err := ic.markSpamInSubject(defaultSpamMark, id, msg, s); err != nil {
+		t.Fatalf("error rewriting subject: %v", err)
+	}
+	bodies := inboxBodies(t, ic)
+	if len(bodies) != 1 || !strings.Contains(bodies[0], "Subject: "+defaultSpamMark+" win") {
+		t.Errorf("expected only the rewritten copy, got %q", bodies)
+	}
+	if files := journalFiles(t, ic); len(files) != 0 {
+		t.Errorf("expected empty journal, got %v", files)
+	}
+}
+
+func TestReplaceMessageWithoutMessageId(t *testing.T) {
+	ic, be, _ := setupJournalAccount(t)
+	addTestMessage(t, be, "From: sender@example.com\r\nTo: rcpt@example.com\r\nSubject: no id\r\n\r\nHello\r\n")
+	if _, err := ic.client.Select(ic.Inbox, false); err != nil {
+		t.Fatalf("error selecting inbox: %v", err)
+	}
+	count := ic.client.Mailbox().Messages
+	msg, s, err := ic.getMessage(count)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	if err := ic.markSpamInSubject(defaultSpamMark, count, msg, s); err != nil {
+		t.Fatalf("error rewriting subject: %v", err)
+	}
+	if _, err := ic.client.Select(ic.Inbox, false); err != nil {
+		t.Fatalf("error selecting inbox: %v", err)
+	}
+	if n := ic.client.Mailbox().Messages; n != count {
+		t.Errorf("expected %d messages after the replacement, got %d", count, n)
+	}
+	msg, s, err = ic.getMessage(count)
+	if err != nil || !strings.Contains(s, "Subject: "+defaultSpamMark+" no id") {
+		t.Errorf("expected the rewritten copy as last message, got %q (%v)", s, err)
+	}
+}
+
+func TestReplaceMessageAppendFails(t *testing.T) {
+	ic, _, _ := setupJournalAccount(t)
+	id := ic.client.Mailbox().Messages
+	msg, s, err := ic.getMessage(id)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	inbox := ic.Inbox
+	ic.Inbox = "missing"
+	err = ic.markSpamInHeader(7, true, id, msg, s)
+	ic.Inbox = inbox
+	if err == nil {
+		t.Fatalf("expected error appending to a missing mailbox")
+	}
+	bodies := inboxBodies(t, ic)
+	if len(bodies) != 1 || bodies[0] != journalMail {
+		t.Errorf("expected the unchanged original, got %q", bodies)
+	}
+	if files := journalFiles(t, ic); len(files) != 0 {
+		t.Errorf("expected empty journal, got %v", files)
+	}
+}
+
+func TestRecoverJournal(t *testing.T) {
+	copyMail := "X-Spam-Flag: YES\r\n" + journalMail
+	tests := []struct {
+		name     string
+		prepare  func(t *testing.T, ic *ImapConfiguration, be *memory.Backend, id uint32, j *journalEntry)
+		expected []string
+	}{
+		{"crash after append", func(t *testing.T, ic *ImapConfiguration, be *memory.Backend, id uint32, j *journalEntry) {
+			addTestMessage(t, be, journalHeader+": "+j.Token+"\r\n"+copyMail)
+		}, []string{journalHeader + ": <token>\r\n" + copyMail}},
+		{"crash before append", func(t *testing.T, ic *ImapConfiguration, be *memory.Backend, id uint32, j *journalEntry) {
+		}, []string{journalMail}},
+		{"copy of another rewrite", func(t *testing.T, ic *ImapConfiguration, be *memory.Backend, id uint32, j *journalEntry) {
+			addTestMessage(t, be, journalHeader+": other\r\n"+copyMail)
+		}, []string{journalMail, journalHeader + ": other\r\n" + copyMail}},
+		{"lost mail", func(t *testing.T, ic *ImapConfiguration, be *memory.Backend, id uint32, j *journalEntry) {
+			if err := ic.deleteMessages(id); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{journalMail}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ic, be, key := setupJournalAccount(t)
+			id := ic.client.Mailbox().Messages
+			msg, s, err := ic.getMessage(id)
+			if err != nil {
+				t.Fatalf("error fetching message: %v", err)
+			}
+			uid, err := ic.fetchUid(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			j, err := ic.writeJournal(msg, s, uid, ic.client.Mailbox().UidValidity)
+			if err != nil {
+				t.Fatalf("error writing journal: %v", err)
+			}
+			test.prepare(t, ic, be, id, j)
+			ic.closeSession()
+
+			c := setupTestConfiguration()
+			c.key = key
+			c.JournalDir = ic.journalDir
+			c.ImapAccounts = []*ImapConfiguration{ic}
+			c.recoverJournal()
+
+			if err := ic.openSession(key); err != nil {
+				t.Fatalf("error opening session: %v", err)
+			}
+			bodies := strings.ReplaceAll(strings.Join(inboxBodies(t, ic), "|"), j.Token, "<token>")
+			if bodies != strings.Join(test.expected, "|") {
+				t.Errorf("expected %q, got %q", test.expected, bodies)
+			}
+			if files := journalFiles(t, ic); len(files) != 0 {
+				t.Errorf("expected empty journal, got %v", files)
+			}
+		})
+	}
+}
+
+func TestRecoverJournalWithoutMessageId(t *testing.T) {
+	ic, be, key := setupJournalAccount(t)
+	noId := "From: sender@example.com\r\nTo: rcpt@example.com\r\nSubject: no id\r\n\r\nHello\r\n"
+	addTestMessage(t, be, noId)
+	if _, err := ic.client.Select(ic.Inbox, false); err != nil {
+		t.Fatalf("error selecting inbox: %v", err)
+	}
+	count := ic.client.Mailbox().Messages
+	msg, s, err := ic.getMessage(count)
+	if err != nil {
+		t.Fatalf("error fetching message: %v", err)
+	}
+	uid, err := ic.fetchUid(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := ic.writeJournal(msg, s, uid, ic.client.Mailbox().UidValidity)
+	if err != nil {
+		t.Fatalf("error writing journal: %v", err)
+	}
+	copyMail := journalHeader + ": " + j.Token + "\r\nX-Spam-Flag: YES\r\n" + noId
+	addTestMessage(t, be, copyMail)
+	ic.closeSession()
+
+	c := setupTestConfiguration()
+	c.key = key
+	c.JournalDir = ic.journalDir
+	c.ImapAccounts = []*ImapConfiguration{ic}
+	c.recoverJournal()
+
+	if err := ic.openSession(key); err != nil {
+		t.Fatalf("error opening session: %v", err)
+	}
+	if _, err := ic.client.Select(ic.Inbox, false); err != nil {
+		t.Fatalf("error selecting inbox: %v", err)
+	}
+	if n := ic.client.Mailbox().Messages; n != count {
+		t.Errorf("expected %d messages after the recovery, got %d", count, n)
+	}
+	if _, s, err := ic.getMessage(count); err != nil || s != copyMail {
+		t.Errorf("expected the copy as last message, got %q (%v)", s, err)
+	}
+	if files := journalFiles(t, ic); len(files) != 0 {
+		t.Errorf("expected empty journal, got %v", files)
+	}
+}
+
+func TestRecoverJournalUnknownAccount(t *testing.T) {
+	dir := t.TempDir()
+	ic := &ImapConfiguration{Name: "gone", Inbox: defaultImapInbox, journalDir: dir}
+	msg := &imap.Message{Envelope: &imap.Envelope{MessageId: "<journal@example.com>"}}
+	j, err := ic.writeJournal(msg, journalMail, 1, 1)
+	if err != nil {
+		t.Fatalf("error writing journal: %v", err)
+	}
+	c := setupTestConfiguration()
+	c.JournalDir = dir
+	c.recoverJournal()
+	if _, err := os.Stat(j.file); err != nil {
+		t.Errorf("expected the journal entry of an unknown account to be kept: %v", err)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/go-co-op/gocron"
 	log "github.com/sirupsen/logrus"
@@ -16,6 +18,49 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if c, ok := commands[os.Args[1]]; ok {
+			os.Exit(c.run(os.Args[2:]))
+		}
+		if os.Args[1] == "help" {
+			printUsage()
+			os.Exit(0)
+		}
+	}
+	flag.Usage = printUsage
+	cli = parseFlags()
+	if cli.checkConfig {
+		os.Exit(runCheckConfig(stringConfig("configFile", cli.ConfigFile, "CONFIG_FILE", "")))
+	}
+	conf := load()
+	if conf.encrypt != "" {
+		s, err := encrypt(conf.encrypt, conf.key)
+		if err != nil {
+			log.Fatalf("error encrypting string: %v", err)
+		}
+		fmt.Println(s)
+		os.Exit(0)
+	}
+	if conf.hashPassword != "" {
+		s, err := hashPassword(conf.hashPassword)
+		if err != nil {
+			log.Fatalf("error hashing password: %v", err)
+		}
+		fmt.Println(s)
+		os.Exit(0)
+	}
+	if conf.rotate {
+		err := conf.rotateKey()
+		if err != nil {
+			log.Fatalf("error rotating key: %v", err)
+		}
+		os.Exit(0)
+	}
+	conf.start()
+}
+
+// load reads the configuration and the key. A missing key file is created. Errors stop eatspam.
+func load() *Configuration {
 	conf, err := New()
 	if err != nil {
 		log.Fatal(err)
@@ -28,22 +73,25 @@ func main() {
 		if err != nil {
 			log.Fatalf("error writing key file: %v", err)
 		}
-		log.Info("New key was created. To encrypt password use `eatspam --encrypt <password>`")
+		log.Info("New key was created. To encrypt password use `eatspam encrypt <password>`")
 	}
-	conf.key = string(b)
-	if conf.encrypt != "" {
-		s, err := encrypt(conf.encrypt, conf.key)
-		if err != nil {
-			log.Fatalf("error encrypting string: %v", err)
-		}
-		fmt.Println(s)
-		os.Exit(0)
+	conf.key = strings.TrimSpace(string(b))
+	if _, err := parseKey(conf.key); err != nil {
+		log.Fatalf("error reading key file %s: %v", conf.KeyFile, err)
+	}
+	return conf
+}
+
+// start runs eatspam in daemon mode or checks all accounts once
+func (conf *Configuration) start() {
+	err := conf.resolveSecrets()
+	if err != nil {
+		log.Fatal(err)
 	}
 	log.Infof("eatspam v%s", conf.Version)
-	d, _ := time.ParseDuration(conf.Interval)
 	if conf.Daemon {
 		log.Info("Start eatspam in daemon mode")
-		log.Infof("Interval is %0.2f seconds", d.Seconds())
+		log.Infof("Interval is %s", conf.Interval)
 	} else {
 		log.Info("Start eatspam in one time mode")
 	}
@@ -54,12 +102,19 @@ func main() {
 	if conf.Rspamd.Use {
 		log.Infof("use rspamd at '%s' with port %d", conf.Rspamd.Host, conf.Rspamd.Port)
 	}
+	conf.recoverJournal()
 	if conf.Daemon {
 		conf.initMetrics()
+		conf.startKeepalive()
 		conf.startCron()
-		conf.startHttpListener()
+		conf.startConfigWatcher()
+		servers := conf.startHttpListener()
+		<-conf.stopOnSignal()
+		conf.shutdown(servers...)
 	} else {
+		conf.stopOnSignal()
 		err := conf.spamChecker()
+		conf.logoutSessions()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -67,49 +122,43 @@ func main() {
 }
 
 func (conf *Configuration) startCron() {
-	s := gocron.NewScheduler(time.UTC)
-	frequency := conf.Interval
-	value, unit, err := parseFrequency(frequency)
-	if err != nil {
-		log.Errorf("error starting sync cron job: %v", err)
-		log.Infof("Start sync job every %d %s", 1, "days")
-		_, err = s.Every(1).Days().Do(conf.cron)
-	} else {
-		switch unit {
-		case "s":
-			log.Infof("Start sync job every %d %s", value, "seconds")
-			_, err = s.Every(value).Seconds().Do(conf.cron)
-		case "m":
-			log.Infof("Start sync job every %d %s", value, "minutes")
-			_, err = s.Every(value).Minutes().Do(conf.cron)
-		case "h":
-			log.Infof("Start sync job every %d %s", value, "hours")
-			_, err = s.Every(value).Hours().Do(conf.cron)
-		case "d":
-			log.Infof("Start sync job every %d %s", value, "days")
-			_, err = s.Every(value).Days().Do(conf.cron)
-		}
-	}
+	conf.scheduler = gocron.NewScheduler(time.Local)
+	err := conf.scheduleCron()
 	if err != nil {
 		log.Fatalf("error creating cronjob: %v", err)
 	}
-	s.StartAsync()
+	conf.scheduler.StartAsync()
 }
 
 func (conf *Configuration) cron() {
-	if conf.cronActive {
+	if _, ok := conf.runScan(conf.scheduledAccounts()...); !ok {
 		log.Info("spamchecker still working. Stopping here.")
-		return
 	}
-	conf.cronActive = true
-	defer func() {
-		conf.cronActive = false
-	}()
+}
 
-	err := conf.spamChecker()
-	if err != nil {
-		log.Errorf("error checking spam: %v", err)
+// runScan checks the given accounts and returns the results of the run.
+// It returns false without checking if another run is still active or eatspam is shutting down.
+func (conf *Configuration) runScan(accounts ...*ImapConfiguration) ([]*RunResult, bool) {
+	if conf.stopping() || !conf.cronMu.TryLock() {
+		return nil, false
+	}
+	defer conf.cronMu.Unlock()
+
+	return conf.checkAccounts(accounts...), true
+}
+
+// startScan checks the given accounts in the background and calls done with the results of the run.
+// It returns false without checking if another run is still active or eatspam is shutting down.
+func (conf *Configuration) startScan(done func([]*RunResult), accounts ...*ImapConfiguration) bool {
+	if conf.stopping() || !conf.cronMu.TryLock() {
+		return false
 	}
+	go func() {
+		results := conf.checkAccounts(accounts...)
+		conf.cronMu.Unlock()
+		done(results)
+	}()
+	return true
 }
 
 func parseFrequency(f string) (int, string, error) {
@@ -134,10 +183,28 @@ func generateKey() string {
 	return hex.EncodeToString(bytes) //encode key in bytes to string for savin
 }
 
+var (
+	errInvalidKey          = errors.New("invalid key, expected 64 hex characters (AES-256)")
+	errMalformedCiphertext = errors.New("malformed encrypted value")
+	errDecryptionFailed    = errors.New("decryption failed, wrong key or tampered value")
+)
+
+// parseKey decodes the hex encoded key and checks its length
+func parseKey(keyString string) ([]byte, error) {
+	key, err := hex.DecodeString(keyString)
+	if err != nil || len(key) != 32 {
+		return nil, errInvalidKey
+	}
+	return key, nil
+}
+
 func encrypt(stringToEncrypt string, keyString string) (string, error) {
 
 	//Since the key is in string, we need to convert decode it to bytes
-	key, _ := hex.DecodeString(keyString)
+	key, err := parseKey(keyString)
+	if err != nil {
+		return "", err
+	}
 	plaintext := []byte(stringToEncrypt)
 
 	//Create a new Cipher Block from the key
@@ -167,8 +234,14 @@ func encrypt(stringToEncrypt string, keyString string) (string, error) {
 
 func decrypt(encryptedString string, keyString string) (string, error) {
 
-	key, _ := hex.DecodeString(keyString)
-	enc, _ := hex.DecodeString(encryptedString)
+	key, err := parseKey(keyString)
+	if err != nil {
+		return "", err
+	}
+	enc, err := hex.DecodeString(encryptedString)
+	if err != nil {
+		return "", fmt.Errorf("%w: not hex encoded", errMalformedCiphertext)
+	}
 
 	//Create a new Cipher Block from the key
 	block, err := aes.NewCipher(key)
@@ -185,13 +258,18 @@ func decrypt(encryptedString string, keyString string) (string, error) {
 	//Get the nonce size
 	nonceSize := aesGCM.NonceSize()
 
+	//The encrypted data contains at least the nonce and the authentication tag
+	if len(enc) < nonceSize+aesGCM.Overhead() {
+		return "", fmt.Errorf("%w: too short", errMalformedCiphertext)
+	}
+
 	//Extract the nonce from the encrypted data
 	nonce, ciphertext := enc[:nonceSize], enc[nonceSize:]
 
 	//Decrypt the data
 	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return "", fmt.Errorf("error decrypting data: %v", err)
+		return "", errDecryptionFailed
 	}
 
 	return fmt.Sprintf("%s", plaintext), nil
@@ -9,6 +9,7 @@ import (
 var (
 	requests *prometheus.CounterVec
 	actions  *prometheus.CounterVec
+	purged   *prometheus.CounterVec
 )
 
 func (c *Configuration) initMetrics() {
@@ -20,6 +21,11 @@ func (c *Configuration) initMetrics() {
 		Help: "no. of actions on mails",
 	}, []string{"action"})
 	prometheus.MustRegister(actions)
+	purged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "purged",
+		Help: "no. of mails deleted from the quarantine after the retention",
+	}, []string{"account"})
+	prometheus.MustRegister(purged)
 	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "http_total",
 		Help: "The total number of http requests",
@@ -38,3 +44,9 @@ func (c *Configuration) pushAction(action string) {
 		actions.With(prometheus.Labels{"action": action}).Inc()
 	}
 }
+
+func (c *Configuration) pushPurged(account string, n int) {
+	if c.CollectMetrics && purged != nil {
+		purged.With(prometheus.Labels{"account": account}).Add(float64(n))
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/emersion/go-sasl"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	authPassword    = "password"
+	authPlain       = "plain"
+	authLogin       = "login"
+	authXoauth2     = "xoauth2"
+	authOauthbearer = "oauthbearer"
+)
+
+var (
+	// tokenMu serializes the access to the token file and unsavedTokens
+	tokenMu sync.Mutex
+	// unsavedTokens keeps the tokens per account which could not be written to the token file. A rotated refresh
+	// token is not lost, and the next refresh tries to save it again.
+	unsavedTokens = map[string]*oauthToken{}
+)
+
+// oauthToken is the token of an account persisted encrypted in the token file
+type oauthToken struct {
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken"`
+	Expiry       time.Time `json:"expiry"`
+	// Source is the hash of the configured refresh token the token was derived from
+	Source string `json:"source"`
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// isOauth reports if the authentication method logs in with an access token instead of the password
+func isOauth(method string) bool {
+	return method == authXoauth2 || method == authOauthbearer
+}
+
+// authenticate logs in with the configured authentication method
+func (ic *ImapConfiguration) authenticate(key string) error {
+	switch ic.Auth.Method {
+	case authXoauth2, authOauthbearer:
+		token, err := ic.accessToken(key)
+		if err != nil {
+			return fmt.Errorf("error getting access token for %s: %v", ic.Name, err)
+		}
+		var sc sasl.Client
+		if ic.Auth.Method == authXoauth2 {
+			sc = &xoauth2Client{username: ic.Username, token: token}
+		} else {
+			sc = sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{Username: ic.Username, Token: token, Host: ic.Host, Port: ic.Port})
+		}
+		err = ic.client.Authenticate(sc)
+		if err != nil {
+			// the access token may be revoked, get a new one next time
+			ic.invalidateAccessToken(key)
+		}
+		return err
+	}
+	pw := ic.password
+	switch ic.Auth.Method {
+	case authPlain:
+		return ic.client.Authenticate(sasl.NewPlainClient("", ic.Username, pw))
+	case authLogin:
+		return ic.client.Authenticate(sasl.NewLoginClient(ic.Username, pw))
+	default:
+		return ic.client.Login(ic.Username, pw)
+	}
+}
+
+// accessToken returns a valid access token of the account. An expired token is refreshed at the token endpoint.
+func (ic *ImapConfiguration) accessToken(key string) (string, error) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	refreshToken := ic.Auth.refreshToken
+	source := fmt.Sprintf("%x", sha256.Sum256([]byte(refreshToken)))
+	tokens, err := loadTokens(ic.tokenFile)
+	if err != nil {
+		return "", err
+	}
+	tok := &oauthToken{}
+	if u := unsavedTokens[ic.Name]; u != nil && u.Source == source {
+		// the unsaved token is newer than the one in the token file
+		tok = u
+		if err := ic.storeToken(tokens, tok, key); err != nil {
+			log.Errorf("error saving token of account %s: %v", ic.Name, err)
+		} else {
+			delete(unsavedTokens, ic.Name)
+		}
+	} else if enc, ok := tokens[ic.Name]; ok {
+		s, err := decrypt(enc, key)
+		if err == nil {
+			err = json.Unmarshal([]byte(s), tok)
+		}
+		if err != nil {
+			log.Warnf("ignoring unreadable token of account %s: %v", ic.Name, err)
+			tok = &oauthToken{}
+		}
+	}
+	if tok.Source == source {
+		if tok.AccessToken != "" && time.Until(tok.Expiry) > time.Minute {
+			return tok.AccessToken, nil
+		}
+		if tok.RefreshToken != "" {
+			// the token endpoint may have rotated the refresh token
+			refreshToken = tok.RefreshToken
+		}
+	}
+	log.Infof("refreshing access token for account %s", ic.Name)
+	tr, err := ic.refreshAccessToken(refreshToken, ic.Auth.clientSecret)
+	if err != nil {
+		return "", err
+	}
+	tok = &oauthToken{
+		AccessToken:  tr.AccessToken,
+		RefreshToken: refreshToken,
+		Expiry:       time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+		Source:       source,
+	}
+	if tr.RefreshToken != "" {
+		tok.RefreshToken = tr.RefreshToken
+	}
+	if err := ic.storeToken(tokens, tok, key); err != nil {
+		// the old refresh token may be invalid after a rotation, so the new one is kept until it is saved
+		log.Errorf("error saving token of account %s, keeping it in memory: %v", ic.Name, err)
+		unsavedTokens[ic.Name] = tok
+	} else {
+		delete(unsavedTokens, ic.Name)
+	}
+	return tok.AccessToken, nil
+}
+
+// storeToken encrypts the token of the account into tokens and writes them to the token file
+func (ic *ImapConfiguration) storeToken(tokens map[string]string, tok *oauthToken, key string) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	enc, err := encrypt(string(b), key)
+	if err != nil {
+		return fmt.Errorf("error encrypting token: %v", err)
+	}
+	tokens[ic.Name] = enc
+	return saveTokens(ic.tokenFile, tokens)
+}
+
+// invalidateAccessToken removes the access token of the account from the token file, but keeps the refresh token
+func (ic *ImapConfiguration) invalidateAccessToken(key string) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	if u := unsavedTokens[ic.Name]; u != nil {
+		u.AccessToken = ""
+	}
+	tokens, err := loadTokens(ic.tokenFile)
+	if err != nil {
+		return
+	}
+	s, err := decrypt(tokens[ic.Name], key)
+	if err != nil {
+		return
+	}
+	tok := oauthToken{}
+	if json.Unmarshal([]byte(s), &tok) != nil {
+		return
+	}
+	tok.AccessToken = ""
+	b, _ := json.Marshal(tok)
+	if enc, err := encrypt(string(b), key); err == nil {
+		tokens[ic.Name] = enc
+		_ = saveTokens(ic.tokenFile, tokens)
+	}
+}
+
+// refreshAccessToken gets a new access token with the refresh token grant
+func (ic *ImapConfiguration) refreshAccessToken(refreshToken string, clientSecret string) (*tokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	form.Set("client_id", ic.Auth.ClientId)
+	if clientSecret != "" {
+		form.Set("client_secret", clientSecret)
+	}
+	if ic.Auth.Scope != "" {
+		form.Set("scope", ic.Auth.Scope)
+	}
+	hc := http.Client{Timeout: 30 * time.Second}
+	resp, err := hc.PostForm(ic.Auth.TokenEndpoint, form)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting token: %v", err)
+	}
+	defer resp.Body.Close()
+	tr := tokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return nil, fmt.Errorf("error reading token response (status %d): %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("token endpoint returned %d: %s %s", resp.StatusCode, tr.Error, tr.ErrorDescription)
+	}
+	if tr.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no access token")
+	}
+	return &tr, nil
+}
+
+// loadTokens reads the encrypted tokens per account from the token file
+func loadTokens(file string) (map[string]string, error) {
+	tokens := map[string]string{}
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading token file: %v", err)
+	}
+	err = yaml.Unmarshal(b, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing token file: %v", err)
+	}
+	if tokens == nil {
+		tokens = map[string]string{}
+	}
+	return tokens, nil
+}
+
+// saveTokens writes the encrypted tokens to the token file
+func saveTokens(file string, tokens map[string]string) error {
+	b, err := yaml.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, b, 0600)
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of file and renames it to file
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// xoauth2Client implements the XOAUTH2 mechanism used by Gmail and Microsoft 365
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// the server sends the error as challenge and expects an empty response
+	log.Debugf("XOAUTH2 error: %s", strings.TrimSpace(string(challenge)))
+	return []byte{}, nil
+}
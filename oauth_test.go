@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// xoauth2Server accepts the XOAUTH2 login of the memory backend user with the access token "access-1"
+type xoauth2Server struct {
+	conn server.Conn
+	be   *memory.Backend
+}
+
+func (a *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	if string(response) != "user=username\x01auth=Bearer access-1\x01\x01" {
+		return nil, true, errors.New("invalid token")
+	}
+	user, err := a.be.Login(a.conn.Info(), "username", "password")
+	if err != nil {
+		return nil, true, err
+	}
+	a.conn.Context().State = imap.AuthenticatedState
+	a.conn.Context().User = user
+	return nil, true, nil
+}
+
+// loginTestServer enables the SASL LOGIN mechanism, which the imap server does not offer by default
+func loginTestServer(s *server.Server, be *memory.Backend) {
+	s.EnableAuth(sasl.Login, func(conn server.Conn) sasl.Server {
+		return sasl.NewLoginServer(func(username, password string) error {
+			user, err := be.Login(conn.Info(), username, password)
+			if err != nil {
+				return err
+			}
+			conn.Context().State = imap.AuthenticatedState
+			conn.Context().User = user
+			return nil
+		})
+	})
+}
+
+func oauthTestServer(s *server.Server, be *memory.Backend) {
+	s.EnableAuth("XOAUTH2", func(conn server.Conn) sasl.Server {
+		return &xoauth2Server{conn: conn, be: be}
+	})
+	s.EnableAuth(sasl.OAuthBearer, func(conn server.Conn) sasl.Server {
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if opts.Username != "username" || opts.Token != "access-1" {
+				return &sasl.OAuthBearerError{Status: "invalid_token"}
+			}
+			user, _ := be.Login(conn.Info(), "username", "password")
+			conn.Context().State = imap.AuthenticatedState
+			conn.Context().User = user
+			return nil
+		})
+	})
+}
+
+// startTokenEndpoint starts a token endpoint that issues access-<n> and rotates the refresh token to refresh-<n>
+func startTokenEndpoint(t *testing.T, calls *int32) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(calls, 1)
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("client_id") != "client" || r.FormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_request"}`)
+			return
+		}
+		expected := "refresh-0"
+		if n > 1 {
+			expected = fmt.Sprintf("refresh-%d", n-1)
+		}
+		if r.FormValue("refresh_token") != expected {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":"invalid_grant","error_description":"expected %s"}`, expected)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(tokenResponse{
+			AccessToken:  fmt.Sprintf("access-%d", n),
+			RefreshToken: fmt.Sprintf("refresh-%d", n),
+			ExpiresIn:    3600,
+		})
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func oauthAccount(t *testing.T, key string, ic *ImapConfiguration, method string, endpoint string) {
+	ic.Password = ""
+	ic.tokenFile = filepath.Join(t.TempDir(), "eatspam.tokens")
+	ic.Auth = ImapAuthConfiguration{
+		Method:        method,
+		TokenEndpoint: endpoint,
+		ClientId:      "client",
+	}
+	ic.Auth.ClientSecret, _ = encrypt("secret", key)
+	ic.Auth.RefreshToken, _ = encrypt("refresh-0", key)
+	if err := ic.resolveSecrets(key); err != nil {
+		t.Fatalf("error resolving secrets: %v", err)
+	}
+}
+
+func TestAccessTokenRefresh(t *testing.T) {
+	key := generateKey()
+	var calls int32
+	ts := startTokenEndpoint(t, &calls)
+	ic := &ImapConfiguration{Name: "test"}
+	oauthAccount(t, key, ic, authXoauth2, ts.URL)
+
+	token, err := ic.accessToken(key)
+	if err != nil || token != "access-1" {
+		t.Fatalf("expected access-1, got %s: %v", token, err)
+	}
+	// the cached token is used until it expires
+	token, err = ic.accessToken(key)
+	if err != nil || token != "access-1" || calls != 1 {
+		t.Fatalf("expected cached access-1, got %s after %d calls: %v", token, calls, err)
+	}
+	tokens, err := loadTokens(ic.tokenFile)
+	if err != nil {
+		t.Fatalf("error loading tokens: %v", err)
+	}
+	if strings.Contains(tokens["test"], "access-1") || strings.Contains(tokens["test"], "refresh-1") {
+		t.Errorf("token file contains plain tokens")
+	}
+	// an invalidated token is refreshed with the rotated refresh token
+	ic.invalidateAccessToken(key)
+	token, err = ic.accessToken(key)
+	if err != nil || token != "access-2" {
+		t.Fatalf("expected access-2, got %s: %v", token, err)
+	}
+	// a new configured refresh token replaces the stored token, even if the access token is still valid
+	ic.Auth.RefreshToken, _ = encrypt("refresh-2", key)
+	ic.resolveSecrets(key)
+	token, err = ic.accessToken(key)
+	if err != nil || token != "access-3" {
+		t.Fatalf("expected access-3, got %s: %v", token, err)
+	}
+}
+
+func TestAccessTokenUnsaved(t *testing.T) {
+	key := generateKey()
+	var calls int32
+	ts := startTokenEndpoint(t, &calls)
+	ic := &ImapConfiguration{Name: "unsaved"}
+	oauthAccount(t, key, ic, authXoauth2, ts.URL)
+	dir := filepath.Join(t.TempDir(), "missing")
+	ic.tokenFile = filepath.Join(dir, "eatspam.tokens")
+	t.Cleanup(func() {
+		delete(unsavedTokens, ic.Name)
+	})
+
+	token, err := ic.accessToken(key)
+	if err != nil || token != "access-1" {
+		t.Fatalf("expected access-1 without a writable token file, got %s: %v", token, err)
+	}
+	// the rotated refresh token is kept in memory
+	ic.invalidateAccessToken(key)
+	token, err = ic.accessToken(key)
+	if err != nil || token != "access-2" {
+		t.Fatalf("expected access-2 with the unsaved refresh token, got %s: %v", token, err)
+	}
+	// the unsaved token is written as soon as the token file is writable
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	token, err = ic.accessToken(key)
+	if err != nil || token != "access-2" || calls != 2 {
+		t.Fatalf("expected cached access-2 after %d calls, got %s: %v", calls, token, err)
+	}
+	tokens, err := loadTokens(ic.tokenFile)
+	if err != nil || tokens[ic.Name] == "" || unsavedTokens[ic.Name] != nil {
+		t.Errorf("expected the token saved to the token file, got %v (%v)", tokens, err)
+	}
+}
+
+func TestOauthLogin(t *testing.T) {
+	key := generateKey()
+	for _, method := range []string{authXoauth2, authOauthbearer} {
+		var calls int32
+		ts := startTokenEndpoint(t, &calls)
+		ic, _ := startTestImapServerWith(t, key, tlsModeImplicit, oauthTestServer)
+		oauthAccount(t, key, ic, method, ts.URL)
+		if err := ic.openSession(key); err != nil {
+			t.Errorf("error logging in with %s: %v", method, err)
+			continue
+		}
+		ic.closeSession()
+		ic.logoutSession()
+	}
+}
+
+func TestSaslLogin(t *testing.T) {
+	key := generateKey()
+	for _, method := range []string{authPlain, authLogin} {
+		ic, _ := startTestImapServerWith(t, key, tlsModeImplicit, loginTestServer)
+		ic.Auth.Method = method
+		if err := ic.openSession(key); err != nil {
+			t.Errorf("error logging in with %s: %v", method, err)
+			continue
+		}
+		ic.closeSession()
+		ic.logoutSession()
+	}
+}
+
+func TestSaslLoginWrongPassword(t *testing.T) {
+	key := generateKey()
+	ic, _ := startTestImapServerWith(t, key, tlsModeImplicit, loginTestServer)
+	ic.Auth.Method = authLogin
+	ic.password = "wrong"
+	if err := ic.openSession(key); err == nil {
+		ic.closeSession()
+		ic.logoutSession()
+		t.Errorf("expected login with %s and a wrong password to fail", authLogin)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// ForwardAuthConfiguration trusts the user name in Header of requests from a reverse proxy with an address in
+// TrustedProxies, e.g. X-Forwarded-User of an SSO forward-auth
+type ForwardAuthConfiguration struct {
+	Header         string   `yaml:"header,omitempty"`
+	TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+	trusted        []*net.IPNet
+}
+
+// validateProxy checks the path prefix and parses the trusted proxies
+func (conf *Configuration) validateProxy() error {
+	p := conf.Http.PathPrefix
+	if p != "" {
+		p = "/" + strings.Trim(p, "/")
+		if p != path.Clean(p) || strings.ContainsAny(p, "?#") {
+			return fmt.Errorf("illegal http.pathPrefix '%s'", conf.Http.PathPrefix)
+		}
+		if p == "/" {
+			p = ""
+		}
+		conf.Http.PathPrefix = p
+	}
+	fa := &conf.Http.ForwardAuth
+	fa.trusted = nil
+	for _, cidr := range fa.TrustedProxies {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("illegal trusted proxy '%s' in http.forwardAuth: %v", cidr, err)
+		}
+		fa.trusted = append(fa.trusted, n)
+	}
+	if fa.Header != "" && len(fa.trusted) == 0 {
+		return fmt.Errorf("http.forwardAuth.header needs trustedProxies")
+	}
+	return nil
+}
+
+// fromTrustedProxy reports if the request comes directly from a trusted reverse proxy
+func (conf *Configuration) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range conf.Http.ForwardAuth.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedUser returns the user name set by a trusted reverse proxy or an empty string
+func (conf *Configuration) forwardedUser(r *http.Request) string {
+	if conf.Http.ForwardAuth.Header == "" || !conf.fromTrustedProxy(r) {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(conf.Http.ForwardAuth.Header))
+}
+
+// forwardedWebUser returns the configured user for a user name of the reverse proxy
+func (conf *Configuration) forwardedWebUser(name string) *webUser {
+	if u := conf.userByName(name); u != nil {
+		return u.webUser()
+	}
+	return nil
+}
+
+// clientAddress returns the ip address of the client. Behind a trusted reverse proxy it is the last address of
+// X-Forwarded-For.
+func (conf *Configuration) clientAddress(r *http.Request) string {
+	if conf.fromTrustedProxy(r) {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isHttps reports if the browser uses https, directly or to a trusted reverse proxy
+func (conf *Configuration) isHttps(r *http.Request) bool {
+	return r.TLS != nil || (conf.fromTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https"))
+}
+
+// url returns the absolute path p of the web ui with the path prefix
+func (conf *Configuration) url(p string) string {
+	return conf.Http.PathPrefix + p
+}
+
+// templateFuncs are the functions available in the templates of the web ui
+func (conf *Configuration) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"url": conf.url,
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func setupProxyConfiguration(t *testing.T) *Configuration {
+	c := setupUsersConfiguration(t)
+	c.Http.PathPrefix = "/eatspam/"
+	c.Http.ForwardAuth = ForwardAuthConfiguration{
+		Header:         "X-Forwarded-User",
+		TrustedProxies: []string{"10.0.0.0/8", "192.0.2.10"},
+	}
+	c.Http.Users = append(c.Http.Users, UserConfiguration{Name: "sso", Role: roleAdmin})
+	if err := c.validateProxy(); err != nil {
+		t.Fatalf("error validating proxy: %v", err)
+	}
+	if err := c.validateUsers(); err != nil {
+		t.Fatalf("error validating users: %v", err)
+	}
+	return c
+}
+
+// proxyRequest sends a request from remote to the web ui with an optional forwarded user
+func proxyRequest(c *Configuration, remote string, path string, user string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.RemoteAddr = remote + ":4711"
+	if user != "" {
+		r.Header.Set("X-Forwarded-User", user)
+	}
+	w := httptest.NewRecorder()
+	c.httpHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestValidateProxy(t *testing.T) {
+	c := setupProxyConfiguration(t)
+	if c.Http.PathPrefix != "/eatspam" {
+		t.Errorf("expected path prefix /eatspam, got %s", c.Http.PathPrefix)
+	}
+	tests := []HttpConfiguration{
+		{PathPrefix: "/a/../b"},
+		{ForwardAuth: ForwardAuthConfiguration{Header: "X-Forwarded-User"}},
+		{ForwardAuth: ForwardAuthConfiguration{Header: "X-Forwarded-User", TrustedProxies: []string{"10.0.0.0/33"}}},
+		{ForwardAuth: ForwardAuthConfiguration{Header: "X-Forwarded-User", TrustedProxies: []string{"proxy"}}},
+	}
+	for _, h := range tests {
+		c := &Configuration{Http: h}
+		if err := c.validateProxy(); err == nil {
+			t.Errorf("expected error for %v", h)
+		}
+	}
+}
+
+func TestForwardAuth(t *testing.T) {
+	c := setupProxyConfiguration(t)
+	w := proxyRequest(c, "10.1.2.3", "/eatspam/index.html", "alice")
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "alice-mail") || strings.Contains(body, "bob-mail") {
+		t.Errorf("expected index page of alice, got %d", w.Code)
+	}
+	if w := proxyRequest(c, "192.0.2.10", "/eatspam/index.html", "sso"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "bob-mail") {
+		t.Errorf("expected index page of admin sso, got %d", w.Code)
+	}
+	// the header of an untrusted client is ignored
+	if w := proxyRequest(c, "192.0.2.11", "/eatspam/index.html", "sso"); w.Code != http.StatusFound || w.Header().Get("Location") != "/eatspam/login.html" {
+		t.Errorf("expected redirect to the login page, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := proxyRequest(c, "10.1.2.3", "/eatspam/index.html", "mallory"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for an unknown user, got %d", w.Code)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	c := setupProxyConfiguration(t)
+	w := proxyRequest(c, "10.1.2.3", "/eatspam/index.html", "sso")
+	for _, s := range []string{`action="/eatspam/scan"`, `href="/eatspam/mails.html"`, `action="/eatspam/logout"`} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("expected %s in the index page", s)
+		}
+	}
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == cookieSession && ck.Path != "/eatspam/" {
+			t.Errorf("expected cookie path /eatspam/, got %s", ck.Path)
+		}
+	}
+	if w := proxyRequest(c, "10.1.2.3", "/eatspam", ""); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/eatspam/" {
+		t.Errorf("expected redirect to /eatspam/, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := proxyRequest(c, "10.1.2.3", "/eatspam/", ""); w.Header().Get("Location") != "/eatspam/index.html" {
+		t.Errorf("expected redirect to /eatspam/index.html, got %s", w.Header().Get("Location"))
+	}
+	if w := proxyRequest(c, "10.1.2.3", "/eatspam/css/styles.css", ""); w.Code != http.StatusOK {
+		t.Errorf("expected asset below the prefix, got %d", w.Code)
+	}
+	if w := proxyRequest(c, "10.1.2.3", "/index.html", "sso"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 outside the prefix, got %d", w.Code)
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	c := setupProxyConfiguration(t)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+	r.RemoteAddr = "10.0.0.1:4711"
+	if a := c.clientAddress(r); a != "203.0.113.7" {
+		t.Errorf("expected 203.0.113.7 behind a trusted proxy, got %s", a)
+	}
+	r.RemoteAddr = "198.51.100.2:4711"
+	if a := c.clientAddress(r); a != "198.51.100.2" {
+		t.Errorf("expected 198.51.100.2 from an untrusted client, got %s", a)
+	}
+}
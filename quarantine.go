@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// historyActionPurge is the action of a mail in the history which was deleted from the quarantine
+	historyActionPurge = "purge"
+	// historyActionRelease is the action of a mail in the history which was released from the quarantine
+	historyActionRelease = "release"
+)
+
+// parseDuration parses a duration like 12h or 30d
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("illegal duration '%s'", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("illegal duration '%s'", s)
+	}
+	return d, nil
+}
+
+// parseRetention parses the retention of the quarantine like 30d
+func parseRetention(s string) (time.Duration, error) {
+	d, err := parseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("illegal quarantineRetention '%s', expected a duration like 30d or 72h", s)
+	}
+	return d, nil
+}
+
+// quarantineFolder returns the folder for rejected mails, quarantineFolder or the spam folder
+func (ic *ImapConfiguration) quarantineFolder() string {
+	if ic.Quarantine != "" {
+		return ic.Quarantine
+	}
+	return ic.SpamFolder
+}
+
+// purgeQuarantine deletes the mails in the quarantine folder which are older than the retention. The age is taken from
+// the INTERNALDATE, which is kept when a mail is moved. Flagged mails are kept and the spam folder is never purged. The
+// purged mails are counted in rr, the metrics and the history.
+func (ic *ImapConfiguration) purgeQuarantine(conf *Configuration, rr *RunResult, now time.Time) error {
+	if ic.retention <= 0 || ic.Quarantine == "" {
+		return nil
+	}
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	folder := ic.Quarantine
+	if _, err := ic.client.Select(folder, false); err != nil {
+		return fmt.Errorf("error selecting quarantine %s: %v", folder, err)
+	}
+	cutoff := now.Add(-ic.retention)
+	criteria := imap.NewSearchCriteria()
+	// BEFORE compares only the date, the exact time is checked below
+	criteria.Before = cutoff.AddDate(0, 0, 1)
+	criteria.WithoutFlags = []string{imap.FlaggedFlag, imap.DeletedFlag}
+	ids, err := ic.client.Search(criteria)
+	if err != nil {
+		return fmt.Errorf("error searching quarantine %s: %v", folder, err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(ids...)
+	msgs := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- ic.client.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchInternalDate}, msgs)
+	}()
+	expired := make([]*imap.Message, 0)
+	for msg := range msgs {
+		if msg.InternalDate.Before(cutoff) {
+			expired = append(expired, msg)
+		}
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("error fetching quarantine %s: %v", folder, err)
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	purge := make([]uint32, 0, len(expired))
+	for _, msg := range expired {
+		purge = append(purge, msg.SeqNum)
+	}
+	if err := ic.deleteMessages(purge...); err != nil {
+		return fmt.Errorf("error purging quarantine %s: %v", folder, err)
+	}
+	log.Infof("purged %d mails older than %s from quarantine %s of account %s", len(expired), ic.Retention, folder, ic.Name)
+	rr.Purged += len(expired)
+	conf.pushPurged(ic.Name, len(expired))
+	for _, msg := range expired {
+		e := historyEntry(ic, checkSpamResult{action: historyActionPurge}, msg)
+		e.Time = now
+		conf.appendHistory(e)
+	}
+	return nil
+}
+
+// quarantinedMessage returns the mail with the Message-ID from the quarantine
+func (ic *ImapConfiguration) quarantinedMessage(key string, messageId string) (*imap.Message, string, error) {
+	err := ic.tryOpenSession(key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer ic.closeSession()
+	return ic.findQuarantined(messageId, true)
+}
+
+// findQuarantined selects the quarantine and fetches the mail with the Message-ID
+func (ic *ImapConfiguration) findQuarantined(messageId string, readOnly bool) (*imap.Message, string, error) {
+	folder := ic.quarantineFolder()
+	if messageId == "" {
+		return nil, "", fmt.Errorf("message has no Message-ID and cannot be found in %s", folder)
+	}
+	if _, err := ic.client.Select(folder, readOnly); err != nil {
+		return nil, "", fmt.Errorf("error selecting quarantine %s: %v", folder, err)
+	}
+	ids, err := ic.searchMessageId(messageId)
+	if err != nil {
+		return nil, "", fmt.Errorf("error searching message in %s: %v", folder, err)
+	}
+	if len(ids) == 0 {
+		return nil, "", fmt.Errorf("message %s not found in %s", messageId, folder)
+	}
+	return ic.getMessage(ids[0])
+}
+
+// releaseMessage moves the mail with the Message-ID from the quarantine back into the inbox and returns its body. The
+// released mail gets flagged as seen by eatspam, so it is not processed again.
+func (ic *ImapConfiguration) releaseMessage(key string, messageId string) (string, error) {
+	err := ic.tryOpenSession(key)
+	if err != nil {
+		return "", err
+	}
+	defer ic.closeSession()
+	msg, s, err := ic.findQuarantined(messageId, false)
+	if err != nil {
+		return "", err
+	}
+	var date time.Time
+	if msg.Envelope != nil {
+		date = msg.Envelope.Date
+	}
+	err = ic.client.Append(ic.Inbox, ic.checkedFlags(), date, bytes.NewBufferString(s))
+	if err != nil {
+		return "", fmt.Errorf("error writing released mail to %s: %v", ic.Inbox, err)
+	}
+	return s, ic.deleteMessages(msg.SeqNum)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := map[string]time.Duration{
+		"30d": 30 * 24 * time.Hour,
+		"72h": 72 * time.Hour,
+	}
+	for s, expected := range tests {
+		d, err := parseRetention(s)
+		if err != nil || d != expected {
+			t.Errorf("expected %s for '%s', got %s (%v)", expected, s, d, err)
+		}
+	}
+	for _, illegal := range []string{"", "30", "0d", "-1d", "month"} {
+		if _, err := parseRetention(illegal); err == nil {
+			t.Errorf("expected error for '%s'", illegal)
+		}
+	}
+}
+
+func TestPurgeQuarantine(t *testing.T) {
+	key := generateKey()
+	ic, be := startTestImapServer(t, key)
+	ic.Quarantine = "Quarantine"
+	ic.Retention = "30d"
+	ic.retention = 30 * 24 * time.Hour
+	now := time.Now()
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox(ic.Quarantine); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(ic.Quarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := setupTestConfiguration()
+	c.key = key
+	c.HistoryFile = filepath.Join(t.TempDir(), "eatspam.history")
+	c.ImapAccounts = []*ImapConfiguration{ic}
+	day := 24 * time.Hour
+	mails := []struct {
+		subject string
+		flags   []string
+		age     time.Duration
+	}{
+		{"old", nil, 31 * day},
+		{"old without Message-ID", nil, 31 * day},
+		{"old flagged", []string{imap.FlaggedFlag}, 40 * day},
+		{"almost old", nil, 29 * day},
+		{"new", nil, time.Hour},
+	}
+	for i, m := range mails {
+		msg := "From: sender@example.com\r\nSubject: " + m.subject + "\r\n\r\nHello\r\n"
+		if i != 1 {
+			msg = fmt.Sprintf("Message-ID: <purge-%d@example.com>\r\n", i) + msg
+		}
+		if err := mbox.CreateMessage(m.flags, now.Add(-m.age), bytes.NewBufferString(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := RunResult{Actions: map[string]int{}}
+	if err := ic.checkSpam(c, &rr); err != nil {
+		t.Fatalf("error checking account: %v", err)
+	}
+	defer ic.logoutSession()
+	if rr.Purged != 2 {
+		t.Errorf("expected 2 purged mails, got %d", rr.Purged)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 3 {
+		t.Errorf("expected 3 mails in the quarantine, got %d", status.Messages)
+	}
+	entries, err := c.readHistory(historyFilter{action: historyActionPurge}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Subject != "old" || entries[0].Account != ic.Name {
+		t.Errorf("expected the purged mail in the history, got %+v", entries)
+	}
+}
+
+func TestPurgeQuarantineSpamFolder(t *testing.T) {
+	key := generateKey()
+	ic, be := startTestImapServer(t, key)
+	ic.Retention = "30d"
+	ic.retention = 30 * 24 * time.Hour
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox(ic.SpamFolder); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(ic.SpamFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	msg := "From: sender@example.com\r\nMessage-ID: <spam@example.com>\r\nSubject: old\r\n\r\nHello\r\n"
+	if err := mbox.CreateMessage(nil, now.Add(-40*24*time.Hour), bytes.NewBufferString(msg)); err != nil {
+		t.Fatal(err)
+	}
+	c := setupTestConfiguration()
+	if err := ic.openSession(key); err != nil {
+		t.Fatal(err)
+	}
+	defer ic.logoutSession()
+	defer ic.closeSession()
+	rr := RunResult{Actions: map[string]int{}}
+	if err := ic.purgeQuarantine(c, &rr, now); err != nil || rr.Purged != 0 {
+		t.Errorf("expected the spam folder without quarantineFolder to be kept, purged %d (%v)", rr.Purged, err)
+	}
+}
@@ -10,15 +10,19 @@ import (
 )
 
 type QueueElement struct {
-	Id      string
-	Score   string
-	Action  string
-	Class   string
-	Account *ImapConfiguration
-	Sender  string
-	Subject string
-	Body    string
-	Date    string
+	Id        string
+	Score     string
+	Action    string
+	Class     string
+	Account   *ImapConfiguration
+	Sender    string
+	Subject   string
+	MessageId string
+	Body      string
+	Date      string
+	Time      time.Time
+	Truncated bool
+	Restored  bool
 }
 
 type Queue struct {
@@ -44,7 +48,7 @@ func NewQueue() *Queue {
 	return &q
 }
 
-func (q *Queue) queueMessage(ic *ImapConfiguration, c checkSpamResult, msg *imap.Message, body string) {
+func (q *Queue) queueMessage(ic *ImapConfiguration, c checkSpamResult, msg *imap.Message, body string, truncated bool) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	sender := ""
@@ -52,15 +56,18 @@ func (q *Queue) queueMessage(ic *ImapConfiguration, c checkSpamResult, msg *imap
 		sender = msg.Envelope.Sender[0].Address()
 	}
 	qe := QueueElement{
-		Id:      fmt.Sprintf("%x", sha256.Sum256([]byte(body))),
-		Score:   fmt.Sprintf("%0.1f", c.score),
-		Action:  c.action,
-		Class:   actionClassMap[c.action],
-		Account: ic,
-		Sender:  sender,
-		Subject: msg.Envelope.Subject,
-		Body:    body,
-		Date:    msg.Envelope.Date.Format(time.RFC822),
+		Id:        fmt.Sprintf("%x", sha256.Sum256([]byte(body))),
+		Score:     fmt.Sprintf("%0.1f", c.score),
+		Action:    c.action,
+		Class:     actionClassMap[c.action],
+		Account:   ic,
+		Sender:    sender,
+		Subject:   msg.Envelope.Subject,
+		MessageId: msg.Envelope.MessageId,
+		Body:      body,
+		Date:      msg.Envelope.Date.Format(time.RFC822),
+		Time:      msg.Envelope.Date,
+		Truncated: truncated,
 	}
 	q.messages.PushBack(&qe)
 	if q.messages.Len() > capacity {
@@ -69,22 +76,69 @@ func (q *Queue) queueMessage(ic *ImapConfiguration, c checkSpamResult, msg *imap
 	}
 }
 
+// copyOf returns a copy of the element of e. The elements returned by the queue are copies, so they can be read
+// without the lock while the queue changes them.
+func copyOf(e *list.Element) *QueueElement {
+	qe := *e.Value.(*QueueElement)
+	return &qe
+}
+
 func (q *Queue) asList() []*QueueElement {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	result := make([]*QueueElement, 0)
 	for e := q.messages.Front(); e != nil; e = e.Next() {
-		result = append(result, e.Value.(*QueueElement))
+		result = append(result, copyOf(e))
 	}
 	return result
 }
 
 func (q *Queue) byId(id string) *QueueElement {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 	for e := q.messages.Front(); e != nil; e = e.Next() {
-		qe := e.Value.(*QueueElement)
-		if qe.Id == id {
-			return qe
+		if e.Value.(*QueueElement).Id == id {
+			return copyOf(e)
 		}
 	}
 	return nil
 }
+
+// byMessageId returns the queued mail of the account with the Message-ID
+func (q *Queue) byMessageId(account string, messageId string) *QueueElement {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for e := q.messages.Back(); e != nil && messageId != ""; e = e.Prev() {
+		if qe := e.Value.(*QueueElement); qe.Account.Name == account && qe.MessageId == messageId {
+			return copyOf(e)
+		}
+	}
+	return nil
+}
+
+// markRestored flags the mail with the id as restored
+func (q *Queue) markRestored(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for e := q.messages.Front(); e != nil; e = e.Next() {
+		if qe := e.Value.(*QueueElement); qe.Id == id {
+			qe.Restored = true
+		}
+	}
+}
+
+// replaceAccounts sets the accounts of the queued mails after a reload. Mails of removed accounts are dropped.
+func (q *Queue) replaceAccounts(accounts map[*ImapConfiguration]*ImapConfiguration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next *list.Element
+	for e := q.messages.Front(); e != nil; e = next {
+		next = e.Next()
+		qe := e.Value.(*QueueElement)
+		if ic := accounts[qe.Account]; ic != nil {
+			qe.Account = ic
+		} else {
+			q.messages.Remove(e)
+		}
+	}
+}
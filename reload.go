@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// configCheckInterval is the time between two checks of the config file for changes
+const configCheckInterval = 10 * time.Second
+
+// startConfigWatcher reloads the config file when it changes or on SIGHUP
+func (conf *Configuration) startConfigWatcher() {
+	modTime, _ := latestModTime(conf.ConfigFile)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		ticker := time.NewTicker(configCheckInterval)
+		for {
+			select {
+			case <-hup:
+				log.Infof("SIGHUP received, reloading %s", conf.ConfigFile)
+			case <-ticker.C:
+				m, err := latestModTime(conf.ConfigFile)
+				if err != nil || !m.After(modTime) {
+					continue
+				}
+				log.Infof("%s changed, reloading", conf.ConfigFile)
+			}
+			modTime, _ = latestModTime(conf.ConfigFile)
+			if err := conf.reload(); err != nil {
+				log.Errorf("error reloading %s, keeping the current config: %v", conf.ConfigFile, err)
+			}
+		}
+	}()
+}
+
+// reload reads and validates the config file and applies it between two runs. An invalid config is not applied.
+func (conf *Configuration) reload() error {
+	nc, err := loadConfig(conf.ConfigFile)
+	if err != nil {
+		return err
+	}
+	nc.key = conf.key
+	err = nc.resolveSecrets()
+	if err != nil {
+		return err
+	}
+	// wait for the active run
+	conf.cronMu.Lock()
+	reschedule := conf.apply(nc)
+	conf.cronMu.Unlock()
+	if reschedule && conf.scheduler != nil {
+		err = conf.scheduleCron()
+		if err != nil {
+			return fmt.Errorf("error rescheduling cronjob: %v", err)
+		}
+	}
+	return nil
+}
+
+// apply takes the settings of the new config nc. Unchanged accounts keep their IMAP session, the sessions of changed
+// and removed accounts are logged out. It returns true if the schedules changed.
+func (conf *Configuration) apply(nc *Configuration) bool {
+	conf.warnRestart(nc)
+	// settings which are only used at startup
+	nc.Http.Port, nc.Http.Listen, nc.Http.Tls, nc.Http.PathPrefix = conf.Http.Port, conf.Http.Listen, conf.Http.Tls, conf.Http.PathPrefix
+	for _, ic := range nc.ImapAccounts {
+		ic.journalDir = conf.JournalDir
+	}
+
+	accounts := make([]*ImapConfiguration, 0, len(nc.ImapAccounts))
+	replaced := map[*ImapConfiguration]*ImapConfiguration{}
+	for _, ic := range nc.ImapAccounts {
+		if old := conf.sameAccount(ic); old != nil {
+			accounts = append(accounts, old)
+			replaced[old] = old
+			continue
+		}
+		if old := conf.accountByName(ic.Name); old != nil && ic.Name != "" {
+			log.Infof("account %s changed", ic.Name)
+			replaced[old] = ic
+		} else {
+			log.Infof("account %s added", ic.Name)
+		}
+		accounts = append(accounts, ic)
+	}
+	for _, old := range conf.ImapAccounts {
+		if replaced[old] == old {
+			continue
+		}
+		if replaced[old] == nil {
+			log.Infof("account %s removed", old.Name)
+		}
+		old.logoutSession()
+	}
+	queue.replaceAccounts(replaced)
+
+	reschedule := conf.scheduleSignature() != nc.scheduleSignature()
+	if conf.LogLevel != nc.LogLevel {
+		setLogLevel(nc.LogLevel)
+	}
+	// requests and jobs read the config with the read lock
+	conf.confMu.Lock()
+	conf.ImapAccounts = accounts
+	conf.Spamd = nc.Spamd
+	conf.Rspamd = nc.Rspamd
+	conf.Http = nc.Http
+	conf.Interval = nc.Interval
+	conf.SpamPrefix = nc.SpamPrefix
+	conf.Actions = nc.Actions
+	conf.Strategy = nc.Strategy
+	conf.LogLevel = nc.LogLevel
+	conf.SpamHeader = nc.SpamHeader
+	conf.Concurrency = nc.Concurrency
+	conf.Fetch = nc.Fetch
+	conf.MaxMessageSize = nc.MaxMessageSize
+	conf.QuietHours = nc.QuietHours
+	conf.Retention = nc.Retention
+	conf.Smtp = nc.Smtp
+	conf.HistoryFile = nc.HistoryFile
+	sessions.refreshUsers(conf)
+	conf.confMu.Unlock()
+	log.Infof("reloaded %s: %d accounts, strategy %s with thresholds %v", conf.ConfigFile, len(conf.ImapAccounts), conf.Strategy, conf.Actions)
+	return reschedule
+}
+
+// warnRestart logs the changed settings which need a restart
+func (conf *Configuration) warnRestart(nc *Configuration) {
+	changed := map[string]bool{
+		"http.port":       conf.Http.Port != nc.Http.Port,
+		"http.listen":     conf.Http.Listen != nc.Http.Listen,
+		"http.tls":        conf.Http.Tls != nc.Http.Tls,
+		"http.pathPrefix": conf.Http.PathPrefix != nc.Http.PathPrefix,
+		"daemon":          conf.Daemon != nc.Daemon,
+		"collectMetrics":  conf.CollectMetrics != nc.CollectMetrics,
+		"keyFile":         conf.KeyFile != nc.KeyFile,
+		"tokenFile":       conf.TokenFile != nc.TokenFile,
+		"keepalive":       conf.Keepalive != nc.Keepalive,
+		"journalDir":      conf.JournalDir != nc.JournalDir,
+	}
+	for name, c := range changed {
+		if c {
+			log.Warnf("%s changed. Restart eatspam to apply it", name)
+		}
+	}
+}
+
+// sameAccount returns the current account with the same settings as ic or nil
+func (conf *Configuration) sameAccount(ic *ImapConfiguration) *ImapConfiguration {
+	b, err := yaml.Marshal(ic)
+	if err != nil {
+		return nil
+	}
+	for _, old := range conf.ImapAccounts {
+		ob, err := yaml.Marshal(old)
+		if err == nil && string(ob) == string(b) && old.password == ic.password &&
+			old.Auth.clientSecret == ic.Auth.clientSecret && old.Auth.refreshToken == ic.Auth.refreshToken {
+			return old
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"github.com/go-co-op/gocron"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const reloadTestConfig = `interval: 5m
+imapAccounts:
+  - name: alice
+    username: alice
+    password: env:EATSPAM_TEST_PASSWORD
+    host: imap.example.com
+  - name: bob
+    username: bob
+    password: env:EATSPAM_TEST_PASSWORD
+    host: imap.example.com
+rspamd:
+  use: true
+actions:
+  5.0: add header
+`
+
+func setupReloadConfiguration(t *testing.T) *Configuration {
+	t.Setenv("EATSPAM_TEST_PASSWORD", "secret")
+	file := filepath.Join(t.TempDir(), "eatspam.yaml")
+	if err := os.WriteFile(file, []byte(reloadTestConfig), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	c, err := loadConfig(file)
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	c.ConfigFile = file
+	c.key = testKey
+	if err := c.resolveSecrets(); err != nil {
+		t.Fatalf("error resolving secrets: %v", err)
+	}
+	c.scheduler = gocron.NewScheduler(time.UTC)
+	if err := c.scheduleCron(); err != nil {
+		t.Fatalf("error scheduling cron: %v", err)
+	}
+	old := queue
+	queue = NewQueue()
+	t.Cleanup(func() {
+		queue = old
+	})
+	for _, ic := range c.ImapAccounts {
+		queue.messages.PushBack(&QueueElement{Id: ic.Name, Account: ic})
+	}
+	return c
+}
+
+func TestReload(t *testing.T) {
+	c := setupReloadConfiguration(t)
+	alice := c.ImapAccounts[0]
+	changed := strings.Replace(reloadTestConfig, "interval: 5m", "interval: 1h", 1)
+	changed = strings.Replace(changed, "  - name: bob\n    username: bob", "  - name: carol\n    username: carol", 1)
+	changed = strings.Replace(changed, "5.0: add header", "7.5: reject", 1)
+	if err := os.WriteFile(c.ConfigFile, []byte(changed), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	if err := c.reload(); err != nil {
+		t.Fatalf("error reloading config: %v", err)
+	}
+	if len(c.ImapAccounts) != 2 || c.ImapAccounts[0] != alice || c.ImapAccounts[1].Name != "carol" {
+		t.Errorf("expected unchanged alice and new carol, got %v", c.ImapAccounts)
+	}
+	if c.ImapAccounts[1].password != "secret" {
+		t.Errorf("expected resolved password of carol")
+	}
+	if c.Interval != "1h" || len(c.Actions) != 1 || c.Actions[7.5] != spamActionReject {
+		t.Errorf("expected new interval and actions, got %s %v", c.Interval, c.Actions)
+	}
+	if jobs := c.scheduler.Jobs(); len(jobs) != 1 {
+		t.Errorf("expected one rescheduled job, got %d", len(jobs))
+	}
+	if mails := queue.asList(); len(mails) != 1 || mails[0].Account != alice {
+		t.Errorf("expected only the mail of alice in the queue, got %v", mails)
+	}
+
+	changed = strings.Replace(changed, "host: imap.example.com", "host: mail.example.com", 1)
+	if err := os.WriteFile(c.ConfigFile, []byte(changed), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	if err := c.reload(); err != nil {
+		t.Fatalf("error reloading config: %v", err)
+	}
+	if c.ImapAccounts[0] == alice || c.ImapAccounts[0].Host != "mail.example.com" {
+		t.Errorf("expected changed account alice")
+	}
+	if mails := queue.asList(); len(mails) != 1 || mails[0].Account != c.ImapAccounts[0] {
+		t.Errorf("expected the mail of alice with the changed account")
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	c := setupReloadConfiguration(t)
+	for _, invalid := range []string{
+		strings.Replace(reloadTestConfig, "interval: 5m", "interval: often", 1),
+		strings.Replace(reloadTestConfig, "host: imap.example.com", "host: imap.example.com\n    tlsMode: plain", 1),
+		strings.Replace(reloadTestConfig, "env:EATSPAM_TEST_PASSWORD", "env:EATSPAM_TEST_MISSING", 1),
+		strings.Replace(reloadTestConfig, "use: true", "use: false", 1),
+		reloadTestConfig + "strategy: spamd\n",
+		"imapAccounts: [",
+	} {
+		if err := os.WriteFile(c.ConfigFile, []byte(invalid), 0600); err != nil {
+			t.Fatalf("error writing config: %v", err)
+		}
+		if err := c.reload(); err == nil {
+			t.Errorf("expected error for config\n%s", invalid)
+		}
+		if c.Interval != "5m" || len(c.ImapAccounts) != 2 || c.Actions[5.0] != spamActionAddHeader {
+			t.Errorf("expected the old config to be kept")
+		}
+	}
+}
+
+// TestReloadConcurrentRequests reloads the config while the web ui and the api are used. Run it with -race.
+func TestReloadConcurrentRequests(t *testing.T) {
+	t.Setenv("EATSPAM_TEST_API_TOKEN", "token")
+	withHttp := reloadTestConfig + "http:\n  password: env:EATSPAM_TEST_PASSWORD\n  apiToken: env:EATSPAM_TEST_API_TOKEN\n"
+	c := setupReloadConfiguration(t)
+	if err := os.WriteFile(c.ConfigFile, []byte(withHttp), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	if err := c.reload(); err != nil {
+		t.Fatalf("error reloading config: %v", err)
+	}
+	h := c.httpHandler()
+	requests := []func() *http.Request{
+		func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, apiPrefix+"/accounts", nil)
+			r.Header.Set("Authorization", "Bearer token")
+			return r
+		},
+		func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(url.Values{"password": {"secret"}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return r
+		},
+		func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		},
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, request := range requests {
+		wg.Add(1)
+		go func(request func() *http.Request) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, request())
+				if w.Code >= http.StatusInternalServerError {
+					t.Errorf("unexpected status %d", w.Code)
+				}
+			}
+		}(request)
+	}
+	for i := 0; i < 20; i++ {
+		config := withHttp
+		if i%2 == 0 {
+			config = strings.Replace(config, "host: imap.example.com", "host: mail.example.com", 1)
+		}
+		if err := os.WriteFile(c.ConfigFile, []byte(config), 0600); err != nil {
+			t.Fatalf("error writing config: %v", err)
+		}
+		if err := c.reload(); err != nil {
+			t.Errorf("error reloading config: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
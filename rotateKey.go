@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// secretKeys are the keys in the configuration file with encrypted values
+var secretKeys = map[string]bool{
+	"password":     true,
+	"apiToken":     true,
+	"clientSecret": true,
+	"refreshToken": true,
+}
+
+// yamlReplacement replaces the raw text of a scalar at offset in a yaml file
+type yamlReplacement struct {
+	offset int
+	old    string
+	new    string
+}
+
+// rotateKey generates a new key and re-encrypts all encrypted values of the configuration file and the token file with
+// it. The configuration file and the key file are backed up with the suffix .bak before they are replaced.
+func (conf *Configuration) rotateKey() error {
+	b, err := os.ReadFile(conf.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	newKey := generateKey()
+	data, n, err := reencryptYaml(b, conf.key, newKey)
+	if err != nil {
+		return err
+	}
+	tokens, err := loadTokens(conf.TokenFile)
+	if err != nil {
+		return err
+	}
+	for name, enc := range tokens {
+		s, err := decrypt(enc, conf.key)
+		if err != nil {
+			return fmt.Errorf("error decrypting token of account %s: %v", name, err)
+		}
+		tokens[name], err = encrypt(s, newKey)
+		if err != nil {
+			return fmt.Errorf("error encrypting token of account %s: %v", name, err)
+		}
+	}
+	// with the backups the old configuration stays usable if eatspam stops in between
+	err = writeFileAtomic(conf.ConfigFile+".bak", b, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing config backup: %v", err)
+	}
+	err = writeFileAtomic(conf.KeyFile+".bak", []byte(conf.key), 0600)
+	if err != nil {
+		return fmt.Errorf("error writing key backup: %v", err)
+	}
+	perm := os.FileMode(0600)
+	if fi, err := os.Stat(conf.ConfigFile); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	err = writeFileAtomic(conf.ConfigFile, data, perm)
+	if err != nil {
+		return fmt.Errorf("error writing config file: %v", err)
+	}
+	err = writeFileAtomic(conf.KeyFile, []byte(newKey), 0600)
+	if err != nil {
+		return fmt.Errorf("error writing key file: %v", err)
+	}
+	if len(tokens) > 0 {
+		err = saveTokens(conf.TokenFile, tokens)
+		if err != nil {
+			return fmt.Errorf("error writing token file: %v", err)
+		}
+	}
+	conf.key = newKey
+	log.Infof("re-encrypted %d values in %s and %d tokens with the new key", n, conf.ConfigFile, len(tokens))
+	return nil
+}
+
+// reencryptYaml decrypts all encrypted values of data with oldKey and encrypts them with newKey. Only the values are
+// replaced in the text, so comments, ordering and formatting stay as they are. It returns the new data and the number of
+// replaced values.
+func reencryptYaml(data []byte, oldKey string, newKey string) ([]byte, int, error) {
+	root := yaml.Node{}
+	err := yaml.Unmarshal(data, &root)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error parsing config file: %v", err)
+	}
+	lines := lineOffsets(data)
+	var replacements []yamlReplacement
+	var walk func(n *yaml.Node) error
+	walk = func(n *yaml.Node) error {
+		if n.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				k, v := n.Content[i], n.Content[i+1]
+				if secretKeys[k.Value] && v.Kind == yaml.ScalarNode && v.Value != "" && !isSecretReference(v.Value) {
+					r, err := reencryptScalar(data, lines, v, oldKey, newKey)
+					if err != nil {
+						return fmt.Errorf("error re-encrypting %s in line %d: %v", k.Value, k.Line, err)
+					}
+					replacements = append(replacements, r)
+				}
+			}
+		}
+		for _, c := range n.Content {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = walk(&root)
+	if err != nil {
+		return nil, 0, err
+	}
+	// replace from the end, so the offsets of the remaining replacements stay valid
+	sort.Slice(replacements, func(i, j int) bool {
+		return replacements[i].offset > replacements[j].offset
+	})
+	out := append([]byte{}, data...)
+	for _, r := range replacements {
+		out = append(out[:r.offset], append([]byte(r.new), out[r.offset+len(r.old):]...)...)
+	}
+	return out, len(replacements), nil
+}
+
+// reencryptScalar creates the replacement of the encrypted value v
+func reencryptScalar(data []byte, lines []int, v *yaml.Node, oldKey string, newKey string) (yamlReplacement, error) {
+	s, err := decrypt(v.Value, oldKey)
+	if err != nil {
+		return yamlReplacement{}, err
+	}
+	enc, err := encrypt(s, newKey)
+	if err != nil {
+		return yamlReplacement{}, err
+	}
+	r := yamlReplacement{old: v.Value, new: enc}
+	switch v.Style {
+	case yaml.DoubleQuotedStyle:
+		r.old, r.new = `"`+r.old+`"`, `"`+r.new+`"`
+	case yaml.SingleQuotedStyle:
+		r.old, r.new = `'`+r.old+`'`, `'`+r.new+`'`
+	case 0:
+	default:
+		return yamlReplacement{}, fmt.Errorf("unsupported yaml style, use a plain or quoted value")
+	}
+	if v.Line < 1 || v.Line > len(lines) {
+		return yamlReplacement{}, fmt.Errorf("unknown position of value")
+	}
+	// the column counts characters, not bytes
+	offset := lines[v.Line-1]
+	for c := 1; c < v.Column && offset < len(data); c++ {
+		_, size := utf8.DecodeRune(data[offset:])
+		offset += size
+	}
+	if !strings.HasPrefix(string(data[offset:]), r.old) {
+		return yamlReplacement{}, fmt.Errorf("value not found at its position")
+	}
+	r.offset = offset
+	return r, nil
+}
+
+// lineOffsets returns the offset of the beginning of each line in data
+func lineOffsets(data []byte) []int {
+	lines := []int{0}
+	for i, b := range data {
+		if b == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotateKey(t *testing.T) {
+	oldKey := generateKey()
+	pw, _ := encrypt("imap-password", oldKey)
+	web, _ := encrypt("web-password", oldKey)
+	token, _ := encrypt("api-token", oldKey)
+	config := "# eatspam configuration\n" +
+		"imapAccounts:\n" +
+		"  - name: test   # the only account\n" +
+		"    password: " + pw + "\n" +
+		"    host: localhost\n" +
+		"  - name: env\n" +
+		"    password: env:EATSPAM_PASSWORD\n" +
+		"http:\n" +
+		"  # web ui\n" +
+		"  password: \"" + web + "\"\n" +
+		"  apiToken: '" + token + "'\n"
+	dir := t.TempDir()
+	c := &Configuration{
+		ConfigFile: filepath.Join(dir, "eatspam.yaml"),
+		KeyFile:    filepath.Join(dir, "eatspam.key"),
+		TokenFile:  filepath.Join(dir, "eatspam.tokens"),
+		key:        oldKey,
+	}
+	if err := os.WriteFile(c.ConfigFile, []byte(config), 0640); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	tok, _ := encrypt(`{"accessToken":"access"}`, oldKey)
+	if err := saveTokens(c.TokenFile, map[string]string{"test": tok}); err != nil {
+		t.Fatalf("error writing tokens: %v", err)
+	}
+	if err := c.rotateKey(); err != nil {
+		t.Fatalf("error rotating key: %v", err)
+	}
+	b, _ := os.ReadFile(c.KeyFile)
+	if string(b) != c.key || c.key == oldKey {
+		t.Fatalf("expected new key in key file")
+	}
+	b, _ = os.ReadFile(c.KeyFile + ".bak")
+	if string(b) != oldKey {
+		t.Errorf("expected old key in backup")
+	}
+	b, _ = os.ReadFile(c.ConfigFile + ".bak")
+	if string(b) != config {
+		t.Errorf("expected old config in backup")
+	}
+	b, _ = os.ReadFile(c.ConfigFile)
+	rotated := string(b)
+	for _, s := range []string{pw, web, token} {
+		if strings.Contains(rotated, s) {
+			t.Errorf("expected value encrypted with the old key to be replaced")
+		}
+	}
+	// only the encrypted values change
+	oldLines, newLines := strings.Split(config, "\n"), strings.Split(rotated, "\n")
+	if len(oldLines) != len(newLines) {
+		t.Fatalf("expected %d lines, got %d", len(oldLines), len(newLines))
+	}
+	expected := map[int]string{3: "imap-password", 9: "web-password", 10: "api-token"}
+	for i := range oldLines {
+		s, ok := expected[i]
+		if !ok {
+			if oldLines[i] != newLines[i] {
+				t.Errorf("expected unchanged line '%s', got '%s'", oldLines[i], newLines[i])
+			}
+			continue
+		}
+		v := strings.Trim(strings.TrimSpace(newLines[i][strings.Index(newLines[i], ":")+1:]), `"'`)
+		if p, err := decrypt(v, c.key); err != nil || p != s {
+			t.Errorf("expected %s in line %d, got %s: %v", s, i+1, p, err)
+		}
+	}
+	if fi, _ := os.Stat(c.ConfigFile); fi.Mode().Perm() != 0640 {
+		t.Errorf("expected permissions 0640, got %v", fi.Mode().Perm())
+	}
+	tokens, _ := loadTokens(c.TokenFile)
+	if s, err := decrypt(tokens["test"], c.key); err != nil || s != `{"accessToken":"access"}` {
+		t.Errorf("expected token encrypted with the new key, got %s: %v", s, err)
+	}
+}
+
+func TestRotateKeyWrongKey(t *testing.T) {
+	pw, _ := encrypt("imap-password", generateKey())
+	config := "imapAccounts:\n  - name: test\n    password: " + pw + "\n"
+	if _, _, err := reencryptYaml([]byte(config), generateKey(), generateKey()); err == nil {
+		t.Errorf("expected error for a value encrypted with another key")
+	}
+}
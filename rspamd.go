@@ -6,6 +6,7 @@ import (
 	rspamd "github.com/Shopify/go-rspamd/v3"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -20,7 +21,12 @@ func (conf *RspamdConfiguration) rspamdCheckIfSpam(s string, result chan checkSp
 	if err != nil {
 		result <- checkSpamResult{score: 0.0, action: "", err: err}
 	} else {
-		result <- checkSpamResult{score: cr.Score, action: cr.Action, err: nil}
+		symbols := make([]string, 0, len(cr.Symbols))
+		for k := range cr.Symbols {
+			symbols = append(symbols, k)
+		}
+		sort.Strings(symbols)
+		result <- checkSpamResult{score: cr.Score, action: cr.Action, symbols: symbols, err: nil}
 	}
 }
 
@@ -36,7 +42,7 @@ func (conf *RspamdConfiguration) learnHam(body string) error {
 		Header:  http.Header{},
 	}
 	l, err := c.LearnHam(ctx, &lr)
-	if l.Success {
+	if err == nil && l.Success {
 		log.Info("successfully learned ham")
 	}
 	return err
@@ -50,7 +56,7 @@ func (conf *RspamdConfiguration) learnSpam(body string) error {
 		Header:  http.Header{},
 	}
 	l, err := c.LearnSpam(ctx, &lr)
-	if l.Success {
+	if err == nil && l.Success {
 		log.Info("successfully learned spam")
 	}
 	return err
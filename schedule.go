@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// quietHours is a daily window in local time, e.g. 22:00-06:00, in which no mails are rewritten. The window may span
+// midnight.
+type quietHours struct {
+	start int
+	end   int
+}
+
+// parseQuietHours parses a window like 22:00-06:00
+func parseQuietHours(s string) (*quietHours, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("illegal quietHours '%s', expected e.g. 22:00-06:00", s)
+	}
+	q := quietHours{}
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("illegal quietHours '%s', expected e.g. 22:00-06:00", s)
+		}
+		m := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			q.start = m
+		} else {
+			q.end = m
+		}
+	}
+	if q.start == q.end {
+		return nil, fmt.Errorf("illegal quietHours '%s', start and end are equal", s)
+	}
+	return &q, nil
+}
+
+// contains reports if t is in the window
+func (q *quietHours) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// inQuietHours reports if the account must not rewrite mails at t
+func (ic *ImapConfiguration) inQuietHours(t time.Time) bool {
+	return ic.quietHours != nil && ic.quietHours.contains(t)
+}
+
+// isCronExpression reports if the schedule is a cron expression like */5 * * * * or @hourly and not an interval like 5m
+func isCronExpression(schedule string) bool {
+	s := strings.TrimSpace(schedule)
+	return strings.Contains(s, " ") || strings.HasPrefix(s, "@")
+}
+
+// validateSchedule checks an interval like 90s or 5m or a standard cron expression like */2 8-18 * * 1-5
+func validateSchedule(schedule string) error {
+	if isCronExpression(schedule) {
+		if _, err := cron.ParseStandard(schedule); err != nil {
+			return fmt.Errorf("illegal cron expression '%s': %v", schedule, err)
+		}
+		return nil
+	}
+	value, _, err := parseFrequency(schedule)
+	if err != nil || value <= 0 {
+		return fmt.Errorf("illegal interval '%s'. Use a number with the unit s, m, h or d, e.g. 90s or 5m, or a cron expression like */5 * * * *", schedule)
+	}
+	return nil
+}
+
+// scheduleCron replaces the jobs of the scheduler. Accounts with an own schedule get own jobs, all other accounts are
+// checked with the interval. Digests have own jobs.
+func (conf *Configuration) scheduleCron() error {
+	conf.scheduler.Clear()
+	err := conf.addJob(conf.Interval, "sync job", conf.cron)
+	if err != nil {
+		return err
+	}
+	for _, ic := range conf.ImapAccounts {
+		name := ic.Name
+		for _, schedule := range ic.Schedule {
+			err = conf.addJob(schedule, "sync job of account "+name, func() {
+				conf.cronAccount(name)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if ic.Digest.Schedule != "" {
+			err = conf.addJob(digestSchedule(ic.Digest.Schedule), "digest of account "+name, func() {
+				conf.cronDigest(name)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addJob schedules f with an interval or a cron expression. f runs with the read lock of the config.
+func (conf *Configuration) addJob(schedule string, name string, job func()) error {
+	s := conf.scheduler
+	f := func() {
+		conf.confMu.RLock()
+		defer conf.confMu.RUnlock()
+		job()
+	}
+	if isCronExpression(schedule) {
+		log.Infof("Start %s with cron expression '%s'", name, schedule)
+		_, err := s.Cron(schedule).Do(f)
+		return err
+	}
+	value, unit, err := parseFrequency(schedule)
+	if err != nil {
+		return fmt.Errorf("illegal interval '%s'", schedule)
+	}
+	switch unit {
+	case "s":
+		log.Infof("Start %s every %d %s", name, value, "seconds")
+		_, err = s.Every(value).Seconds().Do(f)
+	case "m":
+		log.Infof("Start %s every %d %s", name, value, "minutes")
+		_, err = s.Every(value).Minutes().Do(f)
+	case "h":
+		log.Infof("Start %s every %d %s", name, value, "hours")
+		_, err = s.Every(value).Hours().Do(f)
+	case "d":
+		log.Infof("Start %s every %d %s", name, value, "days")
+		_, err = s.Every(value).Days().Do(f)
+	}
+	return err
+}
+
+// cronAccount checks an account with an own schedule
+func (conf *Configuration) cronAccount(name string) {
+	ic := conf.accountByName(name)
+	if ic == nil {
+		return
+	}
+	if _, ok := conf.runScan(ic); !ok {
+		log.Infof("spamchecker still working. Skipping the run of account %s.", name)
+	}
+}
+
+// scheduledAccounts returns the accounts checked with the interval
+func (conf *Configuration) scheduledAccounts() []*ImapConfiguration {
+	accounts := make([]*ImapConfiguration, 0)
+	for _, ic := range conf.ImapAccounts {
+		if len(ic.Schedule) == 0 {
+			accounts = append(accounts, ic)
+		}
+	}
+	return accounts
+}
+
+// scheduleSignature describes the jobs of the scheduler. The jobs are only replaced on a reload if it changes.
+func (conf *Configuration) scheduleSignature() string {
+	s := conf.Interval
+	for _, ic := range conf.ImapAccounts {
+		if len(ic.Schedule) > 0 {
+			s += "\n" + ic.Name + ": " + strings.Join(ic.Schedule, "; ")
+		}
+		if ic.Digest.Schedule != "" {
+			s += "\n" + ic.Name + " digest: " + ic.Digest.Schedule
+		}
+	}
+	return s
+}
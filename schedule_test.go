@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/go-co-op/gocron"
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	at := func(hour int, min int) time.Time {
+		return time.Date(2024, 3, 1, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		window   string
+		t        time.Time
+		expected bool
+	}{
+		{"22:00-06:00", at(23, 30), true},
+		{"22:00-06:00", at(2, 0), true},
+		{"22:00-06:00", at(6, 0), false},
+		{"22:00-06:00", at(12, 0), false},
+		{"08:30-17:00", at(8, 30), true},
+		{"08:30-17:00", at(8, 29), false},
+		{"08:30-17:00", at(17, 0), false},
+	}
+	for _, test := range tests {
+		q, err := parseQuietHours(test.window)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", test.window, err)
+		}
+		if q.contains(test.t) != test.expected {
+			t.Errorf("expected %v for %s at %s", test.expected, test.window, test.t.Format("15:04"))
+		}
+	}
+	for _, illegal := range []string{"", "22:00", "22-06", "25:00-06:00", "06:00-06:00"} {
+		if _, err := parseQuietHours(illegal); err == nil {
+			t.Errorf("expected error for '%s'", illegal)
+		}
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	for _, valid := range []string{"90s", "5m", "1h", "1d", "*/2 8-18 * * 1-5", "*/30 0-7,19-23 * * *", "@hourly"} {
+		if err := validateSchedule(valid); err != nil {
+			t.Errorf("expected '%s' to be valid: %v", valid, err)
+		}
+	}
+	for _, illegal := range []string{"90", "0m", "5x", "*/2 8-18 * *", "61 * * * *"} {
+		if err := validateSchedule(illegal); err == nil {
+			t.Errorf("expected error for '%s'", illegal)
+		}
+	}
+}
+
+func TestScheduleCron(t *testing.T) {
+	c := setupTestConfiguration()
+	c.Interval = "5m"
+	c.ImapAccounts = []*ImapConfiguration{
+		{Name: "alice"},
+		{Name: "bob", Schedule: []string{"*/2 8-18 * * 1-5", "*/30 0-7,19-23 * * *"}},
+	}
+	c.scheduler = gocron.NewScheduler(time.Local)
+	if err := c.scheduleCron(); err != nil {
+		t.Fatalf("error scheduling: %v", err)
+	}
+	if n := len(c.scheduler.Jobs()); n != 3 {
+		t.Errorf("expected 3 jobs, got %d", n)
+	}
+	if accounts := c.scheduledAccounts(); len(accounts) != 1 || accounts[0].Name != "alice" {
+		t.Errorf("expected only alice with the interval, got %v", accounts)
+	}
+}
+
+func TestQuietHoursDeferRewrite(t *testing.T) {
+	c := setupTestConfiguration()
+	q, _ := parseQuietHours(time.Now().Add(-time.Hour).Format("15:04") + "-" + time.Now().Add(time.Hour).Format("15:04"))
+	ic := &ImapConfiguration{Name: "test", quietHours: q}
+	rr := RunResult{Actions: map[string]int{}}
+	// the account has no connection, a rewrite would fail
+	ic.processMessage(c, &rr, &scannedMessage{id: 1, result: checkSpamResult{action: spamActionAddHeader, score: 7}})
+	if rr.Deferred != 1 || rr.Checked != 1 || len(rr.Actions) != 0 {
+		t.Errorf("expected deferred rewrite, got %v", rr)
+	}
+}
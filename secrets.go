@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	secretPrefixEnv  = "env:"
+	secretPrefixFile = "file:"
+	secretPrefixExec = "exec:"
+	secretExecTime   = 30 * time.Second
+)
+
+// resolveSecret returns the plain value of a secret in the configuration. A secret is one of
+//
+//	env:NAME                 the value of the environment variable NAME
+//	file:/run/secrets/name   the content of the file without trailing line breaks
+//	exec:command args        the output of the command without trailing line breaks
+//	<hex>                    a value encrypted with the key file (eatspam --encrypt)
+//
+// The command of exec is split at whitespace and run without a shell. Quotes and backslashes are refused, as they would
+// be passed on literally.
+func resolveSecret(value string, key string) (string, error) {
+	switch {
+	case value == "":
+		return "", nil
+	case strings.HasPrefix(value, secretPrefixEnv):
+		name := strings.TrimPrefix(value, secretPrefixEnv)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return s, nil
+	case strings.HasPrefix(value, secretPrefixFile):
+		name := strings.TrimPrefix(value, secretPrefixFile)
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("error reading secret file: %v", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(value, secretPrefixExec):
+		command := strings.TrimPrefix(value, secretPrefixExec)
+		if strings.ContainsAny(command, `"'\`) {
+			return "", fmt.Errorf("exec secret with quotes or backslashes, shell quoting is not supported. Use a script")
+		}
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return "", fmt.Errorf("exec secret without command")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretExecTime)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("error executing secret command %s: %v", args[0], err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return decrypt(value, key)
+}
+
+// isSecretReference reports if value is a reference to a secret and not an encrypted value
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, secretPrefixEnv) ||
+		strings.HasPrefix(value, secretPrefixFile) ||
+		strings.HasPrefix(value, secretPrefixExec)
+}
+
+// resolveSecrets resolves all secrets of the configuration. It is called once at startup.
+func (conf *Configuration) resolveSecrets() error {
+	var err error
+	conf.Http.password, err = resolveSecret(conf.Http.Password, conf.key)
+	if err != nil {
+		return fmt.Errorf("error resolving http password: %v", err)
+	}
+	conf.Http.apiToken, err = resolveSecret(conf.Http.ApiToken, conf.key)
+	if err != nil {
+		return fmt.Errorf("error resolving http api token: %v", err)
+	}
+	conf.Smtp.password, err = resolveSecret(conf.Smtp.Password, conf.key)
+	if err != nil {
+		return fmt.Errorf("error resolving smtp password: %v", err)
+	}
+	for _, ic := range conf.ImapAccounts {
+		err = ic.resolveSecrets(conf.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveSecrets resolves password, client secret and refresh token of the account
+func (ic *ImapConfiguration) resolveSecrets(key string) error {
+	var err error
+	ic.password, err = resolveSecret(ic.Password, key)
+	if err != nil {
+		return fmt.Errorf("error resolving password of account %s: %v", ic.Name, err)
+	}
+	ic.Auth.clientSecret, err = resolveSecret(ic.Auth.ClientSecret, key)
+	if err != nil {
+		return fmt.Errorf("error resolving client secret of account %s: %v", ic.Name, err)
+	}
+	ic.Auth.refreshToken, err = resolveSecret(ic.Auth.RefreshToken, key)
+	if err != nil {
+		return fmt.Errorf("error resolving refresh token of account %s: %v", ic.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	key := generateKey()
+	enc, err := encrypt("encrypted", key)
+	if err != nil {
+		t.Fatalf("error encrypting: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("error writing secret file: %v", err)
+	}
+	t.Setenv("EATSPAM_TEST_SECRET", "from-env")
+	tests := map[string]string{
+		"":                          "",
+		enc:                         "encrypted",
+		"env:EATSPAM_TEST_SECRET":   "from-env",
+		"file:" + file:              "from-file",
+		"exec:echo from-exec":       "from-exec",
+		"exec:printf from-exec\r\n": "from-exec",
+	}
+	for value, expected := range tests {
+		s, err := resolveSecret(value, key)
+		if err != nil {
+			t.Errorf("error resolving '%s': %v", value, err)
+		} else if s != expected {
+			t.Errorf("expected '%s' for '%s', got '%s'", expected, value, s)
+		}
+	}
+	for _, value := range []string{"env:EATSPAM_TEST_UNSET", "file:" + file + ".missing", "exec:", "exec:false",
+		`exec:echo "from exec"`, `exec:cat /run/my\ secret`, "no-hex"} {
+		if _, err := resolveSecret(value, key); err == nil {
+			t.Errorf("expected error resolving '%s'", value)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	cookieSession    = "eatspam_session"
+	csrfField        = "csrf"
+	maxLoginFailures = 5
+	loginBlockTime   = time.Minute
+	maxLoginBlock    = time.Hour
+)
+
+// session is a login to the web ui. Only the random id is sent to the browser.
+type session struct {
+	id       string
+	csrf     string
+	user     *webUser
+	created  time.Time
+	expires  time.Time
+	mu       sync.Mutex
+	flash    flash
+	scanning bool
+}
+
+// flash is a message shown once on the next page of a session
+type flash struct {
+	text string
+	kind string
+}
+
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// loginFailure counts the failed logins of a client
+type loginFailure struct {
+	count int
+	until time.Time
+	last  time.Time
+}
+
+type loginLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailure
+}
+
+var (
+	sessions = sessionStore{sessions: map[string]*session{}}
+	logins   = loginLimiter{failures: map[string]*loginFailure{}}
+)
+
+// randomToken returns 32 random bytes in hex
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// create starts a new session of the user which expires after timeout without a request
+func (ss *sessionStore) create(u *webUser, timeout time.Duration) *session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	now := time.Now()
+	for id, s := range ss.sessions {
+		if now.After(s.expires) {
+			delete(ss.sessions, id)
+		}
+	}
+	s := &session{id: randomToken(), csrf: randomToken(), user: u, created: now, expires: now.Add(timeout)}
+	ss.sessions[s.id] = s
+	return s
+}
+
+// get returns the valid session with the id and extends it by timeout
+func (ss *sessionStore) get(id string, timeout time.Duration) *session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.sessions[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.expires) {
+		delete(ss.sessions, id)
+		return nil
+	}
+	s.expires = time.Now().Add(timeout)
+	return s
+}
+
+// revoke ends the session with the id
+func (ss *sessionStore) revoke(id string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.sessions, id)
+}
+
+// refreshUsers updates the users of the sessions after a reload of the config. Sessions of removed users end.
+func (ss *sessionStore) refreshUsers(conf *Configuration) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for id, s := range ss.sessions {
+		if u := conf.userByName(s.user.name); u != nil {
+			s.user = u.webUser()
+		} else if s.user.name != legacyUser || conf.Http.password == "" {
+			delete(ss.sessions, id)
+		}
+	}
+}
+
+// setFlash stores a message of the kind success, warning or danger for the next page of the session
+func (s *session) setFlash(text string, kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flash = flash{text: text, kind: kind}
+}
+
+// takeFlash returns the message for the page and removes it from the session
+func (s *session) takeFlash() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.flash
+	s.flash = flash{}
+	return f.text, f.kind
+}
+
+// setScanning marks a scan now of the session as running or finished
+func (s *session) setScanning(scanning bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scanning = scanning
+}
+
+// isScanning reports if a scan now of the session is running
+func (s *session) isScanning() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scanning
+}
+
+// validCsrf checks the csrf token of a form against the token of the session
+func (s *session) validCsrf(r *http.Request) bool {
+	token := r.PostFormValue(csrfField)
+	return token != "" && constantTimeEqual(token, s.csrf)
+}
+
+func constantTimeEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// blocked returns the time until the client may try to log in again
+func (ll *loginLimiter) blocked(client string) time.Duration {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if f, ok := ll.failures[client]; ok {
+		return time.Until(f.until)
+	}
+	return 0
+}
+
+// failed counts a failed login. After maxLoginFailures the client is blocked, the block time doubles with every further
+// failure up to maxLoginBlock.
+func (ll *loginLimiter) failed(client string) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	now := time.Now()
+	for c, f := range ll.failures {
+		if now.Sub(f.last) > maxLoginBlock {
+			delete(ll.failures, c)
+		}
+	}
+	f, ok := ll.failures[client]
+	if !ok {
+		f = &loginFailure{}
+		ll.failures[client] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= maxLoginFailures {
+		d := loginBlockTime << (f.count - maxLoginFailures)
+		if d > maxLoginBlock || d <= 0 {
+			d = maxLoginBlock
+		}
+		f.until = now.Add(d)
+	}
+}
+
+// succeeded resets the failed logins of the client
+func (ll *loginLimiter) succeeded(client string) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	delete(ll.failures, client)
+}
+
+// setSessionCookie sends the session id to the browser. An empty id deletes the cookie.
+func (conf *Configuration) setSessionCookie(w http.ResponseWriter, r *http.Request, id string) {
+	c := http.Cookie{
+		Name:     cookieSession,
+		Value:    id,
+		Path:     conf.url("/"),
+		HttpOnly: true,
+		Secure:   conf.isHttps(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if id == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, &c)
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// emptyActionRows is the number of empty rows in the action table of the settings page for new thresholds
+const emptyActionRows = 2
+
+var (
+	actionNames   = []string{spamActionNoAction, spamActionGreylist, spamActionAddHeader, spamActionRewriteSubject, spamActionSoftReject, spamActionReject}
+	strategyNames = []string{strategyAverage, strategyLowest, strategyHighest, strategySpamd, strategyRspamd}
+	tlsModes      = []string{tlsModeImplicit, tlsModeStarttls, tlsModeNone}
+	behaviours    = []string{behaviourUnseen, behaviourEatspam, behaviourAll}
+	largePolicies = []string{largeMessageSkip, largeMessageTruncate}
+)
+
+type ActionRow struct {
+	Score  string
+	Action string
+}
+
+type SettingsData struct {
+	Page          string
+	Csrf          string
+	User          string
+	Admin         bool
+	MessageText   string
+	MessageType   string
+	Configuration *Configuration
+	Actions       []ActionRow
+	ActionNames   []string
+	Strategies    []string
+}
+
+type AccountEditData struct {
+	Page          string
+	Csrf          string
+	User          string
+	Admin         bool
+	MessageText   string
+	MessageType   string
+	Original      string
+	Password      string
+	Account       *ImapConfiguration
+	Mailboxes     []string
+	TlsModes      []string
+	Behaviours    []string
+	LargePolicies []string
+}
+
+// checkAdmin returns the session of an admin. Other users get a 403.
+func (conf *Configuration) checkAdmin(w http.ResponseWriter, r *http.Request, s *session) *session {
+	if s == nil {
+		return nil
+	}
+	if !s.user.isAdmin() {
+		log.Warnf("user %s is not allowed to access %s", s.user.name, r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Forbidden")
+		conf.pushRequests(r, http.StatusForbidden)
+		return nil
+	}
+	return s
+}
+
+// handleSettings handles the forms of the settings pages
+//
+//	POST /settings/backends        backends, strategy and actions
+//	POST /settings/account         add or change an account
+//	POST /settings/account/test    test the connection of the account in the form
+//	POST /settings/account/delete  remove an account
+func (conf *Configuration) handleSettings(w http.ResponseWriter, r *http.Request) {
+	s := conf.checkAdmin(w, r, conf.checkPost(w, r))
+	if s == nil {
+		return
+	}
+	switch r.URL.Path {
+	case "/settings/backends":
+		err := conf.saveBackends(r)
+		conf.settingsResult(w, r, s, err, conf.url("/settings.html"))
+	case "/settings/account":
+		original := r.PostFormValue("original")
+		ic, err := conf.accountFromForm(r)
+		if err == nil {
+			err = conf.saveAccount(original, ic, strings.TrimSpace(r.PostFormValue("password")))
+		}
+		if err != nil {
+			conf.renderAccountEdit(w, r, s, original, ic, nil, err)
+			return
+		}
+		conf.settingsResult(w, r, s, nil, conf.url("/settings.html"))
+	case "/settings/account/test":
+		original := r.PostFormValue("original")
+		ic, err := conf.accountFromForm(r)
+		var mailboxes []string
+		if err == nil {
+			mailboxes, err = ic.testConnection(conf.key)
+		}
+		conf.renderAccountEdit(w, r, s, original, ic, mailboxes, err)
+	case "/settings/account/delete":
+		err := conf.deleteAccount(r.PostFormValue("a"))
+		conf.settingsResult(w, r, s, err, conf.url("/settings.html"))
+	default:
+		conf.renderNotFound(w, r)
+	}
+}
+
+// settingsResult reports the result of a change on the page
+func (conf *Configuration) settingsResult(w http.ResponseWriter, r *http.Request, s *session, err error, page string) {
+	if err != nil {
+		log.Errorf("error saving settings: %v", err)
+		s.setFlash(err.Error(), "danger")
+	} else {
+		log.Infof("settings saved to %s", conf.ConfigFile)
+		s.setFlash(fmt.Sprintf("Saved to %s. The changes are applied after the current run.", conf.ConfigFile), "success")
+	}
+	http.Redirect(w, r, page, http.StatusFound)
+	conf.pushRequests(r, http.StatusFound)
+}
+
+func (conf *Configuration) renderSettings(w http.ResponseWriter, r *http.Request, s *session) {
+	t, err := conf.parseTemplates(templateDir+r.URL.Path, templateDir+"/navbar.html")
+	if err != nil {
+		log.Errorf("error parsing template %s: %v", r.URL.Path, err)
+		conf.renderServerError(w, r)
+		return
+	}
+	scores := make([]float64, 0)
+	for score := range conf.Actions {
+		scores = append(scores, score)
+	}
+	sort.Float64s(scores)
+	rows := make([]ActionRow, 0)
+	for _, score := range scores {
+		rows = append(rows, ActionRow{Score: formatScore(score), Action: conf.Actions[score]})
+	}
+	for i := 0; i < emptyActionRows; i++ {
+		rows = append(rows, ActionRow{})
+	}
+	text, kind := s.takeFlash()
+	err = t.Execute(w, SettingsData{
+		Page:          "settings",
+		Csrf:          s.csrf,
+		User:          s.user.name,
+		Admin:         true,
+		MessageText:   text,
+		MessageType:   kind,
+		Configuration: conf,
+		Actions:       rows,
+		ActionNames:   actionNames,
+		Strategies:    strategyNames,
+	})
+	if err != nil {
+		log.Errorf("error executing settings template: %v", err)
+	}
+}
+
+// renderAccountEdit shows the form of an account. The mailboxes are offered for inbox and spam folder.
+func (conf *Configuration) renderAccountEdit(w http.ResponseWriter, r *http.Request, s *session, original string, ic *ImapConfiguration, mailboxes []string, err error) {
+	t, terr := conf.parseTemplates(templateDir+"/accountEdit.html", templateDir+"/navbar.html")
+	if terr != nil {
+		log.Errorf("error parsing template accountEdit.html: %v", terr)
+		conf.renderServerError(w, r)
+		return
+	}
+	d := AccountEditData{
+		Page:          "settings",
+		Csrf:          s.csrf,
+		User:          s.user.name,
+		Admin:         true,
+		Original:      original,
+		Account:       ic,
+		Mailboxes:     mailboxes,
+		TlsModes:      tlsModes,
+		Behaviours:    behaviours,
+		LargePolicies: largePolicies,
+	}
+	if d.Account == nil {
+		d.Account = &ImapConfiguration{}
+	}
+	if r.Method == http.MethodPost {
+		// keep the typed password for the next submit of the form
+		d.Password = r.PostFormValue("password")
+	}
+	switch {
+	case err != nil:
+		d.MessageText, d.MessageType = err.Error(), "danger"
+	case mailboxes != nil && r.Method == http.MethodPost:
+		d.MessageText, d.MessageType = fmt.Sprintf("Connection successful, found %d mailboxes.", len(mailboxes)), "success"
+	}
+	terr = t.Execute(w, &d)
+	if terr != nil {
+		log.Errorf("error executing accountEdit template: %v", terr)
+	}
+}
+
+// handleAccountEdit shows the form of the account a or an empty form for a new account
+func (conf *Configuration) handleAccountEdit(w http.ResponseWriter, r *http.Request, s *session) {
+	a := r.URL.Query().Get("a")
+	if a == "" {
+		conf.renderAccountEdit(w, r, s, "", &ImapConfiguration{TlsMode: defaultImapTlsMode, Inbox: defaultImapInbox, SpamFolder: defaultImapSpamFolder, InboxBehaviour: defaultInboxBehaviour}, nil, nil)
+		return
+	}
+	ic := conf.accountByName(a)
+	if ic == nil {
+		conf.renderNotFound(w, r)
+		return
+	}
+	var mailboxes []string
+	err := ic.tryOpenSession(conf.key)
+	if err == nil {
+		mailboxes, err = ic.mailboxNames()
+		ic.closeSession()
+	}
+	if err != nil {
+		log.Warnf("error getting mailboxes of %s: %v", ic.Name, err)
+		err = fmt.Errorf("mailboxes not available: %v", err)
+	}
+	conf.renderAccountEdit(w, r, s, a, ic, mailboxes, err)
+}
+
+// accountFromForm creates the account of the form. TLS and authentication settings are taken from the existing account.
+// The stored password is only kept for the same host and username. The form only accepts literal passwords, secret
+// references run commands or read files on the host, so only the unchanged reference of the config file is accepted.
+func (conf *Configuration) accountFromForm(r *http.Request) (*ImapConfiguration, error) {
+	f := func(name string) string {
+		return strings.TrimSpace(r.PostFormValue(name))
+	}
+	ic := &ImapConfiguration{
+		Name:           f("name"),
+		Username:       f("username"),
+		Host:           f("host"),
+		TlsMode:        f("tlsMode"),
+		Inbox:          f("inbox"),
+		SpamFolder:     f("spamFolder"),
+		InboxBehaviour: f("inboxBehaviour"),
+		MaxMessageSize: f("maxMessageSize"),
+		LargeMessages:  f("largeMessages"),
+		tokenFile:      conf.TokenFile,
+	}
+	old := conf.accountByName(f("original"))
+	if old != nil {
+		ic.TlsConfig = old.TlsConfig
+		ic.Auth = old.Auth
+		if ic.Host == old.Host && ic.Username == old.Username {
+			ic.password = old.password
+		}
+	}
+	if ic.Auth.Method == "" {
+		ic.Auth.Method = authPassword
+	}
+	pw := f("password")
+	switch {
+	case isSecretReference(pw):
+		if old == nil || pw != old.Password {
+			return ic, fmt.Errorf("secret references can only be set in the config file, enter the password")
+		}
+	case pw != "":
+		ic.password = pw
+	}
+	if ic.password == "" && old != nil && !isOauth(ic.Auth.Method) {
+		return ic, fmt.Errorf("enter the password again for the changed host or username")
+	}
+	if p := f("port"); p != "" {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return ic, fmt.Errorf("illegal port '%s'", p)
+		}
+		ic.Port = port
+	}
+	if ic.Port == 0 {
+		ic.Port = defaultImapPort
+		if ic.TlsMode != tlsModeImplicit {
+			ic.Port = defaultImapPlainPort
+		}
+	}
+	switch {
+	case ic.Name == "" || ic.Host == "" || ic.Username == "":
+		return ic, fmt.Errorf("name, username and host are needed")
+	case !contains(tlsModes, ic.TlsMode):
+		return ic, fmt.Errorf("unknown tls mode '%s'", ic.TlsMode)
+	case ic.TlsMode == tlsModeNone && !isLoopback(ic.Host):
+		return ic, fmt.Errorf("tls mode %s is only allowed for localhost", tlsModeNone)
+	case !contains(behaviours, ic.InboxBehaviour):
+		return ic, fmt.Errorf("unknown inbox behaviour '%s'", ic.InboxBehaviour)
+	case ic.LargeMessages != "" && !contains(largePolicies, ic.LargeMessages):
+		return ic, fmt.Errorf("unknown policy for large messages '%s'", ic.LargeMessages)
+	}
+	if ic.MaxMessageSize != "" {
+		if _, err := parseSize(ic.MaxMessageSize); err != nil {
+			return ic, err
+		}
+	}
+	return ic, nil
+}
+
+// saveAccount writes the account to the configuration file. original is the name of the changed account or empty for
+// a new account. The password is encrypted, an empty password or the unchanged secret reference keeps the configured one.
+func (conf *Configuration) saveAccount(original string, ic *ImapConfiguration, password string) error {
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+	doc, err := loadConfigNode(conf.ConfigFile)
+	if err != nil {
+		return err
+	}
+	root := doc.Content[0]
+	seq := mappingValue(root, "imapAccounts")
+	if seq == nil || seq.Kind != yaml.SequenceNode {
+		seq = &yaml.Node{Kind: yaml.SequenceNode}
+		setMappingValue(root, "imapAccounts", seq)
+	}
+	var m *yaml.Node
+	for _, item := range seq.Content {
+		name := ""
+		if n := mappingValue(item, "name"); n != nil {
+			name = n.Value
+		}
+		if original != "" && name == original {
+			m = item
+		} else if name == ic.Name {
+			return fmt.Errorf("an account with the name %s already exists", ic.Name)
+		}
+	}
+	if m == nil {
+		if original != "" {
+			return fmt.Errorf("account %s not found in %s", original, conf.ConfigFile)
+		}
+		if password == "" && ic.Auth.Method == authPassword {
+			return fmt.Errorf("a password is needed for a new account")
+		}
+		m = &yaml.Node{Kind: yaml.MappingNode}
+		seq.Content = append(seq.Content, m)
+	}
+	setScalar(m, "name", "!!str", ic.Name)
+	setScalar(m, "username", "!!str", ic.Username)
+	if password != "" && !isSecretReference(password) {
+		password, err = encrypt(password, conf.key)
+		if err != nil {
+			return fmt.Errorf("error encrypting password: %v", err)
+		}
+		setScalar(m, "password", "!!str", password)
+	}
+	setScalar(m, "host", "!!str", ic.Host)
+	setScalar(m, "port", "!!int", strconv.Itoa(ic.Port))
+	deleteMappingValue(m, "tls")
+	setScalar(m, "tlsMode", "!!str", ic.TlsMode)
+	setScalar(m, "inbox", "!!str", ic.Inbox)
+	setScalar(m, "spamFolder", "!!str", ic.SpamFolder)
+	setScalar(m, "inboxBehaviour", "!!str", ic.InboxBehaviour)
+	setScalar(m, "maxMessageSize", "!!str", ic.MaxMessageSize)
+	setScalar(m, "largeMessages", "!!str", ic.LargeMessages)
+	if original != "" && original != ic.Name {
+		renameUserAccount(root, original, ic.Name)
+	}
+	return saveConfigNode(conf.ConfigFile, doc)
+}
+
+// deleteAccount removes the account from the configuration file and from the accounts of the users
+func (conf *Configuration) deleteAccount(name string) error {
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+	doc, err := loadConfigNode(conf.ConfigFile)
+	if err != nil {
+		return err
+	}
+	root := doc.Content[0]
+	seq := mappingValue(root, "imapAccounts")
+	if seq != nil {
+		for i, item := range seq.Content {
+			if n := mappingValue(item, "name"); n != nil && n.Value == name {
+				seq.Content = append(seq.Content[:i], seq.Content[i+1:]...)
+				renameUserAccount(root, name, "")
+				return saveConfigNode(conf.ConfigFile, doc)
+			}
+		}
+	}
+	return fmt.Errorf("account %s not found in %s", name, conf.ConfigFile)
+}
+
+// renameUserAccount renames an account in the account lists of the users. An empty name removes the account.
+func renameUserAccount(root *yaml.Node, old string, name string) {
+	h := mappingValue(root, "http")
+	if h == nil {
+		return
+	}
+	users := mappingValue(h, "users")
+	if users == nil {
+		return
+	}
+	for _, u := range users.Content {
+		accounts := mappingValue(u, "accounts")
+		if accounts == nil {
+			continue
+		}
+		content := make([]*yaml.Node, 0)
+		for _, a := range accounts.Content {
+			if a.Value == old {
+				if name == "" {
+					continue
+				}
+				a.Value = name
+			}
+			content = append(content, a)
+		}
+		accounts.Content = content
+	}
+}
+
+// saveBackends writes the backends, the strategy and the actions of the form to the configuration file
+func (conf *Configuration) saveBackends(r *http.Request) error {
+	strategy := r.PostFormValue("strategy")
+	if err := validateBackends(r.PostFormValue("spamdUse") != "", r.PostFormValue("rspamdUse") != "", strategy); err != nil {
+		return err
+	}
+	actions := &yaml.Node{Kind: yaml.MappingNode}
+	scores := r.PostForm["score"]
+	names := r.PostForm["action"]
+	seen := map[float64]bool{}
+	for i, s := range scores {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		score, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("illegal score '%s'", s)
+		}
+		if seen[score] {
+			return fmt.Errorf("score %s is used twice", s)
+		}
+		seen[score] = true
+		if i >= len(names) || !contains(actionNames, names[i]) {
+			return fmt.Errorf("unknown action for score %s", s)
+		}
+		actions.Content = append(actions.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: formatScore(score)},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: names[i]})
+	}
+	if len(actions.Content) == 0 {
+		return fmt.Errorf("at least one action is needed")
+	}
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+	doc, err := loadConfigNode(conf.ConfigFile)
+	if err != nil {
+		return err
+	}
+	root := doc.Content[0]
+	for _, backend := range []string{"spamd", "rspamd"} {
+		m := mappingNode(root, backend)
+		port := strings.TrimSpace(r.PostFormValue(backend + "Port"))
+		if p, err := strconv.Atoi(port); port != "" && (err != nil || p < 1 || p > 65535) {
+			return fmt.Errorf("illegal port '%s' for %s", port, backend)
+		}
+		setScalar(m, "use", "!!bool", strconv.FormatBool(r.PostFormValue(backend+"Use") != ""))
+		setScalar(m, "host", "!!str", strings.TrimSpace(r.PostFormValue(backend+"Host")))
+		setScalar(m, "port", "!!int", port)
+	}
+	setScalar(root, "strategy", "!!str", strategy)
+	setMappingValue(root, "actions", actions)
+	return saveConfigNode(conf.ConfigFile, doc)
+}
+
+// formatScore formats a threshold as float, e.g. 4.0 or 4.25
+func formatScore(score float64) string {
+	s := strconv.FormatFloat(score, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
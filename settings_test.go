@@ -0,0 +1,236 @@
+package main
+
+import (
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const settingsTestConfig = `# eatspam test configuration
+imapAccounts:
+  - name: alice-mail
+    username: alice
+    password: env:ALICE_PASSWORD
+    host: imap.example.com
+    tls: false
+    tlsConfig:
+      insecureSkipVerify: true
+  - name: bob-mail
+    username: bob
+    password: env:BOB_PASSWORD
+    host: imap.example.com
+http:
+  users:
+    - name: alice
+      accounts:
+        - alice-mail
+        - bob-mail
+# thresholds
+actions:
+  5.0: add header
+`
+
+func setupSettingsConfiguration(t *testing.T) *Configuration {
+	c := setupUsersConfiguration(t)
+	c.key = testKey
+	c.ConfigFile = filepath.Join(t.TempDir(), "eatspam.yaml")
+	if err := os.WriteFile(c.ConfigFile, []byte(settingsTestConfig), 0640); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	return c
+}
+
+func readConfig(t *testing.T, c *Configuration) string {
+	b, err := os.ReadFile(c.ConfigFile)
+	if err != nil {
+		t.Fatalf("error reading config: %v", err)
+	}
+	return string(b)
+}
+
+// loadSavedConfig parses the saved configuration file
+func loadSavedConfig(t *testing.T, c *Configuration) *Configuration {
+	conf := Configuration{}
+	if err := yaml.Unmarshal([]byte(readConfig(t, c)), &conf); err != nil {
+		t.Fatalf("error parsing saved config: %v", err)
+	}
+	return &conf
+}
+
+func TestSaveAccount(t *testing.T) {
+	c := setupSettingsConfiguration(t)
+	ic := &ImapConfiguration{Name: "alice-new", Username: "alice", Host: "mail.example.com", Port: 143, TlsMode: tlsModeStarttls, Inbox: "INBOX", SpamFolder: "Junk", InboxBehaviour: behaviourUnseen}
+	if err := c.saveAccount("alice-mail", ic, "secret"); err != nil {
+		t.Fatalf("error saving account: %v", err)
+	}
+	s := readConfig(t, c)
+	if strings.Contains(s, "secret") || strings.Contains(s, "ALICE_PASSWORD") || strings.Contains(s, "tls: false") || !strings.Contains(s, "insecureSkipVerify: true") {
+		t.Errorf("expected encrypted password, tlsMode instead of tls and the kept tlsConfig:\n%s", s)
+	}
+	if !strings.Contains(s, "# eatspam test configuration") || !strings.Contains(s, "# thresholds") {
+		t.Errorf("expected comments to be kept:\n%s", s)
+	}
+	if !strings.Contains(s, "- alice-new\n") || strings.Contains(s, "- alice-mail\n") {
+		t.Errorf("expected renamed account in the users:\n%s", s)
+	}
+	if fi, err := os.Stat(c.ConfigFile); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("expected permissions to be kept")
+	}
+	if _, err := os.Stat(c.ConfigFile + ".bak"); err != nil {
+		t.Errorf("expected backup of the config: %v", err)
+	}
+	conf := loadSavedConfig(t, c)
+	if a := conf.accountByName("alice-new"); a == nil || a.Host != "mail.example.com" || a.SpamFolder != "Junk" {
+		t.Errorf("expected changed account, got %v", a)
+	}
+	if pw, err := decrypt(conf.accountByName("alice-new").Password, testKey); err != nil || pw != "secret" {
+		t.Errorf("expected encrypted password, got %s %v", pw, err)
+	}
+	if err := c.saveAccount("", &ImapConfiguration{Name: "bob-mail", Auth: ImapAuthConfiguration{Method: authPassword}}, "x"); err == nil {
+		t.Errorf("expected error for a duplicate account")
+	}
+	if err := c.saveAccount("", &ImapConfiguration{Name: "carol-mail", Auth: ImapAuthConfiguration{Method: authPassword}}, ""); err == nil {
+		t.Errorf("expected error for a new account without password")
+	}
+}
+
+func TestAccountFromFormPassword(t *testing.T) {
+	c := setupSettingsConfiguration(t)
+	old := c.accountByName("alice-mail")
+	old.Username, old.Password, old.password = "alice", "env:ALICE_PASSWORD", "stored"
+	form := func(host string, password string) *http.Request {
+		f := url.Values{
+			"original": {"alice-mail"}, "name": {"alice-mail"}, "username": {"alice"}, "host": {host},
+			"tlsMode": {tlsModeImplicit}, "inboxBehaviour": {behaviourUnseen}, "password": {password},
+		}
+		r := httptest.NewRequest(http.MethodPost, "/settings/account/test", strings.NewReader(f.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	for _, pw := range []string{"", "env:ALICE_PASSWORD"} {
+		if ic, err := c.accountFromForm(form("imap.example.com", pw)); err != nil || ic.password != "stored" {
+			t.Errorf("expected the stored password for '%s', got %s (%v)", pw, ic.password, err)
+		}
+		if _, err := c.accountFromForm(form("evil.example.com", pw)); err == nil {
+			t.Errorf("expected the stored password not to be sent to a changed host for '%s'", pw)
+		}
+	}
+	for _, pw := range []string{"exec:id", "file:/etc/passwd", "env:HOME"} {
+		if _, err := c.accountFromForm(form("imap.example.com", pw)); err == nil {
+			t.Errorf("expected error for the secret reference %s", pw)
+		}
+	}
+	if ic, err := c.accountFromForm(form("evil.example.com", "typed")); err != nil || ic.password != "typed" {
+		t.Errorf("expected the typed password, got %s (%v)", ic.password, err)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	c := setupSettingsConfiguration(t)
+	if err := c.deleteAccount("bob-mail"); err != nil {
+		t.Fatalf("error deleting account: %v", err)
+	}
+	s := readConfig(t, c)
+	if strings.Contains(s, "bob") {
+		t.Errorf("expected bob-mail to be removed:\n%s", s)
+	}
+	if err := c.deleteAccount("bob-mail"); err == nil {
+		t.Errorf("expected error for an unknown account")
+	}
+}
+
+func TestSaveBackends(t *testing.T) {
+	c := setupSettingsConfiguration(t)
+	form := url.Values{
+		"rspamdUse":  {"on"},
+		"rspamdHost": {"rspamd"},
+		"rspamdPort": {"11333"},
+		"strategy":   {strategyRspamd},
+		"score":      {"4", "", "12.5"},
+		"action":     {spamActionGreylist, spamActionReject, spamActionReject},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/settings/backends", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := c.saveBackends(r); err != nil {
+		t.Fatalf("error saving backends: %v", err)
+	}
+	conf := loadSavedConfig(t, c)
+	if !conf.Rspamd.Use || conf.Rspamd.Host != "rspamd" || conf.Rspamd.Port != 11333 || conf.Spamd.Use || conf.Strategy != strategyRspamd {
+		t.Errorf("expected rspamd backend, got %v %v %s", conf.Spamd, conf.Rspamd, conf.Strategy)
+	}
+	if len(conf.Actions) != 2 || conf.Actions[4.0] != spamActionGreylist || conf.Actions[12.5] != spamActionReject {
+		t.Errorf("expected two actions, got %v", conf.Actions)
+	}
+	for _, f := range []url.Values{
+		{"strategy": {"unknown"}, "spamdUse": {"on"}, "score": {"4"}, "action": {spamActionReject}},
+		{"strategy": {strategyRspamd}, "spamdUse": {"on"}, "score": {"4"}, "action": {spamActionReject}},
+		{"strategy": {strategyAverage}, "score": {"4"}, "action": {spamActionReject}},
+		{"strategy": {strategyAverage}, "score": {"4", "4.0"}, "action": {spamActionReject, spamActionReject}},
+		{"strategy": {strategyAverage}, "score": {"x"}, "action": {spamActionReject}},
+		{"strategy": {strategyAverage}, "score": {""}, "action": {spamActionReject}},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/settings/backends", strings.NewReader(f.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := c.saveBackends(r); err == nil {
+			t.Errorf("expected error for %v", f)
+		}
+	}
+}
+
+func TestSettingsAdminOnly(t *testing.T) {
+	c := setupSettingsConfiguration(t)
+	for _, name := range []string{"alice", "root"} {
+		w := postForm(c, "/login", url.Values{"username": {name}, "password": {"secret"}}, nil)
+		var ck *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == cookieSession {
+				ck = c
+			}
+		}
+		if ck == nil {
+			t.Fatalf("expected session cookie after login of %s", name)
+		}
+		expected := http.StatusForbidden
+		if name == "root" {
+			expected = http.StatusOK
+		}
+		for _, page := range []string{"/settings.html", "/accountEdit.html"} {
+			r := httptest.NewRequest(http.MethodGet, page, nil)
+			r.AddCookie(ck)
+			w = httptest.NewRecorder()
+			c.handlerIndex(w, r)
+			if w.Code != expected {
+				t.Errorf("expected %d for %s of %s, got %d", expected, page, name, w.Code)
+			}
+		}
+		csrf := sessions.get(ck.Value, time.Hour).csrf
+		w = postForm(c, "/settings/account/delete", url.Values{"a": {"bob-mail"}, "csrf": {csrf}}, ck)
+		if name == "alice" && w.Code != http.StatusForbidden {
+			t.Errorf("expected 403 for alice, got %d", w.Code)
+		}
+		if name == "root" && (w.Code != http.StatusFound || strings.Contains(readConfig(t, c), "bob-mail")) {
+			t.Errorf("expected root to delete bob-mail, got %d", w.Code)
+		}
+	}
+}
+
+func TestTestConnection(t *testing.T) {
+	ic, _ := startTestImapServer(t, testKey)
+	mailboxes, err := ic.testConnection(testKey)
+	if err != nil {
+		t.Fatalf("error testing connection: %v", err)
+	}
+	if !contains(mailboxes, defaultImapInbox) {
+		t.Errorf("expected INBOX in %v", mailboxes)
+	}
+	ic.password = "wrong"
+	if _, err := ic.testConnection(testKey); err == nil {
+		t.Errorf("expected error for a wrong password")
+	}
+}
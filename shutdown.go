@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is the time to finish the active run and the web requests after SIGTERM
+const shutdownTimeout = 30 * time.Second
+
+// stopOnSignal stops new runs on SIGTERM or SIGINT. The returned channel is closed when a signal arrives.
+func (conf *Configuration) stopOnSignal() <-chan struct{} {
+	stopped := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		s := <-sig
+		signal.Stop(sig)
+		log.Infof("%s received, stopping after the current message", s)
+		conf.stopRuns()
+		close(stopped)
+	}()
+	return stopped
+}
+
+// stopRuns lets the active run finish the current message and rejects new runs
+func (conf *Configuration) stopRuns() {
+	conf.stopOnce.Do(func() {
+		if conf.stop == nil {
+			conf.stop = make(chan struct{})
+		}
+		close(conf.stop)
+	})
+}
+
+// stopping reports if eatspam is shutting down
+func (conf *Configuration) stopping() bool {
+	select {
+	case <-conf.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops the web ui, waits for the active run and logs out the IMAP sessions. It gives up after shutdownTimeout.
+func (conf *Configuration) shutdown(servers ...*http.Server) {
+	conf.stopRuns()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warnf("error stopping web ui on %s: %v", srv.Addr, err)
+		}
+	}
+	if !conf.waitForRun(ctx) {
+		log.Warnf("active run did not finish within %s. Exiting without logout", shutdownTimeout)
+		return
+	}
+	conf.logoutSessions()
+	log.Info("eatspam stopped")
+}
+
+// waitForRun stops the scheduler and waits for the active run until ctx is done. The run lock is kept, so no run
+// starts afterwards.
+func (conf *Configuration) waitForRun(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		if conf.scheduler != nil {
+			// waits for the running jobs
+			conf.scheduler.Stop()
+		}
+		conf.cronMu.Lock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"github.com/emersion/go-imap/backend/memory"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRunScanStopping(t *testing.T) {
+	c := setupTestConfiguration()
+	c.ImapAccounts = []*ImapConfiguration{{Name: "a1"}}
+	c.stopRuns()
+	c.stopRuns()
+	if _, ok := c.runScan(c.ImapAccounts...); ok {
+		t.Errorf("expected no run while shutting down")
+	}
+	results := c.checkAccounts(c.ImapAccounts...)
+	if len(results) != 1 || results[0].Error == "" {
+		t.Errorf("expected skipped account, got %v", results)
+	}
+}
+
+func TestCheckSpamStopping(t *testing.T) {
+	key := generateKey()
+	ic, be := startTestImapServer(t, key)
+	addTestMessage(t, be, testMail)
+	c := setupTestConfiguration()
+	c.key = key
+	c.ImapAccounts = []*ImapConfiguration{ic}
+	c.stopRuns()
+	rr := RunResult{Actions: map[string]int{}}
+	if err := ic.checkSpam(c, &rr); err != nil {
+		t.Fatalf("error checking spam: %v", err)
+	}
+	if rr.Checked != 0 {
+		t.Errorf("expected no checked mails after stop, got %d", rr.Checked)
+	}
+	ic.logoutSession()
+}
+
+// addTestMessage appends an unseen message to the INBOX of the test server
+func addTestMessage(t *testing.T, be *memory.Backend, msg string) {
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(defaultImapInbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(msg)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	key := generateKey()
+	ic, _ := startTestImapServer(t, key)
+	c := setupTestConfiguration()
+	c.key = key
+	c.ImapAccounts = []*ImapConfiguration{ic}
+	if err := ic.openSession(key); err != nil {
+		t.Fatalf("error opening session: %v", err)
+	}
+	ic.closeSession()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	served := make(chan error)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	// an active run delays the shutdown until it is finished
+	c.cronMu.Lock()
+	finished := make(chan time.Time, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		finished <- time.Now()
+		c.cronMu.Unlock()
+	}()
+	c.shutdown(srv)
+	stopped := time.Now()
+
+	if stopped.Before(<-finished) {
+		t.Errorf("expected shutdown to wait for the active run")
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("expected closed server, got %v", err)
+	}
+	if ic.client != nil {
+		t.Errorf("expected imap session to be logged out")
+	}
+	if _, ok := c.runScan(c.ImapAccounts...); ok {
+		t.Errorf("expected no run after shutdown")
+	}
+}
@@ -17,8 +17,8 @@ func (conf *SpamdConfiguration) spamdCheckIfSpam(s string, actions map[float64]s
 
 	msg := strings.NewReader(s)
 
-	// Check if a message is spam.
-	check, err := c.Check(ctx, msg, nil)
+	// Check if a message is spam and get the symbols that matched.
+	check, err := c.Symbols(ctx, msg, nil)
 	if err != nil {
 		result <- checkSpamResult{score: 0.0, action: spamActionNoAction, err: err}
 	} else {
@@ -28,7 +28,7 @@ func (conf *SpamdConfiguration) spamdCheckIfSpam(s string, actions map[float64]s
 				a = v
 			}
 		}
-		result <- checkSpamResult{score: check.Score, action: a, err: nil}
+		result <- checkSpamResult{score: check.Score, action: a, symbols: check.Symbols, err: nil}
 	}
 
 	// Report ham for training.
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	tlsModeImplicit = "tls"
+	tlsModeStarttls = "starttls"
+	tlsModeNone     = "none"
+)
+
+// tlsConfig creates the TLS configuration to connect to the IMAP server of the account
+func (ic *ImapConfiguration) tlsConfig() (*tls.Config, error) {
+	tc := ic.TlsConfig
+	config := tls.Config{
+		ServerName:         ic.Host,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+	if tc.ServerName != "" {
+		config.ServerName = tc.ServerName
+	}
+	if tc.CaFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(tc.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca file: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", tc.CaFile)
+		}
+		config.RootCAs = pool
+	}
+	if tc.CertFile != "" || tc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if tc.Pin != "" {
+		pin, err := parseFingerprint(tc.Pin)
+		if err != nil {
+			return nil, err
+		}
+		// the pinned certificate replaces the verification with the ca certificates
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+			fp := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(fp[:], pin) {
+				return fmt.Errorf("server certificate with fingerprint %s does not match the pinned certificate", hex.EncodeToString(fp[:]))
+			}
+			return nil
+		}
+	}
+	return &config, nil
+}
+
+// parseFingerprint parses a SHA-256 fingerprint in hex with optional colons, e.g. the output of
+// openssl x509 -noout -fingerprint -sha256
+func parseFingerprint(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "sha256:")
+	fp, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(fp) != sha256.Size {
+		return nil, fmt.Errorf("illegal certificate pin '%s', expected a SHA-256 fingerprint in hex", s)
+	}
+	return fp, nil
+}
+
+// isLoopback reports if host is localhost or a loopback address
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseFingerprint(t *testing.T) {
+	fp := "AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89"
+	b, err := parseFingerprint(fp)
+	if err != nil || len(b) != 32 || b[0] != 0xab {
+		t.Errorf("error parsing fingerprint: %v, %x", err, b)
+	}
+	for _, fp := range []string{"", "abcd", "zz" + fp[2:]} {
+		if _, err := parseFingerprint(fp); err == nil {
+			t.Errorf("expected error for '%s'", fp)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for host, expected := range map[string]bool{"localhost": true, "127.0.0.1": true, "::1": true, "imap.example.com": false, "192.168.1.1": false} {
+		if isLoopback(host) != expected {
+			t.Errorf("expected %v for %s", expected, host)
+		}
+	}
+}
+
+func TestTlsModes(t *testing.T) {
+	key := generateKey()
+	for _, mode := range []string{tlsModeImplicit, tlsModeStarttls, tlsModeNone} {
+		ic, _ := startTestImapServerMode(t, key, mode)
+		if err := ic.openSession(key); err != nil {
+			t.Errorf("error connecting with tls mode %s: %v", mode, err)
+			continue
+		}
+		ic.closeSession()
+		ic.logoutSession()
+	}
+}
+
+func TestTlsVerification(t *testing.T) {
+	key := generateKey()
+	ic, _ := startTestImapServer(t, key)
+	pin, err := parseFingerprint(ic.TlsConfig.Pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin[0] ^= 0x01
+	ic.TlsConfig.Pin = hex.EncodeToString(pin)
+	if err := ic.connect(); err == nil {
+		t.Errorf("expected connection with wrong pin to fail")
+	}
+	// without a pin the self-signed certificate is not trusted
+	ic.TlsConfig.Pin = ""
+	if err := ic.connect(); err == nil {
+		t.Errorf("expected connection with untrusted certificate to fail")
+	}
+	ic.TlsConfig.InsecureSkipVerify = true
+	if err := ic.connect(); err != nil {
+		t.Errorf("error connecting without verification: %v", err)
+	} else {
+		ic.logout()
+	}
+	// starttls must not fall back to plaintext
+	ic, _ = startTestImapServerMode(t, key, tlsModeNone)
+	ic.TlsMode = tlsModeStarttls
+	if err := ic.connect(); err == nil {
+		t.Errorf("expected starttls to fail on a server without STARTTLS")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+	// legacyUser is the name of the admin who logs in with http.password
+	legacyUser = "admin"
+)
+
+// dummyHash is compared for unknown users, so the login takes the same time for known and unknown users
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("eatspam"), bcrypt.DefaultCost)
+
+// UserConfiguration is a user of the web ui. A user with role user only sees the listed IMAP accounts.
+type UserConfiguration struct {
+	Name         string   `yaml:"name,omitempty"`
+	PasswordHash string   `yaml:"passwordHash,omitempty"`
+	Role         string   `yaml:"role,omitempty"`
+	Accounts     []string `yaml:"accounts,omitempty"`
+}
+
+// webUser is the user of a session
+type webUser struct {
+	name     string
+	role     string
+	accounts map[string]bool
+}
+
+// hashPassword creates the bcrypt hash of a password for passwordHash
+func hashPassword(pw string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// validateUsers checks the configured users and sets the default role
+func (conf *Configuration) validateUsers() error {
+	names := map[string]bool{}
+	for i := range conf.Http.Users {
+		u := &conf.Http.Users[i]
+		if u.Name == "" {
+			return fmt.Errorf("missing arguments for http user. name is needed")
+		}
+		if u.PasswordHash == "" && conf.Http.ForwardAuth.Header == "" {
+			return fmt.Errorf("missing passwordHash for http user %s. It is only optional with http.forwardAuth", u.Name)
+		}
+		if names[u.Name] {
+			return fmt.Errorf("http user %s is configured twice", u.Name)
+		}
+		names[u.Name] = true
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); u.PasswordHash != "" && err != nil {
+			return fmt.Errorf("passwordHash of http user %s is no bcrypt hash. Use eatspam --hashPassword <password>", u.Name)
+		}
+		if u.Role == "" {
+			u.Role = roleUser
+		}
+		if u.Role != roleAdmin && u.Role != roleUser {
+			return fmt.Errorf("unknown role '%s' for http user %s. Use %s or %s", u.Role, u.Name, roleAdmin, roleUser)
+		}
+		for _, a := range u.Accounts {
+			if conf.accountByName(a) == nil {
+				return fmt.Errorf("unknown imap account '%s' for http user %s", a, u.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// authenticateUser returns the user with name and password. Without a name the legacy http.password logs in as admin.
+func (conf *Configuration) authenticateUser(name string, pw string) *webUser {
+	if name == "" || (name == legacyUser && conf.userByName(legacyUser) == nil) {
+		if conf.Http.password != "" && constantTimeEqual(conf.Http.password, pw) {
+			return &webUser{name: legacyUser, role: roleAdmin}
+		}
+		return nil
+	}
+	u := conf.userByName(name)
+	if u == nil || u.PasswordHash == "" {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(pw))
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(pw)) != nil {
+		return nil
+	}
+	return u.webUser()
+}
+
+// webUser creates the user of a session
+func (u *UserConfiguration) webUser() *webUser {
+	wu := webUser{name: u.Name, role: u.Role, accounts: map[string]bool{}}
+	for _, a := range u.Accounts {
+		wu.accounts[a] = true
+	}
+	return &wu
+}
+
+func (conf *Configuration) userByName(name string) *UserConfiguration {
+	for i := range conf.Http.Users {
+		if conf.Http.Users[i].Name == name {
+			return &conf.Http.Users[i]
+		}
+	}
+	return nil
+}
+
+// isAdmin reports if the user may see all accounts and change global settings
+func (u *webUser) isAdmin() bool {
+	return u.role == roleAdmin
+}
+
+// canSee reports if the user may see the IMAP account
+func (u *webUser) canSee(account string) bool {
+	return u.isAdmin() || u.accounts[account]
+}
+
+// visibleAccounts returns the IMAP accounts the user may see
+func (conf *Configuration) visibleAccounts(u *webUser) []*ImapConfiguration {
+	accounts := make([]*ImapConfiguration, 0)
+	for _, ic := range conf.ImapAccounts {
+		if u.canSee(ic.Name) {
+			accounts = append(accounts, ic)
+		}
+	}
+	return accounts
+}
+
+// visibleMails returns the queued mails of the accounts the user may see
+func visibleMails(u *webUser, elements []*QueueElement) []*QueueElement {
+	mails := make([]*QueueElement, 0)
+	for _, qe := range elements {
+		if qe.Account != nil && u.canSee(qe.Account.Name) {
+			mails = append(mails, qe)
+		}
+	}
+	return mails
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func setupUsersConfiguration(t *testing.T) *Configuration {
+	c := setupHttpConfiguration(t)
+	c.ImapAccounts = []*ImapConfiguration{
+		{Name: "alice-mail", Host: "imap.example.com"},
+		{Name: "bob-mail", Host: "imap.example.com"},
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+	c.Http.Users = []UserConfiguration{
+		{Name: "alice", PasswordHash: string(hash), Accounts: []string{"alice-mail"}},
+		{Name: "root", PasswordHash: string(hash), Role: roleAdmin},
+	}
+	if err := c.validateUsers(); err != nil {
+		t.Fatalf("error validating users: %v", err)
+	}
+	return c
+}
+
+func TestAuthenticateUser(t *testing.T) {
+	c := setupUsersConfiguration(t)
+	if u := c.authenticateUser("alice", "secret"); u == nil || u.isAdmin() || !u.canSee("alice-mail") || u.canSee("bob-mail") {
+		t.Errorf("expected alice as user for alice-mail, got %v", u)
+	}
+	if u := c.authenticateUser("root", "secret"); u == nil || !u.isAdmin() || !u.canSee("bob-mail") {
+		t.Errorf("expected root as admin, got %v", u)
+	}
+	// http.password logs in as admin without a user name
+	if u := c.authenticateUser("", "password"); u == nil || !u.isAdmin() || u.name != legacyUser {
+		t.Errorf("expected legacy admin, got %v", u)
+	}
+	for _, login := range [][2]string{{"alice", "wrong"}, {"unknown", "secret"}, {"", "secret"}, {"alice", "password"}} {
+		if u := c.authenticateUser(login[0], login[1]); u != nil {
+			t.Errorf("expected login of %s to fail", login[0])
+		}
+	}
+}
+
+func TestValidateUsers(t *testing.T) {
+	c := setupUsersConfiguration(t)
+	if c.Http.Users[0].Role != roleUser {
+		t.Errorf("expected default role %s, got %s", roleUser, c.Http.Users[0].Role)
+	}
+	tests := []UserConfiguration{
+		{Name: "x", PasswordHash: "plain"},
+		{Name: "x", PasswordHash: c.Http.Users[0].PasswordHash, Role: "root"},
+		{Name: "x", PasswordHash: c.Http.Users[0].PasswordHash, Accounts: []string{"unknown"}},
+		{Name: "alice", PasswordHash: c.Http.Users[0].PasswordHash},
+	}
+	for _, u := range tests {
+		c := setupUsersConfiguration(t)
+		c.Http.Users = append(c.Http.Users, u)
+		if err := c.validateUsers(); err == nil {
+			t.Errorf("expected error for user %v", u)
+		}
+	}
+}
+
+func TestUserVisibility(t *testing.T) {
+	c := setupUsersConfiguration(t)
+	w := postForm(c, "/login", url.Values{"username": {"alice"}, "password": {"secret"}}, nil)
+	var ck *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieSession {
+			ck = c
+		}
+	}
+	if ck == nil {
+		t.Fatalf("expected session cookie after login, got %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+	r.AddCookie(ck)
+	w = httptest.NewRecorder()
+	c.handlerIndex(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "alice-mail") || strings.Contains(body, "bob-mail") {
+		t.Errorf("expected only alice-mail on the index page")
+	}
+	r = httptest.NewRequest(http.MethodGet, "/account.html?a=bob-mail", nil)
+	r.AddCookie(ck)
+	w = httptest.NewRecorder()
+	c.handlerIndex(w, r)
+	if w.Code != http.StatusFound {
+		t.Errorf("expected redirect for an account of another user, got %d", w.Code)
+	}
+	u := c.authenticateUser("alice", "secret")
+	mails := visibleMails(u, []*QueueElement{{Id: "1", Account: c.ImapAccounts[0]}, {Id: "2", Account: c.ImapAccounts[1]}})
+	if len(mails) != 1 || mails[0].Id != "1" {
+		t.Errorf("expected only the mail of alice-mail, got %v", mails)
+	}
+}